@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/eval"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/provider"
+)
+
+// runEval scores the prompts against the diffs of the corpus
+// and writes the scorecard
+func runEval(args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("diffreviewer eval", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading config: %v\n", err)
+		return exitError
+	}
+	if err := prompts.Default.Load(); err != nil {
+		fmt.Fprintf(stderr, "Error reading prompts: %v\n", err)
+		return exitError
+	}
+	cfg.RegisterFlags(flagSet)
+	corpus := flagSet.String("corpus", "eval", "folder with the cases and their diffs")
+	promptFlag := flagSet.String("prompts", "", "comma separated names or numbers of the prompts, default all")
+	modelNames := flagSet.String("models", "", "comma separated models of the provider, default --model")
+	format := flagSet.String("format", "md", "format of the scorecard: md or json")
+	output := flagSet.String("output", "-", "file to write the scorecard to, - is stdout")
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: diffreviewer eval [flags]\n\n"+
+			"Reviews the diffs of the corpus with every prompt and model, and scores\n"+
+			"how many of the planted issues the reviews mention. Record a run with\n"+
+			"--record and replay it offline with --provider fake --cassette.\n\n")
+		flagSet.PrintDefaults()
+		fmt.Fprintf(stderr, "\nPrompts:\n%s\nProviders:\n%s", promptNames(prompts.Default), provider.Usage())
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+	if flagSet.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments: %v\n", flagSet.Args())
+		return exitError
+	}
+	if *format != "md" && *format != "json" {
+		fmt.Fprintf(stderr, "unknown format %q, choose md or json\n", *format)
+		return exitError
+	}
+
+	cases, err := eval.LoadCorpus(*corpus)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	list, err := selectPrompts(*promptFlag)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	ctx := context.Background()
+	models, err := evalModels(ctx, cfg, *modelNames)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	fmt.Fprintf(stderr, "Evaluating %d prompts with %d models on %d cases\n", len(list), len(models), len(cases))
+	card := eval.Run(ctx, list, models, cases, func(result eval.Result) {
+		found := 0
+		for _, issue := range result.Found {
+			if issue.How != "" {
+				found++
+			}
+		}
+		fmt.Fprintf(stderr, "%s, %s, %s: %d/%d\n", result.Prompt, result.Model, result.Case, found, len(result.Found))
+	})
+	for _, model := range models {
+		if err := model.Action.DeleteFiles(ctx); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+	}
+
+	report := card.Markdown()
+	if *format == "json" {
+		contents, err := json.MarshalIndent(card, "", "  ")
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		report = string(contents) + "\n"
+	}
+	if *output == "-" {
+		_, err = io.WriteString(stdout, report)
+	} else {
+		err = os.WriteFile(*output, []byte(report), 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	return exitOK
+}
+
+// selectPrompts finds the prompts by name or number,
+// all prompts when names is empty
+func selectPrompts(names string) ([]prompts.Prompt, error) {
+	if names == "" {
+		return prompts.List(), nil
+	}
+	var list []prompts.Prompt
+	for _, name := range strings.Split(names, ",") {
+		prompt, ok := prompts.Find(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown prompt %q, choose from:\n%s", name, promptNames(prompts.Default))
+		}
+		list = append(list, prompt)
+	}
+
+	return list, nil
+}
+
+// evalModels creates a model of the provider for every name,
+// the configured model when there are no names
+func evalModels(ctx context.Context, cfg config.Config, names string) ([]eval.Model, error) {
+	list := []string{provider.ModelName(cfg)}
+	if names != "" {
+		list = strings.Split(names, ",")
+	}
+	// the recorder writes its cassette for every call, two
+	// models would overwrite each other
+	if cfg.Record != "" && len(list) > 1 {
+		return nil, errors.New("--record records a single model, leave out --models or give one")
+	}
+
+	var models []eval.Model
+	for _, name := range list {
+		cfg.Model = strings.TrimSpace(name)
+		action, err := provider.New(ctx, cfg, "")
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, eval.Model{Name: provider.ModelName(cfg), Action: action})
+	}
+
+	return models, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+)
+
+func TestRunEvalReplay(t *testing.T) {
+	corpus, err := filepath.Abs(filepath.Join("..", "..", "eval"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cassette := setupReview(t, "")
+	// a review per case, in the order of the names, the
+	// missed issues of the average case are judged
+	err = (&fakemodel.Cassette{Interactions: []fakemodel.Interaction{
+		{Method: "ReviewFile", Result: "The loop reads out of range."},
+		{Method: "ChatMessage", Result: "NO"},
+		{Method: "ReviewFile", Result: "A data race, the map is written without the lock. Set returns before the value is stored."},
+		{Method: "ReviewFile", Result: "SQL injection. The error of Scan is ignored."},
+	}}).Save(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := runEval([]string{"--provider", "fake", "--cassette", cassette, "--corpus", corpus,
+		"--prompts", "1"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "| fake | 5/6 | 83% | 0 |") ||
+		!strings.Contains(stdout.String(), "average: an empty slice divides by zero") {
+		t.Errorf("unexpected scorecard\n%s", stdout.String())
+	}
+}
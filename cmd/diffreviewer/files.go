@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+const filesUsage = `Usage: diffreviewer files [list | prune [flags] | delete <name>...]
+
+Manages the files uploaded to the gemini api with GEMINI_API_KEY. A
+diff larger than %d bytes is uploaded for a review, a session deletes
+its files when it ends. Files of a session that did not end are
+reused for the same diff and expire after 48 hours, or prune them.
+
+`
+
+// runFiles lists, prunes and deletes the files uploaded to gemini
+func runFiles(args []string, stdout, stderr io.Writer) int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading config: %v\n", err)
+		return exitError
+	}
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if cfg.Provider == "gemini" && cfg.APIKey != "" {
+		apiKey = cfg.APIKey
+	}
+
+	command := "list"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	flagSet := flag.NewFlagSet("diffreviewer files prune", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	olderThan := flagSet.Duration("older-than", time.Hour, "prune the files uploaded longer ago, running sessions use the newer")
+	all := flagSet.Bool("all", false, "also prune the files that were not uploaded by aifun")
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, filesUsage, genaimodel.InlineDiffMax)
+		flagSet.PrintDefaults()
+	}
+	if command == "prune" {
+		if err := flagSet.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return exitOK
+			}
+			return exitError
+		}
+		args = flagSet.Args()
+	}
+	if apiKey == "" {
+		fmt.Fprintln(stderr, "no api key, set GEMINI_API_KEY or apiKey in the config")
+		return exitError
+	}
+
+	ctx := context.Background()
+	files, err := genaimodel.NewFiles(ctx, apiKey)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	switch {
+	case command == "list" && len(args) == 0:
+		list, err := files.List(ctx)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if len(list) == 0 {
+			fmt.Fprintln(stdout, "No uploaded files")
+			return exitOK
+		}
+		if err := printFiles(stdout, list); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	case command == "prune" && len(args) == 0:
+		deleted, err := files.Prune(ctx, time.Now().Add(-*olderThan), *all)
+		for _, file := range deleted {
+			fmt.Fprintf(stdout, "Deleted %s %s\n", file.Name, file.DisplayName)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if len(deleted) == 0 {
+			fmt.Fprintln(stdout, "No files to prune")
+		}
+	case command == "delete" && len(args) > 0:
+		for _, name := range args {
+			if err := files.Delete(ctx, name); err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+			fmt.Fprintf(stdout, "Deleted %s\n", name)
+		}
+	default:
+		flagSet.Usage()
+		return exitError
+	}
+
+	return exitOK
+}
+
+// printFiles shows the files as table, the files
+// uploaded by aifun are marked with a star
+func printFiles(stdout io.Writer, list []genaimodel.UploadedFile) error {
+	table := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "name\taifun\tsize\tuploaded\texpires\tstate\t\n")
+	for _, file := range list {
+		ours := ""
+		if file.Ours() {
+			ours = "*"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\t%s\t\n", file.Name, ours, file.Size,
+			file.Created.Local().Format("2006-01-02 15:04"), file.Expires.Local().Format("2006-01-02 15:04"), file.State)
+	}
+
+	return table.Flush()
+}
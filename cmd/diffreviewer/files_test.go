@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunFiles(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `{"files":[{"name":"files/a","displayName":"aifun-1234","sizeBytes":"42",`+
+				`"createTime":%q,"state":"ACTIVE"},{"name":"files/b","displayName":"report.pdf","createTime":%q}]}`, old, old)
+		case http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			fmt.Fprint(w, "{}")
+		}
+	}))
+	defer server.Close()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("AIFUN_CONFIG", "")
+	t.Setenv("GEMINI_API_KEY", "key")
+	t.Setenv("GOOGLE_GEMINI_BASE_URL", server.URL)
+
+	var stdout, stderr bytes.Buffer
+	if code := runFiles([]string{"list"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	lines := strings.Split(stdout.String(), "\n")
+	if len(lines) != 4 || strings.Fields(lines[1])[0] != "files/a" || strings.Fields(lines[1])[1] != "*" ||
+		strings.Fields(lines[1])[2] != "42" {
+		t.Errorf("unexpected list\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := runFiles([]string{"prune", "--older-than", "1h"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	if strings.Join(deleted, ",") != "/v1beta/files/a" || stdout.String() != "Deleted files/a aifun-1234\n" {
+		t.Errorf("expected only the file of aifun to be pruned, got %v\n%s", deleted, stdout.String())
+	}
+
+	if code := runFiles([]string{"upload"}, &stdout, &stderr); code != exitError {
+		t.Errorf("expected exit code %d for an unknown command, got %d", exitError, code)
+	}
+}
@@ -3,23 +3,80 @@ package main
 import (
 	"bufio"
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/chzyer/readline"
 
-	"github.com/MelleKoning/aifun/internal/genainterface"
+	"github.com/MelleKoning/aifun/internal/commands"
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/diffparse"
+	"github.com/MelleKoning/aifun/internal/fileio"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
 	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/provider"
+	"github.com/MelleKoning/aifun/internal/review"
+	"github.com/MelleKoning/aifun/internal/sarif"
+	"github.com/MelleKoning/aifun/internal/session"
 	"github.com/MelleKoning/aifun/internal/terminal"
+	"github.com/MelleKoning/aifun/internal/usage"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "review":
+			os.Exit(runReview(os.Args[2:], os.Stdout, os.Stderr))
+		case "sessions":
+			os.Exit(runSessions(os.Args[2:], os.Stdout, os.Stderr))
+		case "eval":
+			os.Exit(runEval(os.Args[2:], os.Stdout, os.Stderr))
+		case "usage":
+			os.Exit(runUsage(os.Args[2:], os.Stdout, os.Stderr))
+		case "files":
+			os.Exit(runFiles(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Error reading config: %v", err)
+	}
+	cfg.RegisterFlags(flag.CommandLine)
+	diffOptions := gitdiff.DefaultOptions()
+	diffOptions.RegisterFlags(flag.CommandLine)
+	details := prompts.DefaultDetails()
+	details.RegisterFlags(flag.CommandLine)
+	resume := flag.String("resume", "", "id of a saved session to continue, or \"last\"")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of diffreviewer:\n"+
+			"  diffreviewer [flags]         interactive review and chat\n"+
+			"  diffreviewer review [flags]  review without prompting, for pipelines\n"+
+			"  diffreviewer sessions        list, show or delete saved sessions\n"+
+			"  diffreviewer eval [flags]    score the prompts on diffs with planted bugs\n"+
+			"  diffreviewer usage [flags]   report the tokens and costs of the requests\n"+
+			"  diffreviewer files           list or prune the files uploaded to gemini\n\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nProviders:\n%s", provider.Usage())
+	}
+	flag.Parse()
+	if err := diffOptions.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	// the prompt files of the user and the repository
+	if err := prompts.Default.Load(); err != nil {
+		fmt.Println("Error reading prompts:", err)
+	}
+
 	terminal.PrintGlamourString(`
 # Welcome to diffreviewer - genai!
 
-Select a prompt to use for judging the gitdiff.txt
+Select a prompt to use for judging the git diff
 
 > Note: this uses the successor of generative-ai-go which is "google.golang.org/genai"
 
@@ -31,29 +88,54 @@ func main() {
 	`)
 
 	ctx := context.Background()
-	var err error
 
-	systemInstruction := selectAPrompt()
-	modelAction, err := genainterface.NewModel(ctx, systemInstruction)
+	// a resumed session brings its own system instruction
+	var selectedPrompt prompts.Prompt
+	if *resume == "" {
+		selectedPrompt = selectAPrompt()
+	}
+	// the diff is not known yet, the template of the prompt
+	// is filled in again on every review
+	vars := prompts.Collect(ctx, diffOptions, details, "")
+	instruction := selectedPrompt.Instruction(vars)
+	modelAction, err := provider.New(ctx, cfg, instruction)
 	if err != nil {
 		log.Fatalf("Error creating client: %v", err)
 	}
+	sessionAction, err := session.Open(modelAction, cfg.Provider, provider.ModelName(cfg),
+		instruction, *resume)
+	if err != nil {
+		log.Fatalf("Error opening session: %v", err)
+	}
+	sessionAction.CompactAt = cfg.ContextWindow.CompactAt
+	if *resume != "" {
+		selectedPrompt = commands.PromptOf(sessionAction.Current())
+		fmt.Printf("Resumed session %s\n", sessionAction.Current().Summary())
+	}
 
-	//request.filePart, _ = addAFile(ctx, request.client)
-	interactiveSession(ctx, modelAction)
+	runner := commands.NewRunner(sessionAction, selectedPrompt)
+	runner.NewModel = provider.Switcher(cfg)
+	runner.Details = details
+	tracker, err := usage.Open(cfg)
+	if err != nil {
+		log.Fatalf("Error opening the usage: %v", err)
+	}
+	runner.Track(tracker)
+	interactiveSession(ctx, runner, diffOptions)
+	runner.EndSession(ctx)
 }
 
-func selectAPrompt() string {
+func selectAPrompt() prompts.Prompt {
 	reader := bufio.NewReader(os.Stdin)
 
 	// Define a list of prompts
-	prompts := prompts.PromptList
+	promptList := prompts.List()
 
 	// Display the list of prompts
 	terminal.PrintGlamourString("Select a prompt by entering the corresponding number:")
 
 	var promptStrings strings.Builder
-	for title, prompt := range prompts {
+	for title, prompt := range promptList {
 		promptStrings.WriteString(fmt.Sprintf("%d. %s\n", title+1, prompt.Name))
 	}
 	terminal.PrintGlamourString(promptStrings.String())
@@ -63,7 +145,7 @@ func selectAPrompt() string {
 	choiceStr, err := reader.ReadString('\n')
 	if err != nil {
 		fmt.Println("Error reading input:", err)
-		return ""
+		return prompts.Prompt{}
 	}
 
 	// Convert the choice to an integer
@@ -71,30 +153,78 @@ func selectAPrompt() string {
 	_, err = fmt.Sscanf(choiceStr, "%d", &choice)
 	if err != nil {
 		fmt.Println("Could not scan input:", err)
-		return ""
+		return prompts.Prompt{}
 	}
 
 	// Validate the choice
-	if choice < 1 || choice > len(prompts) {
+	if choice < 1 || choice > len(promptList) {
 		fmt.Println("Invalid choice. Exiting...")
-		return ""
+		return prompts.Prompt{}
 	}
 
 	// Use the selected prompt
-	selectedPrompt := prompts[choice-1].Prompt
+	selectedPrompt := promptList[choice-1]
 	fmt.Println("You selected:")
 	terminal.PrintGlamourString(fmt.Sprintf(`%s
 	===========
 	The above prompt will be used as instruction when
-	you upload the gitdiff.txt by typing "file".
-	`, selectedPrompt))
+	you review the git diff by typing "/review", or
+	"/review findings" for a structured review.
+	`, selectedPrompt.Prompt))
 
 	return selectedPrompt
 }
 
-func interactiveSession(ctx context.Context, modelAction genainterface.Action) {
+// words are the commands from before the slash commands,
+// they still work
+var words = map[string]string{
+	"file":     "/" + commands.Review,
+	"findings": "/" + commands.Review + " findings",
+	"prompt":   "/" + commands.Prompt,
+	"sessions": "/" + commands.Load,
+	"new":      "/" + commands.Clear,
+}
 
-	rl, err := readline.New(">")
+// completer completes the slash commands in readline
+type completer struct {
+	runner *commands.Runner
+}
+
+// Do returns what readline adds to the typed line. The
+// completions have the full command name, so an abbreviated
+// command like "/pr x" only gets the rest of its argument
+func (c completer) Do(line []rune, pos int) ([][]rune, int) {
+	typed := strings.TrimLeft(string(line[:pos]), " ")
+	var suffixes [][]rune
+	for _, completion := range c.runner.Complete(typed) {
+		if suffix, ok := completionSuffix(typed, completion); ok {
+			suffixes = append(suffixes, []rune(suffix))
+		}
+	}
+	word := typed[strings.LastIndex(typed, " ")+1:]
+
+	return suffixes, len([]rune(word))
+}
+
+// completionSuffix is the part of the completion after what
+// was typed of the command name, or of the argument
+func completionSuffix(typed, completion string) (string, bool) {
+	if _, arg, found := strings.Cut(typed, " "); found {
+		typed = strings.TrimLeft(arg, " ")
+		_, completion, _ = strings.Cut(completion, " ")
+	}
+	if len(completion) < len(typed) || !strings.EqualFold(completion[:len(typed)], typed) {
+		return "", false
+	}
+
+	return completion[len(typed):], true
+}
+
+func interactiveSession(ctx context.Context, runner *commands.Runner, diffOptions gitdiff.Options) {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       ">",
+		AutoComplete: completer{runner: runner},
+	})
 	if err != nil {
 		log.Fatalf("Error initializing readline: %v", err)
 	}
@@ -108,7 +238,7 @@ func interactiveSession(ctx context.Context, modelAction genainterface.Action) {
 	for {
 
 		// Set the prompt with the color codes
-		terminal.PrintPrompt(modelAction.GetHistoryLength())
+		terminal.PrintPrompt(runner.Action.ContextUsage(ctx).String())
 
 		prompt, err := rl.Readline()
 		if err != nil {
@@ -122,25 +252,153 @@ func interactiveSession(ctx context.Context, modelAction genainterface.Action) {
 			break
 		}
 
-		if prompt == "file" {
-			err := modelAction.ReviewFile()
-			if err != nil {
-				fmt.Println(err)
-			}
+		if command, found := words[prompt]; found {
+			prompt = command
+		}
+		if id, found := strings.CutPrefix(prompt, "resume "); found {
+			prompt = "/" + commands.Load + " " + id
+		}
 
-			// ReviewFile is already sending off
-			// the call to the cloud, so return to for loop
+		if commands.IsCommand(prompt) {
+			runCommand(ctx, runner, diffOptions, prompt)
 			continue
 		}
 
-		if prompt == "prompt" {
-			selectedPrompt := selectAPrompt()
-			modelAction.UpdateSystemInstruction(selectedPrompt)
-			// new prompt will be used in the "file" instruction when
-			// uploading a diff
+		printWarning(runner)
+		requestCtx, stop := interruptible(ctx)
+		result, err := runner.Action.ChatMessage(requestCtx, prompt, printProgress)
+		stop()
+		if genaimodel.Interrupted(err) {
+			// the partial answer is kept in the history as well
+			result += genaimodel.InterruptedMarker
+		} else if err != nil {
+			fmt.Println(err)
 			continue
 		}
+		terminal.PrintGlamourString(result)
+	}
+}
+
+// runCommand runs a slash command, the reviews are
+// streamed here, the other commands by the runner
+func runCommand(ctx context.Context, runner *commands.Runner, diffOptions gitdiff.Options, line string) {
+	input, err := commands.Parse(line)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	result, err := runner.Run(ctx, input)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if result.Output != "" {
+		terminal.PrintGlamourString(result.Output)
+	}
+	if !result.Review {
+		return
+	}
 
-		modelAction.ChatMessage(prompt)
+	diff, ok := getDiff(ctx, diffOptions)
+	if !ok {
+		return
+	}
+	runner.Instruct(ctx, diffOptions, diff)
+	printWarning(runner)
+	if result.Findings {
+		reviewFindings(ctx, runner, diff)
+	} else {
+		reviewFile(ctx, runner, diff)
 	}
 }
+
+// reviewFile reviews the diff with the selected prompt
+// and writes the review to codereview.md
+func reviewFile(ctx context.Context, runner *commands.Runner, diff string) {
+	requestCtx, stop := interruptible(ctx)
+	result, err := runner.Action.ReviewFile(requestCtx, diff, printProgress)
+	stop()
+	if genaimodel.Interrupted(err) {
+		result += genaimodel.InterruptedMarker
+	} else if err != nil {
+		fmt.Println(err)
+		return
+	}
+	terminal.PrintGlamourString(result)
+	fileio.WriteMarkdown(result, "codereview.md")
+}
+
+// reviewFindings does a structured review and writes the
+// findings as markdown, json and sarif
+func reviewFindings(ctx context.Context, runner *commands.Runner, diff string) {
+	requestCtx, stop := interruptible(ctx)
+	findings, err := runner.Action.ReviewFindings(requestCtx, diff, runner.Prompt.Categories, printProgress)
+	stop()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	markdown := review.RenderMarkdown(findings)
+	terminal.PrintGlamourString(markdown)
+	fileio.WriteMarkdown(markdown, "codereview.md")
+	fileio.WriteJSON(review.Report{Findings: findings}, "codereview.json")
+	// without parsed files the lines of the model are used as is
+	files, _ := diffparse.Parse(diff)
+	tool := sarif.Tool{PromptName: runner.Prompt.Name, Provider: runner.Provider, Model: runner.Model}
+	fileio.WriteJSON(sarif.FromFindings(findings, files, tool), "codereview.sarif")
+}
+
+// interruptible is the context of a single request to the
+// model, Ctrl+C stops the request instead of the program
+func interruptible(ctx context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(ctx, os.Interrupt)
+}
+
+// getDiff produces the diff to review, it is not ok
+// when there is an error or nothing to review
+func getDiff(ctx context.Context, diffOptions gitdiff.Options) (string, bool) {
+	diff, err := gitdiff.Diff(ctx, diffOptions)
+	if err != nil {
+		fmt.Println(err)
+		return "", false
+	}
+	if strings.TrimSpace(diff) == "" {
+		fmt.Printf("No changes found in the %s\n", diffOptions.Describe())
+		return "", false
+	}
+	printDiffSummary(diffOptions.Describe(), diff)
+
+	return diff, true
+}
+
+// printDiffSummary shows the size of the diff before
+// it is sent off to the model
+func printDiffSummary(description, diff string) {
+	files, err := diffparse.Parse(diff)
+	if err != nil {
+		fmt.Printf("Reviewing the %s\n", description)
+		return
+	}
+
+	totalAdded, totalRemoved := 0, 0
+	for _, file := range files {
+		added, removed := file.Stats()
+		totalAdded += added
+		totalRemoved += removed
+	}
+	fmt.Printf("Reviewing the %s: %d files, +%d -%d\n", description,
+		len(files), totalAdded, totalRemoved)
+}
+
+// printWarning warns before a request when the costs
+// of this month come near the monthly budget
+func printWarning(runner *commands.Runner) {
+	if warning := runner.Warning(); warning != "" {
+		fmt.Println(warning)
+	}
+}
+
+// printProgress prints a dot for every received chunk
+func printProgress(string) {
+	fmt.Print(".")
+}
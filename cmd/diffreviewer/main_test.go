@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/commands"
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+	"github.com/MelleKoning/aifun/internal/prompts"
+)
+
+func TestCompleter(t *testing.T) {
+	c := completer{runner: commands.NewRunner(fakemodel.New(), prompts.Prompt{})}
+	tests := []struct {
+		typed, want string
+		length      int
+	}{
+		{"/pro", "mpt ", 4},
+		{"/prompt gitreview prompt - o", "nly top 2", 1},
+		{"/pr gitreview prompt - o", "nly top 2", 1},
+		{"/review F", "indings", 1},
+		{"/params temperature=0 se", "ed=", 2},
+	}
+	for _, test := range tests {
+		suffixes, length := c.Do([]rune(test.typed), len([]rune(test.typed)))
+		if len(suffixes) != 1 || string(suffixes[0]) != test.want || length != test.length {
+			t.Errorf("%q: expected %q of %d, got %q of %d", test.typed, test.want, test.length, suffixes, length)
+		}
+	}
+}
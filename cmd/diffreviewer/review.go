@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/diffparse"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/provider"
+	"github.com/MelleKoning/aifun/internal/review"
+	"github.com/MelleKoning/aifun/internal/sarif"
+	"github.com/MelleKoning/aifun/internal/usage"
+)
+
+// exit codes of the review command, so a pipeline can
+// tell failed findings apart from a broken run
+const (
+	exitOK       = 0
+	exitFindings = 1
+	exitError    = 2
+)
+
+var formats = []string{"md", "json", "sarif"}
+
+// runReview is the non-interactive review for pipelines. It
+// never prompts, writes the report and returns the exit code
+func runReview(args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("diffreviewer review", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading config: %v\n", err)
+		return exitError
+	}
+	// the keys are left out already, the warning shows
+	// the pipeline log why the repository config did not apply
+	if len(cfg.Ignored) > 0 {
+		fmt.Fprintf(stderr, "Warning: ignored %s of the .aifun/config.json of the repository, a review for "+
+			"a pipeline takes them only from the user config, env vars or flags\n", strings.Join(cfg.Ignored, ", "))
+	}
+	// a prompt file of the pull request could replace the
+	// prompt of the gate with one that never finds anything
+	library := prompts.NewLibrary(prompts.UserDirs()...)
+	if err := library.Load(); err != nil {
+		fmt.Fprintf(stderr, "Error reading prompts: %v\n", err)
+		return exitError
+	}
+	cfg.RegisterFlags(flagSet)
+	diffOptions := gitdiff.DefaultOptions()
+	diffOptions.RegisterFlags(flagSet)
+	details := prompts.DefaultDetails()
+	details.RegisterFlags(flagSet)
+	promptName := flagSet.String("prompt", prompts.PromptList[0].Name, "name or number of the prompt")
+	format := flagSet.String("format", "md", "format of the report: "+strings.Join(formats, ", "))
+	output := flagSet.String("output", "-", "file to write the report to, - is stdout")
+	failOn := flagSet.String("fail-on", "", "exit with 1 when there are findings of this severity or worse: "+
+		severityNames())
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: diffreviewer review [flags]\n\n"+
+			"Reviews the diff without prompting and exits with 1 when findings\n"+
+			"reach --fail-on, or with 2 on errors.\n\n")
+		flagSet.PrintDefaults()
+		fmt.Fprintf(stderr, "\nPrompts:\n%s\nProviders:\n%s", promptNames(library), provider.Usage())
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+	if flagSet.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments: %v\n", flagSet.Args())
+		return exitError
+	}
+
+	selectedPrompt, ok := library.Find(*promptName)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown prompt %q, choose one of:\n%s", *promptName, promptNames(library))
+		return exitError
+	}
+	var threshold review.Severity
+	if *failOn != "" {
+		threshold, err = review.ParseSeverity(*failOn)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	if !slices.Contains(formats, *format) {
+		fmt.Fprintf(stderr, "unknown format %q, choose one of: %s\n", *format, strings.Join(formats, ", "))
+		return exitError
+	}
+	if err := diffOptions.Validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	ctx := context.Background()
+	diff, err := gitdiff.Diff(ctx, diffOptions)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	findings := []review.Finding{}
+	if strings.TrimSpace(diff) == "" {
+		fmt.Fprintf(stderr, "No changes found in the %s\n", diffOptions.Describe())
+	} else {
+		instruction := selectedPrompt.Instruction(prompts.Collect(ctx, diffOptions, details, diff))
+		modelAction, err := provider.New(ctx, cfg, instruction)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error creating client: %v\n", err)
+			return exitError
+		}
+		tracker, err := usage.Open(cfg)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		labels := usage.Labels{Provider: cfg.Provider, Model: provider.ModelName(cfg), Prompt: selectedPrompt.Name}
+		modelAction.SetUsageHandler(func(u genaimodel.Usage) {
+			tracker.Record(labels, u)
+		})
+		if warning := tracker.Warning(); warning != "" {
+			fmt.Fprintln(stderr, warning)
+		}
+		fmt.Fprintf(stderr, "Reviewing the %s with %q\n", diffOptions.Describe(), selectedPrompt.Name)
+		findings, err = modelAction.ReviewFindings(ctx, diff, selectedPrompt.Categories, func(string) {})
+		// the uploaded diff is not needed after the review
+		if err := modelAction.DeleteFiles(ctx); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+
+	report, err := formatReport(*format, findings, diff, sarif.Tool{
+		PromptName: selectedPrompt.Name,
+		Provider:   cfg.Provider,
+		Model:      provider.ModelName(cfg),
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if *output == "-" {
+		_, err = io.WriteString(stdout, report)
+	} else {
+		err = os.WriteFile(*output, []byte(report), 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	if threshold != "" {
+		if count := review.CountAtLeast(findings, threshold); count > 0 {
+			fmt.Fprintf(stderr, "%d findings of severity %s or worse\n", count, threshold)
+			return exitFindings
+		}
+	}
+
+	return exitOK
+}
+
+func formatReport(format string, findings []review.Finding, diff string, tool sarif.Tool) (string, error) {
+	var value any
+	switch format {
+	case "md":
+		return review.RenderMarkdown(findings), nil
+	case "json":
+		value = review.Report{Findings: findings}
+	case "sarif":
+		// without parsed files the lines of the model are used as is
+		files, _ := diffparse.Parse(diff)
+		value = sarif.FromFindings(findings, files, tool)
+	}
+
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(contents) + "\n", nil
+}
+
+func severityNames() string {
+	var names []string
+	for _, severity := range review.Severities {
+		names = append(names, string(severity))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func promptNames(library *prompts.Library) string {
+	var names strings.Builder
+	for number, prompt := range library.List() {
+		fmt.Fprintf(&names, "  %d. %s\n", number+1, prompt.Name)
+	}
+
+	return names.String()
+}
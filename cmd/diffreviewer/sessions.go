@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/MelleKoning/aifun/internal/session"
+)
+
+const sessionsUsage = `Usage: diffreviewer sessions [list | show <id> | delete <id>...]
+
+Manages the saved chat sessions in ~/.aifun/sessions. Continue
+a session with "diffreviewer --resume <id>", or "--resume last".
+`
+
+// runSessions lists, shows and deletes saved sessions
+func runSessions(args []string, stdout, stderr io.Writer) int {
+	store, err := session.DefaultStore()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	command := "list"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch {
+	case command == "list" && len(args) == 0:
+		sessions, err := store.List()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if len(sessions) == 0 {
+			fmt.Fprintln(stdout, "No saved sessions")
+		}
+		for _, s := range sessions {
+			fmt.Fprintln(stdout, s.Summary())
+		}
+	case command == "show" && len(args) == 1:
+		s, err := store.Load(args[0])
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "%s\nprovider %s, model %s, %d user and %d model tokens (estimated)\n",
+			s.Summary(), s.Provider, s.Model, s.Usage.UserTokens, s.Usage.ModelTokens)
+		for _, message := range s.Messages {
+			fmt.Fprintf(stdout, "\n[%s %s]\n%s\n", message.Role,
+				message.Time.Local().Format("2006-01-02 15:04"), message.Text)
+		}
+	case command == "delete" && len(args) > 0:
+		for _, id := range args {
+			if err := store.Delete(id); err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+			fmt.Fprintf(stdout, "Deleted session %s\n", id)
+		}
+	default:
+		fmt.Fprint(stderr, sessionsUsage)
+		return exitError
+	}
+
+	return exitOK
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/usage"
+)
+
+// runUsage reports the tokens and costs of the
+// requests, grouped by day, session, prompt or model
+func runUsage(args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("diffreviewer usage", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading config: %v\n", err)
+		return exitError
+	}
+	by := flagSet.String("by", usage.ByDay, "group the requests by "+strings.Join(usage.Groups, ", "))
+	days := flagSet.Int("days", 0, "report the last days, 0 for this month")
+	flagSet.Float64Var(&cfg.MonthlyBudget, "monthly-budget", cfg.MonthlyBudget,
+		"monthly budget in dollars to compare this month with")
+	flagSet.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: diffreviewer usage [flags]\n\n"+
+			"Reports the tokens and costs of the requests to the models, recorded\n"+
+			"in ~/.aifun/usage.jsonl. Prices are per million tokens, set them with\n"+
+			"\"prices\" in the config.\n\n")
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitError
+	}
+
+	tracker, err := usage.Open(cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	now := time.Now()
+	var records []usage.Record
+	if *days > 0 {
+		year, month, day := now.AddDate(0, 0, 1-*days).Date()
+		records, err = tracker.Store.Load(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+	} else {
+		records, err = tracker.Month(now)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	rows, err := tracker.Report(records, *by)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	table := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "%s\trequests\tinput\tcached\toutput\tcost\t\n", *by)
+	for _, row := range rows {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\t$%.4f\t\n", row.Key, row.Requests,
+			row.InputTokens, row.CachedTokens, row.OutputTokens, row.Cost)
+	}
+	if err := table.Flush(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if tracker.Budget > 0 {
+		fmt.Fprintf(stdout, "\nMonthly budget: $%.2f\n", tracker.Budget)
+	}
+	if warning := tracker.Warning(); warning != "" {
+		fmt.Fprintln(stdout, warning)
+	}
+
+	return exitOK
+}
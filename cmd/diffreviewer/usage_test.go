@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/usage"
+)
+
+func TestRunUsage(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("AIFUN_CONFIG", "")
+	tracker, err := usage.Open(config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record(usage.Labels{Provider: "gemini", Model: "gemini-2.0-flash", Prompt: "gitreview"},
+		genaimodel.Usage{InputTokens: 1000000, OutputTokens: 1000000})
+
+	var stdout, stderr bytes.Buffer
+	code := runUsage([]string{"--by", "prompt", "--monthly-budget", "0.5"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	lines := strings.Split(stdout.String(), "\n")
+	if strings.Join(strings.Fields(lines[1]), " ") != "gitreview 1 1000000 0 1000000 $0.5000" ||
+		!strings.Contains(stdout.String(), "Over the monthly budget") {
+		t.Errorf("unexpected report\n%s", stdout.String())
+	}
+
+	if code := runUsage([]string{"--by", "week"}, &stdout, &stderr); code != exitError {
+		t.Errorf("expected exit code %d for an unknown group, got %d", exitError, code)
+	}
+}
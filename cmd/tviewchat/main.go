@@ -2,16 +2,49 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 
-	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/commands"
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/provider"
+	"github.com/MelleKoning/aifun/internal/session"
 	"github.com/MelleKoning/aifun/internal/terminal"
 	"github.com/MelleKoning/aifun/internal/tviewview"
+	"github.com/MelleKoning/aifun/internal/usage"
 )
 
 func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cfg.RegisterFlags(flag.CommandLine)
+	diffOptions := gitdiff.DefaultOptions()
+	diffOptions.RegisterFlags(flag.CommandLine)
+	details := prompts.DefaultDetails()
+	details.RegisterFlags(flag.CommandLine)
+	resume := flag.String("resume", "", "id of a saved session to continue, or \"last\"")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of tviewchat:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nProviders:\n%s", provider.Usage())
+	}
+	flag.Parse()
+	if err := diffOptions.Validate(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// the prompt files are read again when they change
+	if err := prompts.Default.Load(); err != nil {
+		fmt.Println("Error reading prompts:", err)
+	}
+
 	mdRenderer, err := terminal.New()
 	if err != nil {
 		fmt.Println(err)
@@ -39,10 +72,40 @@ func main() {
 `
 
 	ctx := context.Background()
-	modelAction, _ := genaimodel.NewModel(ctx, systemPrompt)
+	modelAction, err := provider.New(ctx, cfg, systemPrompt)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// every message is saved, so the chat can be resumed
+	sessionAction, err := session.Open(modelAction, cfg.Provider, provider.ModelName(cfg),
+		systemPrompt, *resume)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sessionAction.CompactAt = cfg.ContextWindow.CompactAt
+
+	// the slash commands work on the saved session, a
+	// resumed session continues with its own prompt
+	selectedPrompt := prompts.Prompt{Name: "architect", Prompt: systemPrompt}
+	if *resume != "" {
+		selectedPrompt = commands.PromptOf(sessionAction.Current())
+	}
+	runner := commands.NewRunner(sessionAction, selectedPrompt)
+	runner.NewModel = provider.Switcher(cfg)
+	runner.Details = details
+	// the tokens of every request are recorded for /usage
+	tracker, err := usage.Open(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	runner.Track(tracker)
 
 	// Create the console view
-	tviewApp := tviewview.New(mdRenderer, modelAction)
+	tviewApp := tviewview.New(mdRenderer, runner, diffOptions)
 
 	// We want to have a default log
 	closeFile := OpenTheLog()
@@ -51,6 +114,7 @@ func main() {
 	if err := tviewApp.Run(); err != nil {
 		log.Fatal(err)
 	}
+	runner.EndSession(ctx)
 }
 
 func OpenTheLog() func() {
@@ -0,0 +1,153 @@
+// Package commands is the slash command layer of the chat input.
+// Both front-ends parse, complete and run the same commands, so
+// a command behaves the same in diffreviewer and tviewchat
+package commands
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names of the commands
+const (
+	Review = "review"
+	Prompt = "prompt"
+	Model  = "model"
+	Params = "params"
+	Save   = "save"
+	Load   = "load"
+	Clear  = "clear"
+	Export = "export"
+	Help   = "help"
+	// Summarise compacts the older messages, Pin keeps
+	// a message out of the summaries
+	Summarise = "summarise"
+	Pin       = "pin"
+	// Usage shows the tokens and costs
+	Usage = "usage"
+)
+
+// Prefix starts a command in the chat input
+const Prefix = "/"
+
+// Command is a slash command of the chat input
+type Command struct {
+	Name string
+	// Args is the hint of the arguments, empty when
+	// the command has no arguments
+	Args        string
+	Description string
+}
+
+// List holds all commands in the order of the help
+var List = []Command{
+	{Name: Review, Args: "[findings | markdown]", Description: "review the git diff, `findings` for a structured review"},
+	{Name: Prompt, Args: "[name or number]", Description: "list the prompts, or use one as system instruction"},
+	{Name: Model, Args: "[name]", Description: "show the model, or continue with another model of the provider"},
+	{Name: Params, Args: "[name=value ... | reset]", Description: "show or set the generation parameters, like `temperature=0.2 seed=1`"},
+	{Name: Save, Args: "[title]", Description: "save the session now, optionally with a new title"},
+	{Name: Load, Args: "[id or last]", Description: "list the saved sessions, or continue one"},
+	{Name: Clear, Description: "start a new, empty session"},
+	{Name: Export, Args: "[file]", Description: "write the chat as markdown, to chat.md by default"},
+	{Name: Summarise, Args: "[list | show number]", Description: "replace the older messages by a summary, `list` and `show` the summarised messages"},
+	{Name: Pin, Args: "[number | last]", Description: "list the messages, or pin one so it is never summarised"},
+	{Name: Usage, Args: "[day | session | prompt | model]", Description: "show the tokens and costs of this session and month"},
+	{Name: Help, Description: "show the commands"},
+}
+
+// Input is a parsed command line
+type Input struct {
+	Command Command
+	// Arg is the rest of the line, trimmed
+	Arg string
+}
+
+// IsCommand is true when the line is a slash command
+func IsCommand(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), Prefix)
+}
+
+// Parse reads a command line like "/load last". A command
+// can be shortened as long as it is not ambiguous
+func Parse(line string) (Input, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	name = strings.TrimPrefix(name, Prefix)
+
+	matches := matching(name)
+	for _, command := range matches {
+		if command.Name == name {
+			matches = []Command{command}
+			break
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Input{}, fmt.Errorf("unknown command %s%s, type %s%s for the commands",
+			Prefix, name, Prefix, Help)
+	case 1:
+		return Input{Command: matches[0], Arg: strings.TrimSpace(arg)}, nil
+	default:
+		return Input{}, fmt.Errorf("%s%s is ambiguous, it can be %s", Prefix, name, names(matches))
+	}
+}
+
+// matching are the commands that start with the name
+func matching(name string) []Command {
+	var matches []Command
+	for _, command := range List {
+		if strings.HasPrefix(command.Name, strings.ToLower(name)) {
+			matches = append(matches, command)
+		}
+	}
+
+	return matches
+}
+
+func names(commands []Command) string {
+	list := make([]string, 0, len(commands))
+	for _, command := range commands {
+		list = append(list, Prefix+command.Name)
+	}
+
+	return strings.Join(list, " ")
+}
+
+// Hint describes what can be typed next: the commands that
+// match a partial name, or the arguments of a command
+func Hint(line string) string {
+	if !IsCommand(line) {
+		return ""
+	}
+	name, _, hasArg := strings.Cut(strings.TrimLeft(line, " "), " ")
+	matches := matching(strings.TrimPrefix(name, Prefix))
+	if len(matches) == 0 {
+		return "unknown command, " + Prefix + Help + " lists the commands"
+	}
+	if len(matches) > 1 && !hasArg {
+		return names(matches)
+	}
+
+	command := matches[0]
+	usage := Prefix + command.Name
+	if command.Args != "" {
+		usage += " " + command.Args
+	}
+
+	return usage + "  " + command.Description
+}
+
+// HelpText lists the commands as markdown
+func HelpText() string {
+	var text strings.Builder
+	text.WriteString("| Command | Description |\n|---|---|\n")
+	for _, command := range List {
+		usage := Prefix + command.Name
+		if command.Args != "" {
+			usage += " " + command.Args
+		}
+		// a | in a cell of the table has to be escaped
+		fmt.Fprintf(&text, "| `%s` | %s |\n", strings.ReplaceAll(usage, "|", `\|`), command.Description)
+	}
+
+	return text.String()
+}
@@ -0,0 +1,377 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/session"
+	"github.com/MelleKoning/aifun/internal/usage"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line, name, arg string
+		fails           bool
+	}{
+		{line: "/review", name: Review},
+		{line: "  /load  last ", name: Load, arg: "last"},
+		{line: "/rev findings", name: Review, arg: "findings"},
+		{line: "/prompt gitreview prompt", name: Prompt, arg: "gitreview prompt"},
+		{line: "/unknown", fails: true},
+	}
+	for _, tt := range tests {
+		input, err := Parse(tt.line)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.line)
+			}
+			continue
+		}
+		if err != nil || input.Command.Name != tt.name || input.Arg != tt.arg {
+			t.Errorf("%q: got %q %q %v", tt.line, input.Command.Name, input.Arg, err)
+		}
+	}
+
+	if !IsCommand(" /help") || IsCommand("what is /help") {
+		t.Error("IsCommand checks the start of the line")
+	}
+}
+
+func TestCompleteAndHint(t *testing.T) {
+	runner := NewRunner(fakemodel.New(), prompts.Prompt{})
+
+	if got := runner.Complete("/c"); !reflect.DeepEqual(got, []string{"/clear"}) {
+		t.Errorf("unexpected completions %q", got)
+	}
+	if got := runner.Complete("/re"); !reflect.DeepEqual(got, []string{"/review "}) {
+		t.Errorf("unexpected completions %q", got)
+	}
+	if got := runner.Complete("/review f"); !reflect.DeepEqual(got, []string{"/review findings"}) {
+		t.Errorf("unexpected completions %q", got)
+	}
+	if got := runner.Complete("/prompt gitreview"); len(got) < 2 ||
+		CommonPrefix(got) != "/prompt gitreview " {
+		t.Errorf("unexpected prompt completions %q", got)
+	}
+	if got := runner.Complete("hello"); got != nil {
+		t.Errorf("expected no completions for a message, got %q", got)
+	}
+
+	if hint := Hint("/load "); !strings.HasPrefix(hint, "/load [id or last]") {
+		t.Errorf("unexpected hint %q", hint)
+	}
+	if hint := Hint("/"); !strings.Contains(hint, "/review") || !strings.Contains(hint, "/help") {
+		t.Errorf("expected all commands, got %q", hint)
+	}
+}
+
+func run(t *testing.T, runner *Runner, line string) Result {
+	t.Helper()
+	input, err := Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := runner.Run(context.Background(), input)
+	if err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+
+	return result
+}
+
+func TestRunSessionCommands(t *testing.T) {
+	store := &session.Store{Dir: t.TempDir()}
+	fake := fakemodel.New("first answer")
+	autosave := session.NewAutosave(fake, store, session.New("fake", "fake", ""))
+	runner := NewRunner(autosave, prompts.Prompt{})
+	if _, err := autosave.ChatMessage(context.Background(), "question", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	id := autosave.Current().ID
+
+	run(t, runner, "/prompt 2")
+	if fake.SystemInstruction != prompts.PromptList[1].Prompt || runner.Prompt.Name != prompts.PromptList[1].Name {
+		t.Error("prompt not applied")
+	}
+
+	run(t, runner, "/save my review")
+	if saved, err := store.Load(id); err != nil || saved.Title != "my review" {
+		t.Errorf("session not saved with the title: %v", err)
+	}
+
+	if result := run(t, runner, "/clear"); !result.Reset || fake.GetHistoryLength() != 0 {
+		t.Error("history not cleared")
+	}
+
+	if result := run(t, runner, "/load"); !strings.Contains(result.Output, id) {
+		t.Errorf("session not listed: %q", result.Output)
+	}
+	result := run(t, runner, "/load "+id)
+	if !result.Reset || fake.GetHistoryLength() != 2 || runner.Prompt.Name != prompts.PromptList[1].Name {
+		t.Errorf("session not resumed: %+v", result)
+	}
+	if got := runner.Complete("/load l"); !reflect.DeepEqual(got, []string{"/load last"}) {
+		t.Errorf("unexpected completions %q", got)
+	}
+
+	file := filepath.Join(t.TempDir(), "chat.md")
+	run(t, runner, "/export "+file)
+	contents, err := os.ReadFile(file)
+	if err != nil || !strings.Contains(string(contents), "## You\n\nquestion") ||
+		!strings.Contains(string(contents), "## Model\n\nfirst answer") {
+		t.Errorf("unexpected export %q %v", contents, err)
+	}
+}
+
+func TestPromptOf(t *testing.T) {
+	store := &session.Store{Dir: t.TempDir()}
+	fake := fakemodel.New("answer")
+	autosave := session.NewAutosave(fake, store, session.New("fake", "fake", ""))
+	runner := NewRunner(autosave, prompts.Prompt{})
+	run(t, runner, "/prompt 1")
+	// the template of the prompt is filled in for the diff
+	runner.Instruct(context.Background(), gitdiff.Options{DiffFile: "gitdiff.txt"},
+		"diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@\n-a\n+b\n")
+	if _, err := autosave.ChatMessage(context.Background(), "question", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := store.Load(autosave.Current().ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(saved.SystemInstruction, "main.go") || PromptOf(saved).Name != prompts.PromptList[0].Name {
+		t.Errorf("the prompt of the session is not found: %q", saved.Prompt)
+	}
+
+	// sessions saved before the name of the prompt was kept
+	older := session.New("fake", "fake", prompts.PromptList[0].Instruction(prompts.Vars{}))
+	if prompt := PromptOf(older); prompt.Name != prompts.PromptList[0].Name {
+		t.Errorf("the prompt of the instruction is not found, got %q", prompt.Name)
+	}
+	other := session.New("fake", "fake", "be brief")
+	other.Title = "chat"
+	if prompt := PromptOf(other); prompt.Name != "chat" || prompt.Prompt != "be brief" {
+		t.Errorf("expected a prompt named after the session, got %+v", prompt)
+	}
+}
+
+func TestRunModel(t *testing.T) {
+	fake := fakemodel.New("answer")
+	if _, err := fake.ChatMessage(context.Background(), "question", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewRunner(fake, prompts.PromptList[0])
+	runner.Provider, runner.Model = "fake", "fake"
+
+	input, _ := Parse("/model other")
+	if _, err := runner.Run(context.Background(), input); err == nil {
+		t.Error("expected an error when models can not be switched")
+	}
+
+	other := fakemodel.New()
+	runner.NewModel = func(_ context.Context, model, instruction string) (genaimodel.Action, error) {
+		return other, nil
+	}
+	run(t, runner, "/model other")
+	if runner.Action != other || runner.Model != "other" || other.GetHistoryLength() != 2 ||
+		other.SystemInstruction != prompts.PromptList[0].Instruction(prompts.Vars{}) {
+		t.Error("model not switched with history and instruction")
+	}
+	if fake.FilesDeleted != 1 || other.FilesDeleted != 0 {
+		t.Errorf("expected the files of the previous model to be deleted, got %d", fake.FilesDeleted)
+	}
+	run(t, runner, "/clear")
+	if other.FilesDeleted != 1 {
+		t.Error("expected a new session to delete the files")
+	}
+	if result := run(t, runner, "/model"); !strings.Contains(result.Output, "**other**") {
+		t.Errorf("unexpected output %q", result.Output)
+	}
+
+	if result := run(t, runner, "/review findings"); !result.Review || !result.Findings {
+		t.Error("expected a structured review")
+	}
+	if result := run(t, runner, "/help"); !strings.Contains(result.Output, "`/export [file]`") {
+		t.Errorf("unexpected help %q", result.Output)
+	}
+}
+
+func TestRunParams(t *testing.T) {
+	fake := fakemodel.New()
+	runner := NewRunner(fake, prompts.PromptList[0])
+
+	if result := run(t, runner, "/params"); !strings.Contains(result.Output, "the defaults of the model") {
+		t.Errorf("unexpected output %q", result.Output)
+	}
+	run(t, runner, "/params temperature=0.2 stop=END")
+	run(t, runner, "/params seed=5 stop=---")
+	if fake.Params.String() != `temperature=0.2 stop="END" stop="---" seed=5` {
+		t.Errorf("parameters not set: %s", fake.Params)
+	}
+	run(t, runner, "/params temperature=")
+	if fake.Params.Temperature != nil {
+		t.Error("an empty value should go back to the default")
+	}
+
+	for _, line := range []string{"/params temperature", "/params temperature=hot", "/params heat=1"} {
+		input, _ := Parse(line)
+		if _, err := runner.Run(context.Background(), input); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+	if fake.Params.Seed == nil || *fake.Params.Seed != 5 {
+		t.Error("a wrong setting should not change the parameters")
+	}
+
+	other := fakemodel.New()
+	runner.NewModel = func(_ context.Context, model, instruction string) (genaimodel.Action, error) {
+		return other, nil
+	}
+	run(t, runner, "/model other")
+	if other.Params.String() != fake.Params.String() {
+		t.Errorf("parameters not kept with the other model: %s", other.Params)
+	}
+	run(t, runner, "/params reset")
+	if other.Params.String() != "the defaults of the model" {
+		t.Errorf("parameters not reset: %s", other.Params)
+	}
+
+	if got := runner.Complete("/params seed=1 te"); len(got) != 1 || got[0] != "/params seed=1 temperature=" {
+		t.Errorf("unexpected completions %q", got)
+	}
+	if got := runner.Complete("/params re"); len(got) != 1 || got[0] != "/params reset" {
+		t.Errorf("unexpected completions %q", got)
+	}
+}
+
+func TestRunSummariseAndPin(t *testing.T) {
+	store := &session.Store{Dir: t.TempDir()}
+	fake := fakemodel.New("answer one", "answer two", "answer three", "the summary")
+	autosave := session.NewAutosave(fake, store, session.New("fake", "fake", ""))
+	runner := NewRunner(autosave, prompts.Prompt{})
+	for _, prompt := range []string{"question one", "question two", "question three"} {
+		if _, err := autosave.ChatMessage(context.Background(), prompt, func(string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(t, runner, "/pin 3")
+	if result := run(t, runner, "/pin"); !strings.Contains(result.Output, "3. user (pinned): question two") {
+		t.Errorf("unexpected list %q", result.Output)
+	}
+	if result := run(t, runner, "/summarise"); !result.Reset || fake.GetHistoryLength() != 6 {
+		t.Errorf("not summarised: %+v, %d messages", result, fake.GetHistoryLength())
+	}
+	if result := run(t, runner, "/summarise list"); !strings.Contains(result.Output, "1. ") {
+		t.Errorf("unexpected list %q", result.Output)
+	}
+	result := run(t, runner, "/summarise show 1")
+	if !strings.Contains(result.Output, "the summary") || !strings.Contains(result.Output, "### You\n\nquestion one") ||
+		strings.Contains(result.Output, "question two") {
+		t.Errorf("unexpected summary %q", result.Output)
+	}
+	for _, line := range []string{"/summarise show 2", "/summarise all", "/pin 99"} {
+		input, _ := Parse(line)
+		if _, err := runner.Run(context.Background(), input); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+
+	withoutSessions := NewRunner(fakemodel.New(), prompts.Prompt{})
+	input, _ := Parse("/pin")
+	if _, err := withoutSessions.Run(context.Background(), input); err == nil {
+		t.Error("expected an error without sessions")
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	store := &session.Store{Dir: t.TempDir()}
+	fake := fakemodel.New("an answer")
+	autosave := session.NewAutosave(fake, store, session.New("fake", "fake", ""))
+	runner := NewRunner(autosave, prompts.PromptList[0])
+
+	if _, err := runner.Run(context.Background(), Input{Command: Command{Name: Usage}}); err == nil {
+		t.Error("expected an error when the usage is not recorded")
+	}
+	tracker := &usage.Tracker{Store: &usage.Store{Path: filepath.Join(t.TempDir(), "usage.jsonl")},
+		Prices: usage.Prices{"fake": {Input: 1000, Output: 1000}}, Budget: 0.001}
+	runner.Track(tracker)
+	if _, err := autosave.ChatMessage(context.Background(), "question", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _ := tracker.Month(time.Now())
+	if len(records) != 1 || records[0].Session != autosave.Current().ID ||
+		records[0].Prompt != prompts.PromptList[0].Name || records[0].OutputTokens == 0 {
+		t.Fatalf("usage not recorded with the labels: %+v", records)
+	}
+	result := run(t, runner, "/usage")
+	if !strings.Contains(result.Output, "This session: 1 requests") || !strings.Contains(result.Output, "| fake/fake | 1 |") {
+		t.Errorf("unexpected usage %q", result.Output)
+	}
+	if result := run(t, runner, "/usage prompt"); !strings.Contains(result.Output, "| "+prompts.PromptList[0].Name+" | 1 |") {
+		t.Errorf("unexpected usage by prompt %q", result.Output)
+	}
+	if warning := runner.Warning(); !strings.HasPrefix(warning, "Over the monthly budget") {
+		t.Errorf("expected a budget warning, got %q", warning)
+	}
+
+	other := fakemodel.New()
+	runner.NewModel = func(_ context.Context, model, instruction string) (genaimodel.Action, error) {
+		return other, nil
+	}
+	run(t, runner, "/model other")
+	if other.OnUsage == nil {
+		t.Error("the usage of the other model is not recorded")
+	}
+}
+
+func TestPromptFilesAndReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "team.md")
+	write := func(text string) {
+		contents := "---\nname: team\nformat: findings\nmodel: big\n---\n" + text
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first version")
+	defer func(library *prompts.Library) { prompts.Default = library }(prompts.Default)
+	prompts.Default = prompts.NewLibrary(dir)
+	if err := prompts.Default.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := fakemodel.New()
+	runner := NewRunner(fake, prompts.Prompt{})
+	if result := run(t, runner, "/prompt team"); !strings.Contains(result.Output, "/model big") {
+		t.Errorf("recommended model not shown: %q", result.Output)
+	}
+	if result := run(t, runner, "/review"); !result.Findings {
+		t.Error("the format of the prompt is not used")
+	}
+	if result := run(t, runner, "/review markdown"); result.Findings {
+		t.Error("the argument should override the format of the prompt")
+	}
+
+	if runner.Reload() {
+		t.Error("nothing changed, nothing to reload")
+	}
+	write("second version")
+	if err := prompts.Default.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.Reload() || fake.SystemInstruction != "second version" {
+		t.Errorf("changed prompt not given to the model: %q", fake.SystemInstruction)
+	}
+}
@@ -0,0 +1,643 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/session"
+	"github.com/MelleKoning/aifun/internal/usage"
+)
+
+const exportFile = "chat.md"
+
+// pinLine is the length of a message in the list of /pin
+const pinLine = 60
+
+var errNoSessions = errors.New("sessions are not saved")
+
+// Result tells the front-end what to show after a command
+type Result struct {
+	// Output is markdown for the user, can be empty
+	Output string
+	// Review asks the front-end to review the diff, it
+	// streams the answer in its own way. Findings asks
+	// for a structured review
+	Review   bool
+	Findings bool
+	// Reset is true when the history was replaced, the
+	// front-end shows the chat again
+	Reset bool
+}
+
+// Runner runs the commands against the model of a front-end
+type Runner struct {
+	// Action is the model, when it saves its sessions the
+	// session commands are available. Read it again after a
+	// command, /model replaces a model without sessions
+	Action genaimodel.Action
+	// Prompt is the selected prompt, its categories are
+	// used for structured reviews
+	Prompt   prompts.Prompt
+	Provider string
+	Model    string
+	// NewModel creates another model of the provider for
+	// /model, nil when the model can not be switched
+	NewModel func(ctx context.Context, model, systemInstruction string) (genaimodel.Action, error)
+	// Details are the description and ticket of the change
+	// for the template of the prompt
+	Details prompts.Details
+
+	// Usage records the tokens of the requests, nil
+	// when they are not recorded. Set it with Track
+	Usage *usage.Tracker
+
+	// vars fill in the template of the prompt, they
+	// are collected for the last reviewed diff
+	vars prompts.Vars
+}
+
+// NewRunner runs the commands for the model
+func NewRunner(action genaimodel.Action, prompt prompts.Prompt) *Runner {
+	r := &Runner{Action: action, Prompt: prompt}
+	if autosave := r.sessions(); autosave != nil {
+		r.Provider = autosave.Current().Provider
+		r.Model = autosave.Current().Model
+		if len(autosave.Current().Messages) == 0 {
+			r.remember(prompt)
+		}
+	}
+
+	return r
+}
+
+// sessions is the autosave of the model, or nil
+func (r *Runner) sessions() *session.Autosave {
+	autosave, _ := r.Action.(*session.Autosave)
+
+	return autosave
+}
+
+// Track records the token usage of every request of
+// the model with the labels of the moment of the request
+func (r *Runner) Track(tracker *usage.Tracker) {
+	r.Usage = tracker
+	r.Action.SetUsageHandler(func(u genaimodel.Usage) {
+		tracker.Record(r.Labels(), u)
+	})
+}
+
+// Labels tell which provider, model, session and
+// prompt a request is for
+func (r *Runner) Labels() usage.Labels {
+	labels := usage.Labels{Provider: r.Provider, Model: r.Model, Prompt: r.Prompt.Name}
+	if autosave := r.sessions(); autosave != nil {
+		labels.Session = autosave.Current().ID
+	}
+
+	return labels
+}
+
+// EndSession deletes the files the model uploaded for the
+// session. An error is logged, the files expire anyway
+func (r *Runner) EndSession(ctx context.Context) {
+	if err := r.Action.DeleteFiles(ctx); err != nil {
+		log.Printf("deleting the uploaded files: %v", err)
+	}
+}
+
+// Warning is the budget warning to show before a
+// request, empty when there is nothing to warn about
+func (r *Runner) Warning() string {
+	if r.Usage == nil {
+		return ""
+	}
+
+	return r.Usage.Warning()
+}
+
+// remember saves the name of the prompt with the session, the
+// instruction is filled in and does not tell the prompt
+func (r *Runner) remember(prompt prompts.Prompt) {
+	if autosave := r.sessions(); autosave != nil {
+		autosave.Current().Prompt = prompt.Name
+	}
+}
+
+// PromptOf finds the prompt of a resumed session by its name,
+// sessions saved without it by their instruction. A session with
+// an instruction that is not in the list gets a prompt named
+// after the session
+func PromptOf(s *session.Session) prompts.Prompt {
+	if s.Prompt != "" {
+		if prompt, ok := prompts.Find(s.Prompt); ok {
+			return prompt
+		}
+	}
+	if prompt, ok := prompts.ByInstruction(s.SystemInstruction); ok {
+		return prompt
+	}
+
+	return prompts.Prompt{Name: s.Title, Prompt: s.SystemInstruction}
+}
+
+// Run executes the command, the caller reviews the diff
+// when the result asks for it
+func (r *Runner) Run(ctx context.Context, input Input) (Result, error) {
+	switch input.Command.Name {
+	case Review:
+		// without argument the format of the prompt is used
+		format := input.Arg
+		if format == "" {
+			format = r.Prompt.Format
+		}
+		switch format {
+		case "", prompts.FormatMarkdown, prompts.FormatFindings:
+		default:
+			return Result{}, fmt.Errorf("unknown review %q, use %s%s %s or %s",
+				input.Arg, Prefix, Review, prompts.FormatFindings, prompts.FormatMarkdown)
+		}
+		return Result{Review: true, Findings: format == prompts.FormatFindings}, nil
+	case Prompt:
+		return r.prompt(input.Arg)
+	case Model:
+		return r.model(ctx, input.Arg)
+	case Params:
+		return r.params(input.Arg)
+	case Save:
+		return r.save(input.Arg)
+	case Load:
+		return r.load(ctx, input.Arg)
+	case Clear:
+		r.EndSession(ctx)
+		if autosave := r.sessions(); autosave != nil {
+			autosave.Start()
+		} else {
+			r.Action.SetHistory(nil)
+		}
+		return Result{Output: "Started a new session\n", Reset: true}, nil
+	case Export:
+		return r.export(input.Arg)
+	case Summarise:
+		return r.summarise(ctx, input.Arg)
+	case Pin:
+		return r.pin(input.Arg)
+	case Usage:
+		return r.usage(input.Arg)
+	case Help:
+		return Result{Output: HelpText()}, nil
+	}
+
+	return Result{}, fmt.Errorf("command %s%s is not implemented", Prefix, input.Command.Name)
+}
+
+func (r *Runner) prompt(name string) (Result, error) {
+	if name == "" {
+		var list strings.Builder
+		for i, prompt := range prompts.List() {
+			marker := ""
+			if prompt.Prompt == r.Prompt.Prompt {
+				marker = " (selected)"
+			}
+			if prompt.Description != "" {
+				marker += " - " + prompt.Description
+			}
+			fmt.Fprintf(&list, "%d. %s%s\n", i+1, prompt.Name, marker)
+		}
+		fmt.Fprintf(&list, "\nSelect one with `%s%s <name or number>`\n", Prefix, Prompt)
+		return Result{Output: list.String()}, nil
+	}
+
+	prompt, ok := prompts.Find(name)
+	if !ok {
+		return Result{}, fmt.Errorf("no prompt %q, %s%s lists the prompts", name, Prefix, Prompt)
+	}
+
+	return Result{Output: r.Use(prompt)}, nil
+}
+
+// Use gives the prompt to the model as system instruction of
+// the session, it returns the message for the user
+func (r *Runner) Use(prompt prompts.Prompt) string {
+	r.Prompt = prompt
+	r.remember(prompt)
+	r.Action.UpdateSystemInstruction(r.Instruction(prompt))
+
+	output := fmt.Sprintf("Using the prompt **%s** as system instruction\n", prompt.Name)
+	if prompt.Model != "" && prompt.Model != r.Model {
+		output += fmt.Sprintf("\nThe prompt recommends the model **%s**, switch with `%s%s %s`\n",
+			prompt.Model, Prefix, Model, prompt.Model)
+	}
+
+	return output
+}
+
+// Instruction is the prompt filled in with the
+// variables of the last reviewed diff
+func (r *Runner) Instruction(prompt prompts.Prompt) string {
+	return prompt.Instruction(r.vars)
+}
+
+// Reload takes the selected prompt from the library again after
+// the prompt files changed. It is true when the instruction of
+// the prompt changed and was given to the model
+func (r *Runner) Reload() bool {
+	prompt, ok := prompts.Find(r.Prompt.Name)
+	if !ok || prompt.Prompt == r.Prompt.Prompt {
+		return false
+	}
+	r.Prompt = prompt
+	r.Action.UpdateSystemInstruction(prompt.Instruction(r.vars))
+
+	return true
+}
+
+// Instruct fills in the template of the selected prompt with
+// the variables of the diff that is about to be reviewed, and
+// gives the result to the model as system instruction
+func (r *Runner) Instruct(ctx context.Context, options gitdiff.Options, diff string) {
+	r.vars = prompts.Collect(ctx, options, r.Details, diff)
+	if prompts.IsTemplate(r.Prompt.Prompt) {
+		r.Action.UpdateSystemInstruction(r.Prompt.Instruction(r.vars))
+	}
+}
+
+func (r *Runner) model(ctx context.Context, name string) (Result, error) {
+	if name == "" || name == r.Model {
+		return Result{Output: fmt.Sprintf("Provider **%s**, model **%s**\n", r.Provider, r.Model)}, nil
+	}
+	if r.NewModel == nil {
+		return Result{}, errors.New("the model can not be switched")
+	}
+
+	instruction := r.Prompt.Instruction(r.vars)
+	autosave := r.sessions()
+	if autosave != nil {
+		// the session can be resumed in the sidebar of tviewchat
+		instruction = autosave.Current().SystemInstruction
+	}
+	action, err := r.NewModel(ctx, name, instruction)
+	if err != nil {
+		return Result{}, err
+	}
+	// the files of the previous model are not reused
+	r.EndSession(ctx)
+	if autosave != nil {
+		autosave.SwitchModel(action, name)
+	} else {
+		action.UpdateSystemInstruction(instruction)
+		action.SetParams(r.Action.GetParams())
+		action.SetUsageHandler(r.Action.GetUsageHandler())
+		action.SetHistory(r.Action.GetHistory())
+		r.Action = action
+	}
+	r.Model = name
+
+	return Result{Output: fmt.Sprintf("Continuing with model **%s**\n", name)}, nil
+}
+
+// params shows the generation parameters, or sets the name=value
+// pairs of the argument. Every request that follows uses them
+func (r *Runner) params(arg string) (Result, error) {
+	if arg == "" {
+		return Result{Output: fmt.Sprintf("Generation parameters: %s\n\n"+
+			"Set them with `%s%s name=value`, the names are %s. An empty value goes back to the "+
+			"default of the model, `%s%s reset` resets all\n",
+			r.Action.GetParams(), Prefix, Params, strings.Join(genaimodel.ParamNames, ", "), Prefix, Params)}, nil
+	}
+
+	var params genaimodel.Params
+	if arg != "reset" {
+		params = r.Action.GetParams()
+		params.StopSequences = append([]string(nil), params.StopSequences...)
+		for _, setting := range strings.Fields(arg) {
+			name, value, ok := strings.Cut(setting, "=")
+			if !ok {
+				return Result{}, fmt.Errorf("use name=value instead of %q, the names are: %s",
+					setting, strings.Join(genaimodel.ParamNames, ", "))
+			}
+			if err := params.Set(name, value); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+	r.Action.SetParams(params)
+
+	return Result{Output: fmt.Sprintf("Generation parameters: %s\n", params)}, nil
+}
+
+func (r *Runner) save(title string) (Result, error) {
+	autosave := r.sessions()
+	if autosave == nil {
+		return Result{}, errNoSessions
+	}
+	current := autosave.Current()
+	if title != "" {
+		current.Title = title
+	}
+	err := autosave.Save()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{Output: fmt.Sprintf("Saved session `%s` %s\n", current.ID, current.Title)}, nil
+}
+
+func (r *Runner) load(ctx context.Context, id string) (Result, error) {
+	autosave := r.sessions()
+	if autosave == nil {
+		return Result{}, errNoSessions
+	}
+	if id == "" {
+		sessions, err := autosave.Store().List()
+		if err != nil {
+			return Result{}, err
+		}
+		if len(sessions) == 0 {
+			return Result{Output: "No saved sessions\n"}, nil
+		}
+		var list strings.Builder
+		list.WriteString("```\n")
+		for _, s := range sessions {
+			list.WriteString(s.Summary() + "\n")
+		}
+		fmt.Fprintf(&list, "```\n\nContinue one with `%s%s <id>`\n", Prefix, Load)
+		return Result{Output: list.String()}, nil
+	}
+
+	s, err := autosave.Store().Load(id)
+	if err != nil {
+		return Result{}, err
+	}
+	r.EndSession(ctx)
+	autosave.Resume(s)
+	r.Prompt = PromptOf(s)
+
+	return Result{Output: fmt.Sprintf("Resumed session `%s` %s\n", s.ID, s.Title), Reset: true}, nil
+}
+
+func (r *Runner) export(file string) (Result, error) {
+	if file == "" {
+		file = exportFile
+	}
+	history := r.Action.GetHistory()
+	err := os.WriteFile(file, []byte(transcript(history, "##")), 0o644)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{Output: fmt.Sprintf("Exported %d messages to `%s`\n", len(history), file)}, nil
+}
+
+// transcript writes the messages as markdown, every
+// message under a heading of the level
+func transcript(history []genaimodel.Message, level string) string {
+	var chat strings.Builder
+	for _, message := range history {
+		heading := "Model"
+		if message.Role == genaimodel.RoleUser {
+			heading = "You"
+		}
+		fmt.Fprintf(&chat, "%s %s\n\n%s\n\n", level, heading, strings.TrimSpace(message.Text))
+	}
+
+	return chat.String()
+}
+
+// summarise replaces the older messages of the session by a
+// summary, or lists and shows the summarised messages
+func (r *Runner) summarise(ctx context.Context, arg string) (Result, error) {
+	autosave := r.sessions()
+	if autosave == nil {
+		return Result{}, errNoSessions
+	}
+	compactions := autosave.Current().Compactions
+	action, number, _ := strings.Cut(arg, " ")
+	switch action {
+	case "":
+		compaction, err := autosave.Compact(ctx)
+		if err != nil {
+			return Result{}, err
+		}
+		return Result{Output: fmt.Sprintf("Summarised %d messages, `%s%s show %d` shows them\n",
+			len(compaction.Messages), Prefix, Summarise, len(autosave.Current().Compactions)), Reset: true}, nil
+	case "list":
+		if len(compactions) == 0 {
+			return Result{Output: "No messages were summarised\n"}, nil
+		}
+		var list strings.Builder
+		for i, compaction := range compactions {
+			fmt.Fprintf(&list, "%d. %s, %d messages\n", i+1,
+				compaction.Time.Local().Format("2006-01-02 15:04"), len(compaction.Messages))
+		}
+		fmt.Fprintf(&list, "\nShow one with `%s%s show <number>`\n", Prefix, Summarise)
+		return Result{Output: list.String()}, nil
+	case "show":
+		index, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil || index < 1 || index > len(compactions) {
+			return Result{}, fmt.Errorf("no summary %q, %s%s list lists them", number, Prefix, Summarise)
+		}
+		compaction := compactions[index-1]
+		return Result{Output: fmt.Sprintf("## Summary %d\n\n%s\n\n## Summarised messages\n\n%s",
+			index, strings.TrimSpace(compaction.Summary), transcript(compaction.History(), "###"))}, nil
+	}
+
+	return Result{}, fmt.Errorf("unknown argument %q, use %s%s list or %s%s show <number>",
+		arg, Prefix, Summarise, Prefix, Summarise)
+}
+
+// pin lists the messages of the session, or pins and
+// unpins one so it is never summarised
+func (r *Runner) pin(arg string) (Result, error) {
+	autosave := r.sessions()
+	if autosave == nil {
+		return Result{}, errNoSessions
+	}
+	if arg == "" {
+		current := autosave.Current()
+		current.SetHistory(autosave.Action.GetHistory())
+		if len(current.Messages) == 0 {
+			return Result{Output: "The session has no messages yet\n"}, nil
+		}
+		var list strings.Builder
+		for i, message := range current.Messages {
+			var marks []string
+			if message.Pinned {
+				marks = append(marks, "pinned")
+			}
+			if message.Review {
+				marks = append(marks, "review")
+			}
+			if message.Summary > 0 {
+				marks = append(marks, fmt.Sprintf("summary %d", message.Summary))
+			}
+			line, _, _ := strings.Cut(strings.TrimSpace(message.Text), "\n")
+			if len([]rune(line)) > pinLine {
+				line = string([]rune(line)[:pinLine]) + "..."
+			}
+			mark := ""
+			if len(marks) > 0 {
+				mark = " (" + strings.Join(marks, ", ") + ")"
+			}
+			fmt.Fprintf(&list, "%d. %s%s: %s\n", i+1, message.Role, mark, line)
+		}
+		fmt.Fprintf(&list, "\nPin or unpin one with `%s%s <number>`\n", Prefix, Pin)
+		return Result{Output: list.String()}, nil
+	}
+
+	number := len(autosave.Action.GetHistory())
+	if arg != "last" {
+		var err error
+		number, err = strconv.Atoi(arg)
+		if err != nil {
+			return Result{}, fmt.Errorf("%q is not a message number, %s%s lists them", arg, Prefix, Pin)
+		}
+	}
+	pinned, err := autosave.Pin(number)
+	if err != nil {
+		return Result{}, err
+	}
+	if !pinned {
+		return Result{Output: fmt.Sprintf("Message %d is not pinned anymore\n", number)}, nil
+	}
+
+	return Result{Output: fmt.Sprintf("Pinned message %d, it is never summarised\n", number)}, nil
+}
+
+// usage shows the costs of the session and the month, and
+// the usage of the month grouped by model or the argument
+func (r *Runner) usage(by string) (Result, error) {
+	if r.Usage == nil {
+		return Result{}, errors.New("the token usage is not recorded")
+	}
+	if by == "" {
+		by = usage.ByModel
+	}
+	records, err := r.Usage.Month(time.Now())
+	if err != nil {
+		return Result{}, err
+	}
+	rows, err := r.Usage.Report(records, by)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var output strings.Builder
+	session := r.Labels().Session
+	if session != "" {
+		var current []usage.Record
+		for _, record := range records {
+			if record.Session == session {
+				current = append(current, record)
+			}
+		}
+		sessionRows, _ := r.Usage.Report(current, usage.BySession)
+		total := sessionRows[len(sessionRows)-1]
+		fmt.Fprintf(&output, "This session: %d requests, %d input and %d output tokens, $%.4f\n\n",
+			total.Requests, total.InputTokens, total.OutputTokens, total.Cost)
+	}
+	fmt.Fprintf(&output, "This month by %s:\n\n%s", by, usage.Markdown(rows, by))
+	if r.Usage.Budget > 0 {
+		fmt.Fprintf(&output, "\nMonthly budget: $%.2f\n", r.Usage.Budget)
+	}
+	if warning := r.Usage.Warning(); warning != "" {
+		fmt.Fprintf(&output, "\n**%s**\n", warning)
+	}
+
+	return Result{Output: output.String()}, nil
+}
+
+// Complete returns the lines the partial line can be completed
+// to: command names, and the arguments of /review, /prompt,
+// /params, /summarise, /pin, /usage and /load
+func (r *Runner) Complete(line string) []string {
+	if !IsCommand(line) {
+		return nil
+	}
+	line = strings.TrimLeft(line, " ")
+	name, arg, hasArg := strings.Cut(line, " ")
+	if !hasArg {
+		var completions []string
+		for _, command := range matching(strings.TrimPrefix(name, Prefix)) {
+			completion := Prefix + command.Name
+			if command.Args != "" {
+				completion += " "
+			}
+			completions = append(completions, completion)
+		}
+		return completions
+	}
+
+	input, err := Parse(name)
+	if err != nil {
+		return nil
+	}
+	var candidates []string
+	switch input.Command.Name {
+	case Review:
+		candidates = []string{prompts.FormatFindings, prompts.FormatMarkdown}
+	case Prompt:
+		for _, prompt := range prompts.List() {
+			candidates = append(candidates, prompt.Name)
+		}
+	case Params:
+		// the names complete the last setting of the line
+		arg = strings.TrimLeft(arg, " ")
+		done := arg[:strings.LastIndex(arg, " ")+1]
+		if done == "" {
+			candidates = append(candidates, "reset")
+		}
+		for _, name := range genaimodel.ParamNames {
+			candidates = append(candidates, done+name+"=")
+		}
+	case Summarise:
+		candidates = []string{"list", "show "}
+	case Pin:
+		candidates = []string{"last"}
+	case Usage:
+		candidates = usage.Groups
+	case Load:
+		if autosave := r.sessions(); autosave != nil {
+			candidates = append(candidates, session.Last)
+			sessions, _ := autosave.Store().List()
+			for _, s := range sessions {
+				candidates = append(candidates, s.ID)
+			}
+		}
+	}
+
+	var completions []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(strings.TrimLeft(arg, " "))) {
+			completions = append(completions, Prefix+input.Command.Name+" "+candidate)
+		}
+	}
+
+	return completions
+}
+
+// CommonPrefix is the longest start that all completions share,
+// a partial line can be completed up to it
+func CommonPrefix(completions []string) string {
+	if len(completions) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), completions...)
+	sort.Strings(sorted)
+	first, last := sorted[0], sorted[len(sorted)-1]
+	i := 0
+	for i < len(first) && i < len(last) && first[i] == last[i] {
+		i++
+	}
+
+	return first[:i]
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+// DirName is the name of the folder that contains the
+// configuration, both in the home folder of the user
+// and in the root of a repository
+const DirName = ".aifun"
+
+const fileName = "config.json"
+
+// Config holds the settings for talking to a model. The
+// settings are read from the config files first, then
+// overridden by environment variables and at last by flags
+type Config struct {
+	// Provider is the name of the backend, for example
+	// "gemini" or "ollama"
+	Provider string `json:"provider"`
+	// Model is the name of the model at the provider,
+	// empty uses the default of the provider
+	Model   string `json:"model,omitempty"`
+	BaseURL string `json:"baseUrl,omitempty"`
+	APIKey  string `json:"apiKey,omitempty"`
+	// Cassette is the file the "fake" provider replays
+	Cassette string `json:"cassette,omitempty"`
+	// Record is a file to record all model calls to,
+	// it can be replayed with the "fake" provider
+	Record string `json:"record,omitempty"`
+	// Params are the generation parameters of every request
+	Params genaimodel.Params `json:"params,omitempty"`
+	// ContextWindow limits the size of a request, the chat
+	// history is left out when Trim is set
+	ContextWindow genaimodel.ContextWindow `json:"contextWindow,omitempty"`
+	// Prices are the prices per million tokens by model name,
+	// they add to and override the built-in prices
+	Prices map[string]genaimodel.Price `json:"prices,omitempty"`
+	// MonthlyBudget in dollars warns before a request when the
+	// costs of the month come near it, 0 is no budget
+	MonthlyBudget float64 `json:"monthlyBudget,omitempty"`
+	// Retry tells how often a failed request is tried again
+	// and how many requests a minute may be sent
+	Retry genaimodel.RetryPolicy `json:"retry,omitempty"`
+	// Ignored are the keys of the repository config that
+	// only the user may set, see repoKeys
+	Ignored []string `json:"-"`
+}
+
+// repoKeys are the settings the .aifun/config.json of a repository
+// may make. The provider, its url and api key, the cassette and
+// record files and the prices come from the user config, env vars
+// or flags, so a checked out repository can not send the diff and
+// the api key of the user to another host or overwrite files
+var repoKeys = map[string]bool{"model": true, "params": true, "contextWindow": true, "retry": true}
+
+// paramUsage describes the flags of the generation parameters
+var paramUsage = map[string]string{
+	genaimodel.ParamTemperature:    "sampling temperature between 0 and 2, lower is more deterministic",
+	genaimodel.ParamTopP:           "nucleus sampling, the probability mass between 0 and 1",
+	genaimodel.ParamTopK:           "sample from the k most likely tokens",
+	genaimodel.ParamMaxTokens:      "maximum number of tokens of an answer",
+	genaimodel.ParamStop:           "stop sequence, repeat the flag for more",
+	genaimodel.ParamSeed:           "seed for reproducible answers",
+	genaimodel.ParamThinkingBudget: "thinking tokens of gemini, 0 is off and -1 lets the model decide",
+}
+
+// UserDir returns the ~/.aifun folder of the user
+func UserDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, DirName), nil
+}
+
+// Load reads the configuration. The user config file
+// ~/.aifun/config.json is read first, the repoKeys of the
+// .aifun/config.json of the current repository override it.
+// When the env var AIFUN_CONFIG is set, only that file is
+// read. Environment variables AIFUN_PROVIDER, AIFUN_MODEL,
+// AIFUN_BASE_URL and AIFUN_API_KEY override the values of
+// the files.
+func Load() (Config, error) {
+	cfg := Config{Provider: "gemini"}
+
+	if path := os.Getenv("AIFUN_CONFIG"); path != "" {
+		err := readFile(path, &cfg, nil)
+		if err != nil {
+			return cfg, err
+		}
+	} else {
+		if userDir, err := UserDir(); err == nil {
+			err := readFile(filepath.Join(userDir, fileName), &cfg, nil)
+			if err != nil {
+				return cfg, err
+			}
+		}
+		err := readFile(filepath.Join(DirName, fileName), &cfg, repoKeys)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	overrideFromEnv(&cfg.Provider, "AIFUN_PROVIDER")
+	overrideFromEnv(&cfg.Model, "AIFUN_MODEL")
+	overrideFromEnv(&cfg.BaseURL, "AIFUN_BASE_URL")
+	overrideFromEnv(&cfg.APIKey, "AIFUN_API_KEY")
+
+	return cfg, nil
+}
+
+// RegisterFlags adds the flags to the flagset. The
+// current values of the config are used as defaults
+// so that flags override the file and env settings
+func (c *Config) RegisterFlags(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&c.Provider, "provider", c.Provider, "model backend to use")
+	flagSet.StringVar(&c.Model, "model", c.Model, "model name, empty for the provider default")
+	flagSet.StringVar(&c.BaseURL, "base-url", c.BaseURL, "base url of the provider api")
+	flagSet.StringVar(&c.APIKey, "api-key", c.APIKey, "api key for the provider")
+	flagSet.StringVar(&c.Cassette, "cassette", c.Cassette, "cassette file to replay with the fake provider")
+	flagSet.StringVar(&c.Record, "record", c.Record, "record the model calls to this cassette file")
+	flagSet.IntVar(&c.ContextWindow.Tokens, "context-window", c.ContextWindow.Tokens,
+		"context window of the model in tokens, 0 for the default of the provider")
+	flagSet.BoolVar(&c.ContextWindow.Trim, "trim-history", c.ContextWindow.Trim,
+		"leave the oldest messages out of a request that does not fit the context window")
+	flagSet.Float64Var(&c.MonthlyBudget, "monthly-budget", c.MonthlyBudget,
+		"warn before a request when the costs of this month come near this amount of dollars")
+	flagSet.IntVar(&c.ContextWindow.CompactAt, "compact-at", c.ContextWindow.CompactAt,
+		"summarise older messages from this percentage of the context window, 0 for 80, 100 turns it off")
+	flagSet.IntVar(&c.Retry.Attempts, "attempts", c.Retry.Attempts,
+		"calls of a request that hits a rate limit or a transient error, 0 for 4, 1 never tries again")
+	flagSet.IntVar(&c.Retry.RequestsPerMinute, "requests-per-minute", c.Retry.RequestsPerMinute,
+		"space the requests to the model to stay below this rate, 0 is no limit")
+	// the stop flags replace the stop sequences of the files
+	stopFlags := false
+	for _, name := range genaimodel.ParamNames {
+		flagSet.Func(name, paramUsage[name], func(value string) error {
+			if name == genaimodel.ParamStop && !stopFlags {
+				stopFlags = true
+				c.Params.StopSequences = nil
+			}
+			return c.Params.Set(name, value)
+		})
+	}
+}
+
+// readFile decodes the file on top of the given config, a missing
+// file is no error. With allowed keys the other keys are left out
+// and added to the Ignored of the config
+func readFile(path string, cfg *Config, allowed map[string]bool) error {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if allowed != nil {
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(contents, &keys); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		for key := range keys {
+			if !allowed[key] {
+				cfg.Ignored = append(cfg.Ignored, key)
+				delete(keys, key)
+			}
+		}
+		if len(cfg.Ignored) > 0 {
+			sort.Strings(cfg.Ignored)
+			log.Printf("%s: ignored %s, only the user config sets them", path, strings.Join(cfg.Ignored, ", "))
+		}
+		if contents, err = json.Marshal(keys); err != nil {
+			return err
+		}
+	}
+
+	err = json.Unmarshal(contents, cfg)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func overrideFromEnv(value *string, envVar string) {
+	if env := os.Getenv(envVar); env != "" {
+		*value = env
+	}
+}
@@ -0,0 +1,408 @@
+// Package diffparse parses the output of git diff into files,
+// hunks and lines with their old and new line numbers
+package diffparse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LineKind tells if a line of a hunk is unchanged, added or removed
+type LineKind int
+
+const (
+	Context LineKind = iota
+	Added
+	Removed
+	// NoNewline is the "\ No newline at end of file" marker
+	NoNewline
+)
+
+// Line is a line of a hunk. OldNumber is 0 for added
+// lines and NewNumber is 0 for removed lines
+type Line struct {
+	Kind      LineKind
+	Text      string
+	OldNumber int
+	NewNumber int
+}
+
+// Hunk is a block of changes starting with "@@ -a,b +c,d @@"
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	// Section is the text after the second @@, often
+	// the function the hunk is in
+	Section string
+	Lines   []Line
+	// header is the parsed "@@" line, kept to render
+	// the hunk exactly like git did
+	header string
+}
+
+// File is the diff of one file. The names are without the
+// a/ and b/ prefixes, for a new file OldName is empty and
+// for a deleted file NewName is empty
+type File struct {
+	OldName    string
+	NewName    string
+	IsNew      bool
+	IsDeleted  bool
+	IsRename   bool
+	IsCopy     bool
+	Similarity int
+	OldMode    string
+	NewMode    string
+	IsBinary   bool
+	// Header holds the lines before the first hunk, as is
+	Header []string
+	Hunks  []*Hunk
+}
+
+// Name is the name of the file after the change, or
+// the old name when the file is deleted
+func (f *File) Name() string {
+	if f.NewName != "" {
+		return f.NewName
+	}
+
+	return f.OldName
+}
+
+// IsModeChange is true when the file mode changed
+func (f *File) IsModeChange() bool {
+	return f.OldMode != "" && f.NewMode != "" && f.OldMode != f.NewMode
+}
+
+// Stats counts the added and removed lines
+func (f *File) Stats() (added, removed int) {
+	for _, hunk := range f.Hunks {
+		for _, line := range hunk.Lines {
+			switch line.Kind {
+			case Added:
+				added++
+			case Removed:
+				removed++
+			}
+		}
+	}
+
+	return added, removed
+}
+
+// ContainsNewLine is true when the line number of the new
+// file is shown in one of the hunks, added or as context
+func (f *File) ContainsNewLine(number int) bool {
+	for _, hunk := range f.Hunks {
+		if number >= hunk.NewStart && number < hunk.NewStart+hunk.NewLines {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String renders the file again as unified diff
+func (f *File) String() string {
+	var build strings.Builder
+	for _, header := range f.Header {
+		build.WriteString(header)
+		build.WriteByte('\n')
+	}
+	for _, hunk := range f.Hunks {
+		build.WriteString(hunk.String())
+	}
+
+	return build.String()
+}
+
+// String renders the hunk again as unified diff
+func (h *Hunk) String() string {
+	var build strings.Builder
+	if h.header != "" {
+		build.WriteString(h.header)
+	} else {
+		fmt.Fprintf(&build, "@@ -%d,%d +%d,%d @@", h.OldStart, h.OldLines, h.NewStart, h.NewLines)
+		if h.Section != "" {
+			build.WriteString(" " + h.Section)
+		}
+	}
+	build.WriteByte('\n')
+
+	for _, line := range h.Lines {
+		switch line.Kind {
+		case Added:
+			build.WriteByte('+')
+		case Removed:
+			build.WriteByte('-')
+		case NoNewline:
+			build.WriteByte('\\')
+		default:
+			build.WriteByte(' ')
+		}
+		build.WriteString(line.Text)
+		build.WriteByte('\n')
+	}
+
+	return build.String()
+}
+
+// Parse parses the output of git diff. Plain unified diffs
+// without the "diff --git" lines are supported as well
+func Parse(diff string) ([]*File, error) {
+	p := &parser{}
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	if diff == "" {
+		lines = nil
+	}
+
+	for number, line := range lines {
+		err := p.parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number+1, err)
+		}
+	}
+	if p.hunk != nil && (p.oldLeft > 0 || p.newLeft > 0) {
+		return nil, fmt.Errorf("hunk of %s ends early", p.file.Name())
+	}
+
+	return p.files, nil
+}
+
+type parser struct {
+	files []*File
+	file  *File
+	hunk  *Hunk
+	// lines left in the current hunk
+	oldLeft int
+	newLeft int
+	oldLine int
+	newLine int
+}
+
+func (p *parser) parseLine(line string) error {
+	if p.hunk != nil && (p.oldLeft > 0 || p.newLeft > 0) {
+		return p.parseHunkLine(line)
+	}
+
+	switch {
+	case strings.HasPrefix(line, "diff --git "):
+		p.startFile(line)
+		p.file.OldName, p.file.NewName = namesFromGitHeader(line)
+	case strings.HasPrefix(line, "@@ "):
+		return p.startHunk(line)
+	case strings.HasPrefix(line, `\`) && p.hunk != nil:
+		p.hunk.Lines = append(p.hunk.Lines, Line{Kind: NoNewline, Text: line[1:]})
+	case strings.HasPrefix(line, "--- "):
+		// plain unified diffs start without "diff --git"
+		if p.file == nil || len(p.file.Hunks) > 0 {
+			p.startFile(line)
+		} else {
+			p.file.Header = append(p.file.Header, line)
+		}
+		p.file.OldName = nameFromMarker(line[4:])
+	case strings.HasPrefix(line, "+++ ") && p.file != nil:
+		p.file.Header = append(p.file.Header, line)
+		p.file.NewName = nameFromMarker(line[4:])
+	case p.file != nil && len(p.file.Hunks) == 0:
+		p.file.Header = append(p.file.Header, line)
+		p.parseExtendedHeader(line)
+	}
+
+	return nil
+}
+
+func (p *parser) startFile(line string) {
+	p.file = &File{Header: []string{line}}
+	p.hunk = nil
+	p.files = append(p.files, p.file)
+}
+
+// parseExtendedHeader handles the lines git puts between
+// "diff --git" and the first hunk
+func (p *parser) parseExtendedHeader(line string) {
+	f := p.file
+	switch {
+	case strings.HasPrefix(line, "new file mode "):
+		f.IsNew = true
+		f.OldName = ""
+		f.NewMode = strings.TrimPrefix(line, "new file mode ")
+	case strings.HasPrefix(line, "deleted file mode "):
+		f.IsDeleted = true
+		f.NewName = ""
+		f.OldMode = strings.TrimPrefix(line, "deleted file mode ")
+	case strings.HasPrefix(line, "old mode "):
+		f.OldMode = strings.TrimPrefix(line, "old mode ")
+	case strings.HasPrefix(line, "new mode "):
+		f.NewMode = strings.TrimPrefix(line, "new mode ")
+	case strings.HasPrefix(line, "rename from "):
+		f.IsRename = true
+		f.OldName = unquote(strings.TrimPrefix(line, "rename from "))
+	case strings.HasPrefix(line, "rename to "):
+		f.IsRename = true
+		f.NewName = unquote(strings.TrimPrefix(line, "rename to "))
+	case strings.HasPrefix(line, "copy from "):
+		f.IsCopy = true
+		f.OldName = unquote(strings.TrimPrefix(line, "copy from "))
+	case strings.HasPrefix(line, "copy to "):
+		f.IsCopy = true
+		f.NewName = unquote(strings.TrimPrefix(line, "copy to "))
+	case strings.HasPrefix(line, "similarity index "):
+		f.Similarity, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "similarity index "), "%"))
+	case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+		f.IsBinary = true
+	case strings.HasPrefix(line, "index "):
+		// "index abc..def 100644" carries the mode when it did not change
+		fields := strings.Fields(line)
+		if len(fields) == 3 && f.OldMode == "" && f.NewMode == "" {
+			f.OldMode, f.NewMode = fields[2], fields[2]
+		}
+	}
+}
+
+func (p *parser) startHunk(line string) error {
+	if p.file == nil {
+		return fmt.Errorf("hunk without file: %q", line)
+	}
+
+	// @@ -oldStart,oldLines +newStart,newLines @@ section
+	end := strings.Index(line[3:], " @@")
+	if end < 0 {
+		return fmt.Errorf("invalid hunk header %q", line)
+	}
+	ranges := strings.Fields(line[3 : 3+end])
+	if len(ranges) != 2 || !strings.HasPrefix(ranges[0], "-") || !strings.HasPrefix(ranges[1], "+") {
+		return fmt.Errorf("invalid hunk header %q", line)
+	}
+
+	hunk := &Hunk{Section: strings.TrimSpace(line[3+end+3:]), header: line}
+	var err error
+	hunk.OldStart, hunk.OldLines, err = parseRange(ranges[0][1:])
+	if err != nil {
+		return err
+	}
+	hunk.NewStart, hunk.NewLines, err = parseRange(ranges[1][1:])
+	if err != nil {
+		return err
+	}
+
+	p.file.Hunks = append(p.file.Hunks, hunk)
+	p.hunk = hunk
+	p.oldLeft, p.newLeft = hunk.OldLines, hunk.NewLines
+	p.oldLine, p.newLine = hunk.OldStart, hunk.NewStart
+
+	return nil
+}
+
+func (p *parser) parseHunkLine(line string) error {
+	kind := Context
+	text := line
+	if line != "" {
+		text = line[1:]
+		switch line[0] {
+		case '+':
+			kind = Added
+		case '-':
+			kind = Removed
+		case '\\':
+			kind = NoNewline
+		case ' ':
+		default:
+			return fmt.Errorf("unexpected line in hunk: %q", line)
+		}
+	}
+	// an empty line is a context line of which the
+	// trailing whitespace got stripped
+
+	hunkLine := Line{Kind: kind, Text: text}
+	switch kind {
+	case Added:
+		hunkLine.NewNumber = p.newLine
+		p.newLine++
+		p.newLeft--
+	case Removed:
+		hunkLine.OldNumber = p.oldLine
+		p.oldLine++
+		p.oldLeft--
+	case Context:
+		hunkLine.OldNumber, hunkLine.NewNumber = p.oldLine, p.newLine
+		p.oldLine++
+		p.newLine++
+		p.oldLeft--
+		p.newLeft--
+	}
+	if p.oldLeft < 0 || p.newLeft < 0 {
+		return fmt.Errorf("hunk of %s has more lines than its header says", p.file.Name())
+	}
+	p.hunk.Lines = append(p.hunk.Lines, hunkLine)
+
+	return nil
+}
+
+// parseRange parses "start,lines" or "start", which means one line
+func parseRange(r string) (int, int, error) {
+	start, lines, found := strings.Cut(r, ",")
+	startNumber, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid hunk range %q", r)
+	}
+	if !found {
+		return startNumber, 1, nil
+	}
+	lineCount, err := strconv.Atoi(lines)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid hunk range %q", r)
+	}
+
+	return startNumber, lineCount, nil
+}
+
+// namesFromGitHeader takes the names of "diff --git a/x b/x". The
+// names are ambiguous when they contain spaces, the rename and
+// ---/+++ lines that follow give the exact names
+func namesFromGitHeader(line string) (string, string) {
+	names := strings.TrimPrefix(line, "diff --git ")
+	if strings.HasPrefix(names, `"`) {
+		return "", ""
+	}
+	// for unchanged names both halves are equal
+	half := len(names) / 2
+	if len(names)%2 == 1 && names[half] == ' ' {
+		oldName, newName := names[:half], names[half+1:]
+		return stripPrefix(oldName), stripPrefix(newName)
+	}
+	oldName, newName, _ := strings.Cut(names, " b/")
+
+	return stripPrefix(oldName), newName
+}
+
+// nameFromMarker takes the name of a "--- a/x" or "+++ b/x" line
+func nameFromMarker(marker string) string {
+	// plain diff -u adds a tab and the timestamp
+	name, _, _ := strings.Cut(marker, "\t")
+	name = unquote(name)
+	if name == "/dev/null" {
+		return ""
+	}
+
+	return stripPrefix(name)
+}
+
+func stripPrefix(name string) string {
+	if strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "b/") {
+		return name[2:]
+	}
+
+	return name
+}
+
+func unquote(name string) string {
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		return unquoted
+	}
+
+	return name
+}
@@ -0,0 +1,140 @@
+package diffparse
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const sampleDiff = `diff --git a/main.go b/main.go
+index 83db48f..bf269f4 100644
+--- a/main.go
++++ b/main.go
+@@ -1,5 +1,7 @@ package main
+ package main
+
+-import "fmt"
++import (
++	"fmt"
++)
+
+ func main() {
+@@ -10,2 +12,2 @@ func main() {
+-	fmt.Println("hi")
++	fmt.Println("hello")
+ }
+diff --git a/old.go b/new.go
+similarity index 90%
+rename from old.go
+rename to new.go
+index 1111111..2222222 100644
+--- a/old.go
++++ b/new.go
+@@ -3 +3 @@
+-var x = 1
++var x = 2
+\ No newline at end of file
+diff --git a/run.sh b/run.sh
+old mode 100644
+new mode 100755
+diff --git a/logo.png b/logo.png
+new file mode 100644
+index 0000000..3333333
+Binary files /dev/null and b/logo.png differ
+diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+index 4444444..0000000
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+`
+
+func TestParse(t *testing.T) {
+	files, err := Parse(sampleDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Fatalf("expected 5 files, got %d", len(files))
+	}
+
+	mainGo := files[0]
+	if mainGo.Name() != "main.go" || len(mainGo.Hunks) != 2 {
+		t.Errorf("unexpected main.go %+v", mainGo)
+	}
+	added, removed := mainGo.Stats()
+	if added != 4 || removed != 2 {
+		t.Errorf("expected +4 -2, got +%d -%d", added, removed)
+	}
+	hunk := mainGo.Hunks[0]
+	if hunk.Section != "package main" || hunk.NewLines != 7 {
+		t.Errorf("unexpected hunk %+v", hunk)
+	}
+	// the closing ) of the import block is line 5 of the new file
+	if line := hunk.Lines[5]; line.Kind != Added || line.NewNumber != 5 || line.Text != ")" {
+		t.Errorf("unexpected line %+v", line)
+	}
+	if line := hunk.Lines[6]; line.Kind != Context || line.OldNumber != 4 || line.NewNumber != 6 {
+		t.Errorf("empty context line not numbered: %+v", line)
+	}
+	if !mainGo.ContainsNewLine(13) || mainGo.ContainsNewLine(8) {
+		t.Error("ContainsNewLine does not follow the hunks")
+	}
+
+	rename := files[1]
+	if !rename.IsRename || rename.OldName != "old.go" || rename.NewName != "new.go" || rename.Similarity != 90 {
+		t.Errorf("unexpected rename %+v", rename)
+	}
+	if last := rename.Hunks[0].Lines[2]; last.Kind != NoNewline {
+		t.Errorf("expected no newline marker, got %+v", last)
+	}
+
+	if mode := files[2]; !mode.IsModeChange() || mode.NewMode != "100755" || len(mode.Hunks) != 0 {
+		t.Errorf("unexpected mode change %+v", mode)
+	}
+	if binary := files[3]; !binary.IsBinary || !binary.IsNew || binary.Name() != "logo.png" {
+		t.Errorf("unexpected binary %+v", binary)
+	}
+	if gone := files[4]; !gone.IsDeleted || gone.Name() != "gone.txt" || gone.NewName != "" {
+		t.Errorf("unexpected deleted file %+v", gone)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	files, err := Parse(sampleDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered string
+	for _, file := range files {
+		rendered += file.String()
+	}
+	// empty context lines are rendered with their space again
+	if rendered != strings.ReplaceAll(sampleDiff, "\n\n", "\n \n") {
+		t.Errorf("rendered diff differs:\n%s", rendered)
+	}
+}
+
+func TestParseRepositoryDiff(t *testing.T) {
+	diff, err := os.ReadFile("../../gitdiff.txt")
+	if err != nil {
+		t.Skip("no gitdiff.txt in the repository")
+	}
+
+	files, err := Parse(string(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Error("no files parsed")
+	}
+}
+
+func TestParseInvalidHunk(t *testing.T) {
+	_, err := Parse("--- a/x\n+++ b/x\n@@ -1,2 +1,2 @@\n-a\n+b\n")
+	if err == nil {
+		t.Error("expected error for a hunk that ends early")
+	}
+}
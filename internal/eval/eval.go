@@ -0,0 +1,151 @@
+// Package eval scores the review prompts against a corpus of
+// diffs with planted bugs, so a change to a prompt can be
+// judged by more than a single review
+package eval
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+)
+
+// caseExtension is the extension of the case files, the
+// diff of a case is a file next to it
+const caseExtension = ".json"
+
+// Case is a diff with the issues a good review mentions
+type Case struct {
+	Name string `json:"-"`
+	// Description is the purpose of the change, as in
+	// the description of a pull request
+	Description string `json:"description"`
+	// DiffFile is relative to the case file
+	DiffFile string        `json:"diff"`
+	Expect   []Expectation `json:"expect"`
+
+	Diff string `json:"-"`
+}
+
+// Expectation is an issue planted in the diff. It is found when
+// the review contains one of the keywords, matches the pattern,
+// or when the judge model agrees the review mentions the issue.
+// The judge is only asked when the other checks fail
+type Expectation struct {
+	Issue    string   `json:"issue"`
+	Keywords []string `json:"keywords,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Judge    bool     `json:"judge,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadCorpus reads the cases of a folder, sorted by name
+func LoadCorpus(dir string) ([]Case, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no corpus %s", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []Case
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), caseExtension) {
+			continue
+		}
+		c, err := ReadCase(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("no cases in %s", dir)
+	}
+	sort.Slice(cases, func(i, j int) bool { return cases[i].Name < cases[j].Name })
+
+	return cases, nil
+}
+
+// ReadCase reads a case file and its diff
+func ReadCase(path string) (Case, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return Case{}, err
+	}
+	var c Case
+	if err := json.Unmarshal(contents, &c); err != nil {
+		return Case{}, fmt.Errorf("case %s: %w", path, err)
+	}
+	c.Name = strings.TrimSuffix(filepath.Base(path), caseExtension)
+	if c.DiffFile == "" {
+		c.DiffFile = c.Name + ".diff"
+	}
+	c.DiffFile = filepath.Join(filepath.Dir(path), c.DiffFile)
+	diff, err := os.ReadFile(c.DiffFile)
+	if err != nil {
+		return Case{}, fmt.Errorf("case %s: %w", path, err)
+	}
+	c.Diff = string(diff)
+
+	if len(c.Expect) == 0 {
+		return Case{}, fmt.Errorf("case %s expects no issues", path)
+	}
+	for i := range c.Expect {
+		if err := c.Expect[i].compile(); err != nil {
+			return Case{}, fmt.Errorf("case %s: %w", path, err)
+		}
+	}
+
+	return c, nil
+}
+
+// options diff the case like a prepared diff file,
+// the repository of the case is not there
+func (c Case) options() gitdiff.Options {
+	return gitdiff.Options{DiffFile: c.DiffFile}
+}
+
+func (e *Expectation) compile() error {
+	if e.Issue == "" {
+		return errors.New("an expectation without issue")
+	}
+	if len(e.Keywords) == 0 && e.Pattern == "" && !e.Judge {
+		return fmt.Errorf("issue %q has no keywords, pattern or judge", e.Issue)
+	}
+	if e.Pattern == "" {
+		return nil
+	}
+	pattern, err := regexp.Compile(e.Pattern)
+	if err != nil {
+		return fmt.Errorf("issue %q: %w", e.Issue, err)
+	}
+	e.pattern = pattern
+
+	return nil
+}
+
+// Match checks the keywords, ignoring case, and the pattern.
+// It returns how the issue was found, empty when it was not
+func (e Expectation) Match(review string) string {
+	lower := strings.ToLower(review)
+	for _, keyword := range e.Keywords {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			return "keyword " + keyword
+		}
+	}
+	if e.pattern != nil && e.pattern.MatchString(review) {
+		return "pattern"
+	}
+
+	return ""
+}
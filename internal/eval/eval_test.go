@@ -0,0 +1,91 @@
+package eval
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+	"github.com/MelleKoning/aifun/internal/prompts"
+)
+
+func TestLoadCorpus(t *testing.T) {
+	cases, err := LoadCorpus(filepath.Join("..", "..", "eval"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 3 || cases[0].Name != "average" || !strings.HasPrefix(cases[0].Diff, "diff --git") {
+		t.Errorf("unexpected cases %+v", cases)
+	}
+	for _, c := range cases {
+		vars := prompts.Collect(context.Background(), c.options(), prompts.Details{}, c.Diff)
+		if len(vars.Files) != 1 || vars.Languages != "Go 100%" {
+			t.Errorf("%s: the diff is not parsed: %+v", c.Name, vars)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"),
+		[]byte(`{"expect": [{"issue": "x", "pattern": "("}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.diff"), []byte(""), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCorpus(dir); err == nil {
+		t.Error("expected an error for a broken pattern")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	expectation := Expectation{Issue: "race", Keywords: []string{"Data Race"}, Pattern: `(?i)without.{0,10}lock`}
+	if err := expectation.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"This is a data race.":                "keyword Data Race",
+		"The map is written WITHOUT the lock": "pattern",
+		"Looks good to me":                    "",
+	}
+	for review, want := range tests {
+		if got := expectation.Match(review); got != want {
+			t.Errorf("%q: got %q, want %q", review, got, want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := Case{Name: "race", Diff: "diff", Expect: []Expectation{
+		{Issue: "data race", Keywords: []string{"race"}},
+		{Issue: "returns early", Judge: true},
+		{Issue: "leaks", Judge: true},
+	}}
+	// the review, then the judge for the second and third issue
+	fake := fakemodel.New("There is a race.", "YES", "No.")
+	card := Run(context.Background(), prompts.PromptList[:1],
+		[]Model{{Name: "fake", Action: fake}}, []Case{c}, func(Result) {})
+
+	if len(card.Scores) != 1 {
+		t.Fatalf("expected a score, got %+v", card)
+	}
+	score := card.Scores[0]
+	if score.Found != 2 || score.Issues != 3 || score.Percent() != 66 || score.Errors != 0 {
+		t.Errorf("unexpected score %+v", score)
+	}
+	found := card.Results[0].Found
+	if found[0].How != "keyword race" || found[1].How != "judge" || found[2].How != "" {
+		t.Errorf("unexpected results %+v", found)
+	}
+	if fake.SystemInstruction != judgeInstruction || len(fake.Prompts) != 3 ||
+		!strings.Contains(fake.Prompts[1], "Issue: returns early") {
+		t.Errorf("judge not asked: %q", fake.Prompts)
+	}
+
+	markdown := card.Markdown()
+	if !strings.Contains(markdown, "| "+prompts.PromptList[0].Name+" | fake | 2/3 | 66% | 0 |") ||
+		!strings.Contains(markdown, "race: leaks") {
+		t.Errorf("unexpected scorecard\n%s", markdown)
+	}
+}
@@ -0,0 +1,186 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/prompts"
+)
+
+// judgeInstruction makes the model a judge of a review
+const judgeInstruction = `You judge code reviews. You get an issue of a git diff and a review of that diff.
+Answer YES when the review mentions the issue, also when it uses other words, and NO when it does not.
+Answer with a single word.`
+
+// Model is a model under test
+type Model struct {
+	Name   string
+	Action genaimodel.Action
+}
+
+// Result is the review of a case by a prompt and a model
+type Result struct {
+	Prompt string  `json:"prompt"`
+	Model  string  `json:"model"`
+	Case   string  `json:"case"`
+	Found  []Found `json:"found"`
+	Error  string  `json:"error,omitempty"`
+	// Seconds is the time the review took
+	Seconds float64 `json:"seconds"`
+}
+
+// Found tells how an issue was found, How is
+// empty when the review missed the issue
+type Found struct {
+	Issue string `json:"issue"`
+	How   string `json:"how,omitempty"`
+}
+
+// Score sums up the results of a prompt and a model
+type Score struct {
+	Prompt  string  `json:"prompt"`
+	Model   string  `json:"model"`
+	Cases   int     `json:"cases"`
+	Issues  int     `json:"issues"`
+	Found   int     `json:"found"`
+	Errors  int     `json:"errors"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Percent is the share of the issues that was found
+func (s Score) Percent() int {
+	if s.Issues == 0 {
+		return 0
+	}
+
+	return s.Found * 100 / s.Issues
+}
+
+// Scorecard holds a score per prompt and model, and
+// the results it is made of
+type Scorecard struct {
+	Scores  []Score  `json:"scores"`
+	Results []Result `json:"results"`
+}
+
+// Run reviews every case with every prompt and model. A model
+// is used for all its reviews and judgements one after the
+// other, so a recorded run can be replayed. Progress is called
+// after every review
+func Run(ctx context.Context, list []prompts.Prompt, models []Model, cases []Case,
+	progress func(Result)) Scorecard {
+	var card Scorecard
+	for _, model := range models {
+		for _, prompt := range list {
+			score := Score{Prompt: prompt.Name, Model: model.Name}
+			for _, c := range cases {
+				result := runCase(ctx, prompt, model, c)
+				score.add(result)
+				card.Results = append(card.Results, result)
+				progress(result)
+			}
+			card.Scores = append(card.Scores, score)
+		}
+	}
+
+	return card
+}
+
+func (s *Score) add(result Result) {
+	s.Cases++
+	s.Issues += len(result.Found)
+	s.Seconds += result.Seconds
+	if result.Error != "" {
+		s.Errors++
+	}
+	for _, found := range result.Found {
+		if found.How != "" {
+			s.Found++
+		}
+	}
+}
+
+// runCase reviews the diff of the case in a new chat and
+// checks which of the expected issues the review mentions
+func runCase(ctx context.Context, prompt prompts.Prompt, model Model, c Case) Result {
+	result := Result{Prompt: prompt.Name, Model: model.Name, Case: c.Name}
+	for _, expectation := range c.Expect {
+		result.Found = append(result.Found, Found{Issue: expectation.Issue})
+	}
+
+	vars := prompts.Collect(ctx, c.options(), prompts.Details{Description: c.Description}, c.Diff)
+	action := model.Action
+	action.SetHistory(nil)
+	action.UpdateSystemInstruction(prompt.Instruction(vars))
+
+	start := time.Now()
+	review, err := action.ReviewFile(ctx, c.Diff, func(string) {})
+	result.Seconds = time.Since(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for i, expectation := range c.Expect {
+		how := expectation.Match(review)
+		if how == "" && expectation.Judge {
+			how, err = judge(ctx, action, expectation.Issue, review)
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}
+		result.Found[i].How = how
+	}
+
+	return result
+}
+
+// judge asks the model if the review mentions the issue,
+// it returns "judge" when it does
+func judge(ctx context.Context, action genaimodel.Action, issue, review string) (string, error) {
+	action.SetHistory(nil)
+	action.UpdateSystemInstruction(judgeInstruction)
+	answer, err := action.ChatMessage(ctx, fmt.Sprintf(
+		"Issue: %s\n\nReview:\n%s\n\nDoes the review mention the issue? Answer YES or NO.", issue, review),
+		func(string) {})
+	if err != nil {
+		return "", fmt.Errorf("judge: %w", err)
+	}
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(answer)), "YES") {
+		return "", nil
+	}
+
+	return "judge", nil
+}
+
+// Markdown renders the scores as a table, followed by
+// the issues that were missed
+func (card Scorecard) Markdown() string {
+	var text strings.Builder
+	text.WriteString("# Prompt scorecard\n\n")
+	text.WriteString("| Prompt | Model | Found | Score | Errors | Seconds |\n|---|---|---|---|---|---|\n")
+	for _, score := range card.Scores {
+		fmt.Fprintf(&text, "| %s | %s | %d/%d | %d%% | %d | %.1f |\n", score.Prompt, score.Model,
+			score.Found, score.Issues, score.Percent(), score.Errors, score.Seconds)
+	}
+
+	var missed strings.Builder
+	for _, result := range card.Results {
+		for _, found := range result.Found {
+			if found.How == "" {
+				fmt.Fprintf(&missed, "* %s, %s, %s: %s\n", result.Prompt, result.Model, result.Case, found.Issue)
+			}
+		}
+		if result.Error != "" {
+			fmt.Fprintf(&missed, "* %s, %s, %s: error %s\n", result.Prompt, result.Model, result.Case, result.Error)
+		}
+	}
+	if missed.Len() > 0 {
+		text.WriteString("\n## Missed\n\n" + missed.String())
+	}
+
+	return text.String()
+}
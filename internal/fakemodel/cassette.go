@@ -0,0 +1,300 @@
+package fakemodel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/review"
+)
+
+// ErrCassetteDone is returned by the replayer when the
+// cassette has no interactions left
+var ErrCassetteDone = errors.New("fakemodel: no interactions left on the cassette")
+
+// Cassette holds recorded interactions with a model
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one call to the model. Method is the
+// name of the genaimodel.Action method that was called,
+// Prompt is the chat message or the reviewed diff. The
+// Result of ReviewFindings is the json of the findings
+type Interaction struct {
+	Method string  `json:"method"`
+	Prompt string  `json:"prompt,omitempty"`
+	Chunks []Chunk `json:"chunks"`
+	Result string  `json:"result"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Chunk is a streamed piece of the answer, DelayMs is
+// the time since the previous chunk or since the call
+type Chunk struct {
+	Text    string `json:"text"`
+	DelayMs int64  `json:"delayMs"`
+}
+
+// LoadCassette reads a cassette from a json file
+func LoadCassette(path string) (*Cassette, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cassette Cassette
+	err = json.Unmarshal(contents, &cassette)
+	if err != nil {
+		return nil, fmt.Errorf("reading cassette %s: %w", path, err)
+	}
+
+	return &cassette, nil
+}
+
+// Save writes the cassette as json file
+func (c *Cassette) Save(path string) error {
+	contents, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, contents, 0644)
+}
+
+// recorder passes all calls to the real model and
+// writes every interaction to the cassette file
+type recorder struct {
+	genaimodel.Action
+	path     string
+	cassette Cassette
+}
+
+// NewRecorder wraps a real model. After every call the
+// cassette is written to path so it can be replayed later
+func NewRecorder(action genaimodel.Action, path string) genaimodel.Action {
+	return &recorder{
+		Action: action,
+		path:   path,
+	}
+}
+
+func (r *recorder) ChatMessage(ctx context.Context, userPrompt string, onChunk func(string)) (string, error) {
+	interaction := Interaction{Method: "ChatMessage", Prompt: userPrompt}
+	result, err := r.Action.ChatMessage(ctx, userPrompt, r.recordChunks(&interaction, onChunk))
+
+	return result, r.save(interaction, result, err)
+}
+
+func (r *recorder) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	interaction := Interaction{Method: "ReviewFile", Prompt: diff}
+	result, err := r.Action.ReviewFile(ctx, diff, r.recordChunks(&interaction, onChunk))
+
+	return result, r.save(interaction, result, err)
+}
+
+func (r *recorder) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	interaction := Interaction{Method: "ReviewFindings", Prompt: diff}
+	findings, err := r.Action.ReviewFindings(ctx, diff, categories, r.recordChunks(&interaction, onChunk))
+
+	result, marshalErr := json.Marshal(review.Report{Findings: findings})
+	if marshalErr != nil {
+		return findings, marshalErr
+	}
+
+	return findings, r.save(interaction, string(result), err)
+}
+
+func (r *recorder) SendSystemPrompt(ctx context.Context) (string, error) {
+	result, err := r.Action.SendSystemPrompt(ctx)
+
+	return result, r.save(Interaction{Method: "SendSystemPrompt"}, result, err)
+}
+
+// recordChunks returns a callback that remembers the chunk
+// and its timing before passing it on to onChunk
+func (r *recorder) recordChunks(interaction *Interaction, onChunk func(string)) func(string) {
+	last := time.Now()
+
+	return func(text string) {
+		now := time.Now()
+		interaction.Chunks = append(interaction.Chunks, Chunk{
+			Text:    text,
+			DelayMs: now.Sub(last).Milliseconds(),
+		})
+		last = now
+		onChunk(text)
+	}
+}
+
+// save adds the interaction to the cassette file. The
+// error of the call has precedence over a save error
+func (r *recorder) save(interaction Interaction, result string, callErr error) error {
+	interaction.Result = result
+	if callErr != nil {
+		interaction.Error = callErr.Error()
+	}
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+
+	saveErr := r.cassette.Save(r.path)
+	if callErr != nil {
+		return callErr
+	}
+
+	return saveErr
+}
+
+// replayer plays back a cassette, every call takes
+// the next interaction
+type replayer struct {
+	systemInstruction string
+	cassette          *Cassette
+	speed             float64
+	history           []Turn
+	params            genaimodel.Params
+	window            genaimodel.ContextWindow
+	onUsage           genaimodel.UsageHandler
+}
+
+// NewReplayer replays the cassette at path. A speed of 1 keeps
+// the recorded timing between chunks, 2 is twice as fast and
+// 0 replays without any delay
+func NewReplayer(path string, speed float64) (genaimodel.Action, error) {
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replayer{cassette: cassette, speed: speed}, nil
+}
+
+func (r *replayer) GetHistoryLength() int {
+	return len(r.history)
+}
+
+func (r *replayer) GetHistory() []Turn {
+	return append([]Turn{}, r.history...)
+}
+
+func (r *replayer) SetHistory(history []Turn) {
+	r.history = append([]Turn{}, history...)
+}
+
+func (r *replayer) UpdateSystemInstruction(systemInstruction string) {
+	r.systemInstruction = systemInstruction
+}
+
+func (r *replayer) GetParams() genaimodel.Params {
+	return r.params
+}
+
+func (r *replayer) SetParams(params genaimodel.Params) {
+	r.params = params
+}
+
+func (r *replayer) SetContextWindow(window genaimodel.ContextWindow) {
+	r.window = window
+}
+
+func (r *replayer) ContextUsage(context.Context) genaimodel.ContextUsage {
+	return usage(r.systemInstruction, r.history, r.window)
+}
+
+// GetUsageHandler returns the handler, a cassette has
+// no token usage so it is never called
+func (r *replayer) GetUsageHandler() genaimodel.UsageHandler {
+	return r.onUsage
+}
+
+func (r *replayer) SetUsageHandler(handler genaimodel.UsageHandler) {
+	r.onUsage = handler
+}
+
+// SetRetryPolicy does nothing, a cassette never fails to connect
+func (r *replayer) SetRetryPolicy(genaimodel.RetryPolicy) {}
+
+// DeleteFiles does nothing, a cassette uploads nothing
+func (r *replayer) DeleteFiles(context.Context) error {
+	return nil
+}
+
+func (r *replayer) ChatMessage(ctx context.Context, userPrompt string, onChunk func(string)) (string, error) {
+	r.history = append(r.history, Turn{Role: "user", Text: userPrompt})
+
+	return r.play(ctx, "ChatMessage", onChunk)
+}
+
+func (r *replayer) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	return r.play(ctx, "ReviewFile", onChunk)
+}
+
+func (r *replayer) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	result, err := r.play(ctx, "ReviewFindings", onChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return review.ParseFindings(result)
+}
+
+func (r *replayer) SendSystemPrompt(ctx context.Context) (string, error) {
+	interaction, err := r.next("SendSystemPrompt")
+	if err != nil {
+		return "", err
+	}
+	if interaction.Error != "" {
+		return "", errors.New(interaction.Error)
+	}
+
+	return interaction.Result, ctx.Err()
+}
+
+func (r *replayer) play(ctx context.Context, method string, onChunk func(string)) (string, error) {
+	interaction, err := r.next(method)
+	if err != nil {
+		return "", err
+	}
+
+	var partial strings.Builder
+	for _, chunk := range interaction.Chunks {
+		delay := time.Duration(0)
+		if r.speed > 0 {
+			delay = time.Duration(float64(chunk.DelayMs)/r.speed) * time.Millisecond
+		}
+		if err := wait(ctx, delay); err != nil {
+			r.history = append(r.history, Turn{Role: "model", Text: partial.String() + genaimodel.InterruptedMarker})
+			return partial.String(), err
+		}
+		onChunk(chunk.Text)
+		partial.WriteString(chunk.Text)
+	}
+
+	if interaction.Error != "" {
+		return "", errors.New(interaction.Error)
+	}
+	r.history = append(r.history, Turn{Role: "model", Text: interaction.Result})
+
+	return interaction.Result, nil
+}
+
+func (r *replayer) next(method string) (Interaction, error) {
+	if len(r.cassette.Interactions) == 0 {
+		return Interaction{}, ErrCassetteDone
+	}
+	interaction := r.cassette.Interactions[0]
+	r.cassette.Interactions = r.cassette.Interactions[1:]
+
+	if interaction.Method != method {
+		return interaction, fmt.Errorf("fakemodel: cassette has %s but %s was called",
+			interaction.Method, method)
+	}
+
+	return interaction, nil
+}
@@ -0,0 +1,224 @@
+// Package fakemodel contains models that implement
+// genaimodel.Action without calling a live service,
+// so the chat and review flows can be tested offline
+package fakemodel
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/review"
+	"github.com/MelleKoning/aifun/internal/tokens"
+)
+
+// Turn is one message in the history of the fake models
+type Turn = genaimodel.Message
+
+// Model is a scripted fake. Every call answers with the next
+// response of the script, when the script is used up the
+// prompt is echoed back. The answers are streamed word by word
+type Model struct {
+	SystemInstruction string
+	// Prompts contains every prompt that was received,
+	// for ReviewFile this is the diff. SendSystemPrompt
+	// is recorded by name
+	Prompts []string
+	History []Turn
+	// Params are the generation parameters that were set
+	Params genaimodel.Params
+	Window genaimodel.ContextWindow
+	// OnUsage receives the estimated tokens of every answer
+	OnUsage genaimodel.UsageHandler
+	// Retry is the retry policy that was set
+	Retry genaimodel.RetryPolicy
+	// FilesDeleted counts the ends of sessions
+	FilesDeleted int
+	// Delay is the time between the chunks of an answer,
+	// to test cancelling a stream
+	Delay time.Duration
+
+	responses []string
+	errs      []error
+}
+
+// New creates a scripted fake that answers with the responses in order
+func New(responses ...string) *Model {
+	return &Model{responses: responses}
+}
+
+// FailNext makes the next call return the error
+// instead of the next scripted response
+func (m *Model) FailNext(err error) {
+	m.errs = append(m.errs, err)
+}
+
+func (m *Model) GetHistoryLength() int {
+	return len(m.History)
+}
+
+func (m *Model) GetHistory() []Turn {
+	return append([]Turn{}, m.History...)
+}
+
+func (m *Model) SetHistory(history []Turn) {
+	m.History = append([]Turn{}, history...)
+}
+
+func (m *Model) UpdateSystemInstruction(systemInstruction string) {
+	m.SystemInstruction = systemInstruction
+}
+
+func (m *Model) GetParams() genaimodel.Params {
+	return m.Params
+}
+
+func (m *Model) SetParams(params genaimodel.Params) {
+	m.Params = params
+}
+
+func (m *Model) SetContextWindow(window genaimodel.ContextWindow) {
+	m.Window = window
+}
+
+// ContextUsage estimates the tokens, the limit
+// is the window that was set
+func (m *Model) ContextUsage(context.Context) genaimodel.ContextUsage {
+	return usage(m.SystemInstruction, m.History, m.Window)
+}
+
+func (m *Model) GetUsageHandler() genaimodel.UsageHandler {
+	return m.OnUsage
+}
+
+func (m *Model) SetUsageHandler(handler genaimodel.UsageHandler) {
+	m.OnUsage = handler
+}
+
+func (m *Model) SetRetryPolicy(policy genaimodel.RetryPolicy) {
+	m.Retry = policy
+}
+
+// DeleteFiles counts the calls in FilesDeleted
+func (m *Model) DeleteFiles(context.Context) error {
+	m.FilesDeleted++
+	return nil
+}
+
+func usage(instruction string, history []Turn, window genaimodel.ContextWindow) genaimodel.ContextUsage {
+	used := tokens.Estimate(instruction)
+	for _, turn := range history {
+		used += tokens.Estimate(turn.Text)
+	}
+
+	return genaimodel.ContextUsage{Used: used, Limit: window.Tokens}
+}
+
+func (m *Model) ChatMessage(ctx context.Context, userPrompt string, onChunk func(string)) (string, error) {
+	m.History = append(m.History, Turn{Role: "user", Text: userPrompt})
+
+	return m.answer(ctx, userPrompt, onChunk)
+}
+
+func (m *Model) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	return m.answer(ctx, diff, onChunk)
+}
+
+// ReviewFindings parses the scripted response as json
+// findings, without script there are no findings
+func (m *Model) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	if len(m.responses) == 0 {
+		m.responses = append(m.responses, `{"findings":[]}`)
+	}
+	result, err := m.answer(ctx, diff, onChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return review.ParseFindings(result)
+}
+
+func (m *Model) SendSystemPrompt(ctx context.Context) (string, error) {
+	m.Prompts = append(m.Prompts, "SendSystemPrompt")
+	if err := wait(ctx, m.Delay); err != nil {
+		return "", err
+	}
+	if len(m.responses) == 0 {
+		return m.SystemInstruction, nil
+	}
+	response := m.responses[0]
+	m.responses = m.responses[1:]
+
+	return response, nil
+}
+
+// answer streams the next response. A cancelled context stops
+// the stream, the partial answer is kept marked as interrupted
+func (m *Model) answer(ctx context.Context, prompt string, onChunk func(string)) (string, error) {
+	m.Prompts = append(m.Prompts, prompt)
+
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return "", err
+	}
+
+	response := prompt
+	if len(m.responses) > 0 {
+		response = m.responses[0]
+		m.responses = m.responses[1:]
+	}
+
+	var partial strings.Builder
+	for _, chunk := range SplitChunks(response) {
+		err := wait(ctx, m.Delay)
+		if err != nil {
+			m.History = append(m.History, Turn{Role: "model", Text: partial.String() + genaimodel.InterruptedMarker})
+			return partial.String(), err
+		}
+		onChunk(chunk)
+		partial.WriteString(chunk)
+	}
+	m.History = append(m.History, Turn{Role: "model", Text: response})
+	if m.OnUsage != nil {
+		m.OnUsage(genaimodel.Usage{InputTokens: tokens.Estimate(m.SystemInstruction + prompt),
+			OutputTokens: tokens.Estimate(response)})
+	}
+
+	return response, nil
+}
+
+// wait sleeps for the delay, or returns the error
+// of the context when it is cancelled before
+func wait(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// SplitChunks cuts the text into chunks of a word with
+// its trailing whitespace, joined they form the text again
+func SplitChunks(text string) []string {
+	var chunks []string
+	for len(text) > 0 {
+		end := strings.IndexAny(text, " \n")
+		if end < 0 {
+			chunks = append(chunks, text)
+			break
+		}
+		end += len(text[end:]) - len(strings.TrimLeft(text[end:], " \n"))
+		chunks = append(chunks, text[:end])
+		text = text[end:]
+	}
+
+	return chunks
+}
@@ -0,0 +1,135 @@
+package fakemodel
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+func TestScriptedModel(t *testing.T) {
+	fake := New("Hello there\nfriend", "Review done")
+
+	var chunks []string
+	result, err := fake.ChatMessage(context.Background(), "hi", func(s string) {
+		chunks = append(chunks, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Hello there\nfriend" || strings.Join(chunks, "") != result {
+		t.Errorf("unexpected result %q from chunks %q", result, chunks)
+	}
+	if len(chunks) != 3 {
+		t.Errorf("expected 3 chunks, got %q", chunks)
+	}
+
+	result, _ = fake.ReviewFile(context.Background(), "+diff", func(string) {})
+	if result != "Review done" {
+		t.Errorf("unexpected review %q", result)
+	}
+	if fake.GetHistoryLength() != 3 {
+		t.Errorf("expected history of 3, got %d", fake.GetHistoryLength())
+	}
+
+	// script is used up, the prompt is echoed
+	result, _ = fake.ChatMessage(context.Background(), "echo me", func(string) {})
+	if result != "echo me" {
+		t.Errorf("expected echo, got %q", result)
+	}
+
+	fake.FailNext(errors.New("quota"))
+	_, err = fake.ChatMessage(context.Background(), "fail", func(string) {})
+	if err == nil {
+		t.Error("expected scripted error")
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	recording := NewRecorder(New("Hi, I am a fake", "All good", "Intro"), path)
+	_, err := recording.ChatMessage(context.Background(), "hello", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = recording.ReviewFile(context.Background(), "+diff", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recording.SendSystemPrompt(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := NewReplayer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []string
+	result, err := replay.ChatMessage(context.Background(), "hello", func(s string) {
+		chunks = append(chunks, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Hi, I am a fake" || len(chunks) != 5 {
+		t.Errorf("unexpected replay %q from chunks %q", result, chunks)
+	}
+
+	result, err = replay.ReviewFile(context.Background(), "+diff", func(string) {})
+	if err != nil || result != "All good" {
+		t.Errorf("unexpected review replay %q: %v", result, err)
+	}
+	if replay.GetHistoryLength() != 3 {
+		t.Errorf("expected history of 3, got %d", replay.GetHistoryLength())
+	}
+	if intro, err := replay.SendSystemPrompt(context.Background()); err != nil || intro != "Intro" {
+		t.Errorf("unexpected system prompt replay %q", intro)
+	}
+
+	_, err = replay.ChatMessage(context.Background(), "more", func(string) {})
+	if !errors.Is(err, ErrCassetteDone) {
+		t.Errorf("expected ErrCassetteDone, got %v", err)
+	}
+}
+
+func TestReplayWrongMethod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cassette := Cassette{Interactions: []Interaction{{Method: "ReviewFile", Result: "x"}}}
+	if err := cassette.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, _ := NewReplayer(path, 0)
+	_, err := replay.ChatMessage(context.Background(), "hello", func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "ReviewFile") {
+		t.Errorf("expected method mismatch error, got %v", err)
+	}
+}
+
+func TestCancelKeepsPartialAnswer(t *testing.T) {
+	fake := New("first\nsecond\nthird")
+	fake.Delay = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result, err := fake.ChatMessage(ctx, "hi", func(chunk string) {
+		if strings.HasPrefix(chunk, "first") {
+			cancel()
+		}
+	})
+	if !genaimodel.Interrupted(err) {
+		t.Fatalf("expected an interrupted error, got %v", err)
+	}
+	if result != "first\n" {
+		t.Errorf("unexpected partial answer %q", result)
+	}
+	history := fake.GetHistory()
+	if len(history) != 2 || history[1].Text != "first\n"+genaimodel.InterruptedMarker {
+		t.Errorf("partial answer not kept in the history: %+v", history)
+	}
+}
@@ -1,6 +1,7 @@
 package fileio
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -21,3 +22,15 @@ func WriteMarkdown(fullString string, filename string) {
 		log.Println(err)
 	}
 }
+
+// WriteJSON writes the value as indented json, for
+// tools that process the output of a review
+func WriteJSON(value any, filename string) {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	WriteMarkdown(string(contents)+"\n", filename)
+}
@@ -0,0 +1,190 @@
+package genaimodel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+const (
+	// InlineDiffMax is the size in bytes up to which a diff is sent
+	// in the request itself, a larger diff is uploaded as file
+	InlineDiffMax = 16 * 1024
+	// filePrefix starts the display name of the files that aifun
+	// uploads, it is followed by the sha256 of the content
+	filePrefix = "aifun-"
+	// reuseMargin is the time an uploaded file has to be
+	// valid still to be used for the next request
+	reuseMargin = time.Hour
+)
+
+// UploadedFile is a file uploaded to the gemini api. The
+// api deletes the files 48 hours after the upload
+type UploadedFile struct {
+	// Name is the id of the file, like "files/abc123"
+	Name        string
+	DisplayName string
+	URI         string
+	Size        int64
+	Created     time.Time
+	Expires     time.Time
+	State       string
+}
+
+// Ours tells if aifun uploaded the file
+func (f UploadedFile) Ours() bool {
+	return strings.HasPrefix(f.DisplayName, filePrefix)
+}
+
+func uploadedFile(file *genai.File) UploadedFile {
+	uploaded := UploadedFile{Name: file.Name, DisplayName: file.DisplayName, URI: file.URI,
+		Created: file.CreateTime, Expires: file.ExpirationTime, State: string(file.State)}
+	if file.SizeBytes != nil {
+		uploaded.Size = *file.SizeBytes
+	}
+
+	return uploaded
+}
+
+// Files manages the files uploaded to the gemini api. Content
+// that was uploaded before, also by an earlier run, is not
+// uploaded again as long as the file does not expire soon
+type Files struct {
+	client *genai.Client
+	// byHash are the files of aifun by the sha256 of the content
+	byHash map[string]*genai.File
+	// listed is set once the files of earlier runs are known
+	listed bool
+	// used are the names of the files of this session
+	used map[string]bool
+}
+
+// NewFiles manages the files of the api key
+func NewFiles(ctx context.Context, apiKey string) (*Files, error) {
+	client, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:  apiKey,
+		Backend: genai.BackendGeminiAPI,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newFiles(client), nil
+}
+
+func newFiles(client *genai.Client) *Files {
+	return &Files{client: client, byHash: map[string]*genai.File{}, used: map[string]bool{}}
+}
+
+// upload uploads the content as text file, or returns the
+// file that has the same content
+func (f *Files) upload(ctx context.Context, content string) (*genai.File, error) {
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	if !f.listed {
+		// the files of a run that ended without deleting them,
+		// reusing them only saves an upload
+		if _, err := f.List(ctx); err != nil {
+			log.Printf("listing the uploaded files, uploading without reuse: %v", err)
+		}
+	}
+
+	file, ok := f.byHash[hash]
+	if !ok || !reusable(file) {
+		var err error
+		file, err = f.client.Files.Upload(ctx, strings.NewReader(content), &genai.UploadFileConfig{
+			MIMEType:    "text/plain",
+			DisplayName: filePrefix + hash,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("uploading the diff: %w", err)
+		}
+		f.byHash[hash] = file
+	}
+	f.used[file.Name] = true
+
+	return file, nil
+}
+
+// reusable is an active file that stays long enough
+func reusable(file *genai.File) bool {
+	return (file.State == "" || file.State == genai.FileStateActive) &&
+		(file.ExpirationTime.IsZero() || time.Until(file.ExpirationTime) > reuseMargin)
+}
+
+// List returns all uploaded files of the api key, the
+// files of aifun are remembered for reuse
+func (f *Files) List(ctx context.Context) ([]UploadedFile, error) {
+	var files []UploadedFile
+	for file, err := range f.client.Files.All(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		uploaded := uploadedFile(file)
+		if hash, ok := strings.CutPrefix(file.DisplayName, filePrefix); ok {
+			f.byHash[hash] = file
+		}
+		files = append(files, uploaded)
+	}
+	f.listed = true
+
+	return files, nil
+}
+
+// Delete deletes the uploaded file by name
+func (f *Files) Delete(ctx context.Context, name string) error {
+	_, err := f.client.Files.Delete(ctx, name, nil)
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", name, err)
+	}
+	for hash, file := range f.byHash {
+		if file.Name == name {
+			delete(f.byHash, hash)
+		}
+	}
+	delete(f.used, name)
+
+	return nil
+}
+
+// Prune deletes the files of aifun that were uploaded before the
+// given time, all files with all set. It returns the deleted files
+func (f *Files) Prune(ctx context.Context, before time.Time, all bool) ([]UploadedFile, error) {
+	files, err := f.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []UploadedFile
+	var errs []error
+	for _, file := range files {
+		if (!all && !file.Ours()) || !file.Created.Before(before) {
+			continue
+		}
+		if err := f.Delete(ctx, file.Name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deleted = append(deleted, file)
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+// deleteUsed deletes the files that were uploaded
+// or reused in this session
+func (f *Files) deleteUsed(ctx context.Context) error {
+	var errs []error
+	for name := range f.used {
+		errs = append(errs, f.Delete(ctx, name))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,196 @@
+package genaimodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// filesStandIn is an httptest server for the files api of gemini,
+// it keeps the uploaded files in memory and counts the uploads
+type filesStandIn struct {
+	server  *httptest.Server
+	mutex   sync.Mutex
+	files   map[string]*genai.File
+	pending map[string]*genai.File
+	uploads int
+}
+
+func newFilesStandIn(t *testing.T) *filesStandIn {
+	t.Helper()
+	s := &filesStandIn{files: map[string]*genai.File{}, pending: map[string]*genai.File{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// add puts a file in the stand-in as if uploaded earlier
+func (s *filesStandIn) add(name, displayName string, created time.Time) {
+	s.files[name] = &genai.File{Name: name, DisplayName: displayName, URI: s.server.URL + "/v1beta/" + name,
+		MIMEType: "text/plain", State: genai.FileStateActive, CreateTime: created,
+		ExpirationTime: created.Add(48 * time.Hour)}
+}
+
+func (s *filesStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/v1beta/files":
+		var request struct {
+			File genai.File `json:"file"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		id := fmt.Sprintf("upload%d", len(s.pending))
+		s.pending[id] = &request.File
+		w.Header().Set("X-Goog-Upload-URL", s.server.URL+"/session/"+id)
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/session/"):
+		_, _ = io.Copy(io.Discard, r.Body)
+		file := s.pending[strings.TrimPrefix(r.URL.Path, "/session/")]
+		s.uploads++
+		name := fmt.Sprintf("files/f%d", s.uploads)
+		s.add(name, file.DisplayName, time.Now())
+		w.Header().Set("X-Goog-Upload-Status", "final")
+		_ = json.NewEncoder(w).Encode(map[string]any{"file": s.files[name]})
+	case r.Method == http.MethodGet && r.URL.Path == "/v1beta/files":
+		files := []*genai.File{}
+		for _, file := range s.files {
+			files = append(files, file)
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		_ = json.NewEncoder(w).Encode(map[string]any{"files": files})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1beta/files/"):
+		delete(s.files, strings.TrimPrefix(r.URL.Path, "/v1beta/"))
+		fmt.Fprint(w, "{}")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *filesStandIn) names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := []string{}
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func newStandInFiles(t *testing.T, s *filesStandIn) *Files {
+	t.Helper()
+	client, err := genai.NewClient(context.Background(), &genai.ClientConfig{APIKey: "key",
+		Backend: genai.BackendGeminiAPI, HTTPOptions: genai.HTTPOptions{BaseURL: s.server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newFiles(client)
+}
+
+func TestReviewPartsReuseUploads(t *testing.T) {
+	standIn := newFilesStandIn(t)
+	// a file of an earlier run with the same content, and one of another tool
+	large := strings.Repeat("+ a changed line\n", InlineDiffMax/10)
+	standIn.add("files/earlier", filePrefix+"0000", time.Now().Add(-time.Hour))
+	standIn.add("files/other", "report.pdf", time.Now().Add(-time.Hour))
+	m := &theModel{files: newStandInFiles(t, standIn)}
+	ctx := context.Background()
+
+	parts, err := m.reviewParts(ctx, "+ small", "be strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || !strings.Contains(parts[0].Text, "+ small") || standIn.uploads != 0 {
+		t.Errorf("a small diff should be inline without upload, got %d uploads", standIn.uploads)
+	}
+
+	for range 2 {
+		parts, err = m.reviewParts(ctx, large, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if standIn.uploads != 1 || parts[0].FileData == nil ||
+		!strings.Contains(parts[len(parts)-1].Text, parts[0].FileData.FileURI) {
+		t.Errorf("expected a single upload of the same diff, got %d: %+v", standIn.uploads, parts[0])
+	}
+
+	// a new run finds the file of the earlier run by its content
+	again := &theModel{files: newStandInFiles(t, standIn)}
+	if _, err := again.reviewParts(ctx, large, ""); err != nil {
+		t.Fatal(err)
+	}
+	if standIn.uploads != 1 {
+		t.Errorf("the upload of the earlier run was not reused, got %d uploads", standIn.uploads)
+	}
+
+	if err := m.DeleteFiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := standIn.names(); strings.Join(names, ",") != "files/earlier,files/other" {
+		t.Errorf("expected only the files of other sessions to stay, got %v", names)
+	}
+}
+
+func TestFilesPrune(t *testing.T) {
+	standIn := newFilesStandIn(t)
+	standIn.add("files/old", filePrefix+"1111", time.Now().Add(-3*time.Hour))
+	standIn.add("files/new", filePrefix+"2222", time.Now())
+	standIn.add("files/other", "report.pdf", time.Now().Add(-3*time.Hour))
+	files := newStandInFiles(t, standIn)
+	ctx := context.Background()
+
+	listed, err := files.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || !listed[0].Ours() || listed[2].Ours() || listed[0].URI == "" {
+		t.Errorf("unexpected files %+v", listed)
+	}
+
+	deleted, err := files.Prune(ctx, time.Now().Add(-time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].Name != "files/old" {
+		t.Errorf("expected only the old file of aifun to be pruned, got %+v", deleted)
+	}
+	if _, err := files.Prune(ctx, time.Now().Add(time.Minute), true); err != nil {
+		t.Fatal(err)
+	}
+	if names := standIn.names(); len(names) != 0 {
+		t.Errorf("expected all files to be pruned, got %v", names)
+	}
+}
+
+func TestUploadWithoutList(t *testing.T) {
+	standIn := newFilesStandIn(t)
+	listing := standIn.server.Config.Handler
+	standIn.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.Error(w, `{"error":{"code":500,"message":"list failed"}}`, http.StatusInternalServerError)
+			return
+		}
+		listing.ServeHTTP(w, r)
+	})
+	files := newStandInFiles(t, standIn)
+
+	file, err := files.upload(context.Background(), "+ a line")
+	if err != nil || file.URI == "" || standIn.uploads != 1 {
+		t.Errorf("expected the upload to work without the list, got %v after %d uploads", err, standIn.uploads)
+	}
+}
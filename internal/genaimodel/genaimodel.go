@@ -2,7 +2,9 @@ package genaimodel
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 	"log"
 	"os"
 	"strings"
@@ -10,16 +12,49 @@ import (
 	// genai is the successor of the previous
 	// generative-ai-go model
 	"google.golang.org/genai"
+
+	"github.com/MelleKoning/aifun/internal/review"
 )
 
 const (
-	modelName = "gemini-2.0-flash"
+	// GeminiDefaultModel is used when no model is configured
+	GeminiDefaultModel = "gemini-2.0-flash"
 )
 
 type theModel struct {
 	systemInstruction string
 	client            *genai.Client
+	modelName         string
 	chatHistory       []*genai.Content
+	params            Params
+	budget            budget
+	onUsage           UsageHandler
+	caller            caller
+	files             *Files
+}
+
+// Roles of the messages in the chat history, the same
+// for every backend
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Message is a message of the chat history
+type Message struct {
+	Role string
+	Text string
+}
+
+// InterruptedMarker is appended to a partial answer in the
+// chat history when the request was cancelled
+const InterruptedMarker = "\n\n_[interrupted]_"
+
+// Interrupted tells if the error is caused by cancelling the
+// context of the request. The methods of Action then return
+// the partial answer together with the error
+func Interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
 
 // Action is the interface for the model
@@ -28,14 +63,44 @@ type theModel struct {
 // intermediate results in the console
 // and to allow for streaming of the response
 type Action interface {
-	SendSystemPrompt() string
-	ReviewFile(func(string)) (string, error)
+	// SendSystemPrompt asks the model to introduce itself
+	// with the system instruction
+	SendSystemPrompt(context.Context) (string, error)
+	// ReviewFile reviews the given git diff with the system
+	// instruction and streams the review to the callback
+	ReviewFile(context.Context, string, func(string)) (string, error)
+	// ReviewFindings reviews the diff like ReviewFile but returns
+	// structured findings, limited to the categories of the prompt
+	ReviewFindings(context.Context, string, []string, func(string)) ([]review.Finding, error)
 	// ChatMessage provides a callback function for each
 	// chunk of the response. Eventually will return the full
-	// response as a string
-	ChatMessage(string, func(string)) (string, error)
+	// response as a string. Cancelling the context stops the
+	// stream, the partial answer is kept in the history
+	ChatMessage(context.Context, string, func(string)) (string, error)
 	UpdateSystemInstruction(string)
 	GetHistoryLength() int
+	// GetHistory returns a copy of the chat history, SetHistory
+	// replaces it, for example to resume a saved session
+	GetHistory() []Message
+	SetHistory([]Message)
+	// GetParams returns the generation parameters, SetParams
+	// replaces them for the next requests
+	GetParams() Params
+	SetParams(Params)
+	// SetContextWindow limits the size of the requests,
+	// ContextUsage tells how much of it the chat uses
+	SetContextWindow(ContextWindow)
+	ContextUsage(context.Context) ContextUsage
+	// GetUsageHandler returns the handler of the token usage,
+	// SetUsageHandler receives the usage of the next requests
+	GetUsageHandler() UsageHandler
+	SetUsageHandler(UsageHandler)
+	// SetRetryPolicy tells how failed requests are tried
+	// again and how many requests a minute are sent
+	SetRetryPolicy(RetryPolicy)
+	// DeleteFiles deletes the files uploaded for the session,
+	// the model can still be used after it
+	DeleteFiles(context.Context) error
 }
 
 // NewModel sets up the client for communication with Gemini. Ensure
@@ -44,6 +109,18 @@ type Action interface {
 func NewModel(ctx context.Context, systemInstruction string) (Action, error) {
 	apiKey := os.Getenv("GEMINI_API_KEY")
 
+	return NewGeminiModel(ctx, apiKey, GeminiDefaultModel, systemInstruction)
+}
+
+// NewGeminiModel sets up the client for communication with Gemini
+// with an explicit api key and model name. An empty model
+// falls back to GeminiDefaultModel
+func NewGeminiModel(ctx context.Context, apiKey, model,
+	systemInstruction string) (Action, error) {
+	if model == "" {
+		model = GeminiDefaultModel
+	}
+
 	genaiclient, err := genai.NewClient(ctx, &genai.ClientConfig{
 		APIKey:  apiKey,
 		Backend: genai.BackendGeminiAPI,
@@ -52,122 +129,289 @@ func NewModel(ctx context.Context, systemInstruction string) (Action, error) {
 		return nil, err
 	}
 
-	return &theModel{
+	m := &theModel{
 		systemInstruction: systemInstruction,
 		client:            genaiclient,
-	}, err
+		modelName:         model,
+		files:             newFiles(genaiclient),
+	}
+	m.budget.count = m.countTokens
+
+	return m, err
 }
 
 func (m *theModel) GetHistoryLength() int {
 	return len(m.chatHistory)
 }
+func (m *theModel) GetHistory() []Message {
+	return contentHistory(m.chatHistory)
+}
+
+func contentHistory(contents []*genai.Content) []Message {
+	history := make([]Message, 0, len(contents))
+	for _, content := range contents {
+		history = append(history, Message{Role: content.Role, Text: contentText(content)})
+	}
+
+	return history
+}
+
+// contentText joins the text of the parts
+func contentText(content *genai.Content) string {
+	var text strings.Builder
+	for _, part := range content.Parts {
+		text.WriteString(part.Text)
+	}
+
+	return text.String()
+}
+
+func contentTexts(contents []*genai.Content) []string {
+	texts := make([]string, 0, len(contents))
+	for _, content := range contents {
+		texts = append(texts, contentText(content))
+	}
+
+	return texts
+}
+
+func (m *theModel) SetHistory(history []Message) {
+	m.chatHistory = nil
+	for _, message := range history {
+		m.chatHistory = append(m.chatHistory, genai.NewContentFromText(message.Text, genai.Role(message.Role)))
+	}
+}
+
 func (m *theModel) UpdateSystemInstruction(systemInstruction string) {
 	m.systemInstruction = systemInstruction
 }
 
+func (m *theModel) GetParams() Params {
+	return m.params
+}
+
+func (m *theModel) SetParams(params Params) {
+	m.params = params
+}
+
+func (m *theModel) SetContextWindow(window ContextWindow) {
+	m.budget.window = window
+}
+
+func (m *theModel) GetUsageHandler() UsageHandler {
+	return m.onUsage
+}
+
+func (m *theModel) SetUsageHandler(handler UsageHandler) {
+	m.onUsage = handler
+}
+
+func (m *theModel) SetRetryPolicy(policy RetryPolicy) {
+	m.caller.policy = policy
+}
+
+func (m *theModel) DeleteFiles(ctx context.Context) error {
+	return m.files.deleteUsed(ctx)
+}
+
+// ContextUsage counts the tokens with the tokenizer of gemini
+func (m *theModel) ContextUsage(ctx context.Context) ContextUsage {
+	m.resolveWindow(ctx)
+
+	return m.budget.usage(ctx, m.systemInstruction, contentTexts(m.chatHistory))
+}
+
+// resolveWindow asks gemini once for the input token limit
+// of the model, when no context window is configured
+func (m *theModel) resolveWindow(ctx context.Context) {
+	if m.budget.window.Tokens > 0 || m.budget.fallback > 0 {
+		return
+	}
+	m.budget.fallback = GeminiDefaultContextWindow
+	model, err := m.client.Models.Get(ctx, m.modelName, nil)
+	if err != nil {
+		log.Printf("getting the token limit of %s: %v", m.modelName, err)
+		return
+	}
+	if model.InputTokenLimit > 0 {
+		m.budget.fallback = int(model.InputTokenLimit)
+	}
+}
+
+func (m *theModel) countTokens(ctx context.Context, text string) (int, error) {
+	response, err := m.client.Models.CountTokens(ctx, m.modelName, genai.Text(text), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(response.TotalTokens), nil
+}
+
+// generateConfig applies the generation parameters, the
+// caller adds the system instruction when it needs one
+func (m *theModel) generateConfig() *genai.GenerateContentConfig {
+	params := m.params
+	config := &genai.GenerateContentConfig{
+		Temperature:     params.Temperature,
+		TopP:            params.TopP,
+		MaxOutputTokens: params.MaxTokens,
+		StopSequences:   params.StopSequences,
+		Seed:            params.Seed,
+	}
+	if params.TopK != nil {
+		topK := float32(*params.TopK)
+		config.TopK = &topK
+	}
+	if params.ThinkingBudget != nil {
+		config.ThinkingConfig = &genai.ThinkingConfig{ThinkingBudget: params.ThinkingBudget}
+	}
+
+	return config
+}
+
 // ChatMessage sends a message to the model
 // and returns the answer as string
 // Variables:
 // userPrompt: the prompt to send to the model
 // onChunk: a callback function that is called for each chunk of the response
-func (m *theModel) ChatMessage(userPrompt string,
+func (m *theModel) ChatMessage(ctx context.Context, userPrompt string,
 	onChunk func(string)) (string, error) {
-	ctx := context.Background()
-
-	// Add user prompt to chat history
-	m.chatHistory = append(m.chatHistory, genai.NewContentFromText(userPrompt, genai.RoleUser))
-
-	// Create chat with history
-	chat, err := m.client.Chats.Create(ctx, modelName, nil, m.chatHistory)
+	// the oldest messages are left out when they do not fit
+	m.resolveWindow(ctx)
+	start, err := m.budget.fit(ctx, m.systemInstruction, m.GetHistory(), userPrompt, int(m.params.MaxTokens))
 	if err != nil {
 		return "", err
 	}
 
-	// Send message to the model using streaming
-	stream := chat.SendMessageStream(ctx, genai.Part{Text: userPrompt})
-
-	var allModelParts []*genai.Part
-
-	for chunk, err := range stream {
+	// Create chat with history, sending the message adds it
+	fullString, err := retry(ctx, &m.caller, onChunk, func(onChunk func(string)) (string, error) {
+		chat, err := m.client.Chats.Create(ctx, m.modelName, m.generateConfig(), m.chatHistory[start:])
 		if err != nil {
-			fmt.Println("Error receiving stream:", err)
-			break
+			return "", err
 		}
-		part := chunk.Candidates[0].Content.Parts[0]
-		onChunk(part.Text) // raise callback func
-		allModelParts = append(allModelParts, part)
+		return m.receive(chat.SendMessageStream(ctx, genai.Part{Text: userPrompt}), onChunk)
+	})
+	if err != nil && !Interrupted(err) {
+		return fullString, err
 	}
 
-	// concatenate the output model answer
-	fullString := buildString(allModelParts)
-
-	// Add the combined response to chat history
+	// Add user prompt and the answer to chat history
+	m.chatHistory = append(m.chatHistory, genai.NewContentFromText(userPrompt, genai.RoleUser))
+	if err != nil {
+		m.chatHistory = append(m.chatHistory,
+			genai.NewContentFromText(fullString+InterruptedMarker, genai.RoleModel))
+		return fullString, err
+	}
 	modelResponse := genai.NewContentFromText(fullString, genai.RoleModel)
 	m.chatHistory = append(m.chatHistory, modelResponse)
 
 	return fullString, nil
 }
 
-func (m *theModel) SendSystemPrompt() string {
+func (m *theModel) SendSystemPrompt(ctx context.Context) (string, error) {
 	systemContent := genai.NewContentFromText(m.systemInstruction, genai.RoleModel)
 	m.chatHistory = append(m.chatHistory, systemContent)
 	commandText := "Hi - please introduce yourselve"
 	genaiCommandPart := genai.NewContentFromText(commandText, genai.RoleUser)
 	genaiContents := append([]*genai.Content{}, genaiCommandPart)
 
-	config := &genai.GenerateContentConfig{
-		SystemInstruction: genai.NewContentFromText(m.systemInstruction, genai.RoleModel),
-	}
+	config := m.generateConfig()
+	config.SystemInstruction = genai.NewContentFromText(m.systemInstruction, genai.RoleModel)
 
-	stream := m.client.Models.GenerateContentStream(
-		context.Background(),
-		modelName,
-		genaiContents,
-		config,
-	)
+	return retry(ctx, &m.caller, func(string) {}, func(onChunk func(string)) (string, error) {
+		return m.receive(m.client.Models.GenerateContentStream(ctx, m.modelName, genaiContents, config), onChunk)
+	})
+}
 
-	// process response
-	var allModelParts []*genai.Part
+// ReviewFile reviews the diff, large diffs are reviewed in
+// batches that are consolidated into one review
+func (m *theModel) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	fullString, err := review.Run(ctx, diff, review.Options{}, m.generateReview, onChunk)
+	if Interrupted(err) && fullString != "" {
+		m.chatHistory = append(m.chatHistory,
+			genai.NewContentFromText(fullString+InterruptedMarker, genai.RoleModel))
+	}
+	if err != nil {
+		return fullString, err
+	}
 
-	for chunk, err := range stream {
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
-		printResponse(chunk)
+	// Combine all parts into a single part and add to chat history
+	modelResponse := genai.NewContentFromText(fullString, genai.RoleModel)
+	m.chatHistory = append(m.chatHistory, modelResponse)
 
-		part := chunk.Candidates[0].Content.Parts[0]
-		allModelParts = append(allModelParts, part)
+	return fullString, nil
+}
 
+// ReviewFindings asks for a json answer with the response schema
+// of gemini, the rendered markdown is added to the chat history
+func (m *theModel) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	findings, err := review.RunFindings(ctx, diff, review.Options{Categories: categories},
+		m.generateReview, onChunk)
+	if err != nil {
+		return nil, err
 	}
 
-	fullString := buildString(allModelParts)
+	modelResponse := genai.NewContentFromText(review.RenderMarkdown(findings), genai.RoleModel)
+	m.chatHistory = append(m.chatHistory, modelResponse)
 
-	return fullString
+	return findings, nil
 }
 
-// ReviewFile revies the "gitdiff.txt" file
-func (m *theModel) ReviewFile(onChunk func(string)) (string, error) {
-	filePart, fileUri := m.addAFile(context.Background(), m.client)
-	log.Printf("fileUri is %s", fileUri)
+// generateReview uploads the diff as file and sends it after
+// the chat history. Without a diff only the instruction is
+// sent, that is the consolidation pass of a batched review
+func (m *theModel) generateReview(ctx context.Context, request review.Request,
+	onChunk func(string)) (string, error) {
+	diff, instruction := request.Diff, request.Instruction
+	m.resolveWindow(ctx)
+	start, err := m.budget.fit(ctx, m.systemInstruction, m.GetHistory(),
+		diff+instruction, int(m.params.MaxTokens))
+	if err != nil {
+		return "", err
+	}
+	config := m.generateConfig()
+	config.SystemInstruction = genai.NewContentFromText(m.systemInstruction, genai.RoleModel)
+	if request.JSON {
+		config.ResponseMIMEType = "application/json"
+		config.ResponseSchema = findingsSchema(request.Categories)
+	}
 
-	// Start with chatHistory
-	genaiContents := append([]*genai.Content{}, m.chatHistory...)
+	return retry(ctx, &m.caller, onChunk, func(onChunk func(string)) (string, error) {
+		parts, err := m.reviewParts(ctx, diff, instruction)
+		if err != nil {
+			return "", err
+		}
+		// Start with chatHistory
+		genaiContents := append([]*genai.Content{}, m.chatHistory[start:]...)
+		genaiContents = append(genaiContents, genai.NewContentFromParts(parts, genai.RoleUser))
 
-	// we first create a Part for file,
-	// later we add an additional part
-	// to this slice to add the Command below
-	parts := []*genai.Part{
-		filePart,
-	}
+		return m.receive(m.client.Models.GenerateContentStream(ctx, m.modelName, genaiContents, config), onChunk)
+	})
+}
 
-	fileContent := genai.NewContentFromParts(parts, genai.RoleUser)
+// reviewParts are the parts of the review request: the diff as
+// file with the instruction and the command. A small diff, or
+// no diff, is sent in the text to save the upload
+func (m *theModel) reviewParts(ctx context.Context, diff, instruction string) ([]*genai.Part, error) {
+	if len(diff) <= InlineDiffMax {
+		return []*genai.Part{{Text: inlineReviewCommand(diff, instruction)}}, nil
+	}
 
-	// Include fileContent
-	genaiContents = append(genaiContents, fileContent)
+	// we first create a Part for file,
+	// later we add additional parts for
+	// the instruction and the Command below
+	var parts []*genai.Part
+	file, err := m.files.upload(ctx, diff)
+	if err != nil {
+		return nil, err
+	}
+	fileUri := file.URI
+	log.Printf("fileUri is %s", fileUri)
+	parts = append(parts, genai.NewPartFromURI(file.URI, file.MIMEType))
 
-	config := &genai.GenerateContentConfig{
-		SystemInstruction: genai.NewContentFromText(m.systemInstruction, genai.RoleModel),
+	if instruction != "" {
+		parts = append(parts, &genai.Part{Text: instruction})
 	}
 
 	commandText := `* Do not include the provided diff output in the response.
@@ -177,90 +421,110 @@ func (m *theModel) ReviewFile(onChunk func(string)) (string, error) {
 		AI OUTPUT:`
 	commandText = strings.Replace(commandText, "{fileUri}", fileUri, 1)
 
-	// add command as additional part
-	// to the last item in the genaiContents
-	genaiCommandPart := &genai.Part{Text: commandText}
-	lastContentPart := len(genaiContents) - 1
-	genaiContents[lastContentPart].Parts = append(genaiContents[lastContentPart].Parts, genaiCommandPart)
-
-	// add the command text to the file contents
-	//genaiCommandText := genai.Text(commandText)
-	//genaiContents = append(genaiContents, genaiCommandText...)
-	stream := m.client.Models.GenerateContentStream(
-		context.Background(),
-		modelName,
-		genaiContents,
-		config,
-	)
+	return append(parts, &genai.Part{Text: commandText}), nil
+}
 
-	var allModelParts []*genai.Part
+// receive collects the streamed answer. The usage of the last
+// chunk is reported, also of a stream that stopped early. A
+// blocked prompt or answer fails with KindSafety
+func (m *theModel) receive(stream iter.Seq2[*genai.GenerateContentResponse, error],
+	onChunk func(string)) (string, error) {
+	var build strings.Builder
+	var metadata *genai.GenerateContentResponseUsageMetadata
+	// the tokens of a stopped stream are paid as well
+	defer func() {
+		m.onUsage.report(geminiUsage(metadata))
+	}()
 
 	for chunk, err := range stream {
 		if err != nil {
-			return "", err
-
+			// the partial answer is kept when interrupted
+			return build.String(), err
+		}
+		if chunk.UsageMetadata != nil {
+			metadata = chunk.UsageMetadata
+		}
+		if err := blocked(chunk); err != nil {
+			return build.String(), err
 		}
 
-		//printResponse(chunk)
-
-		part := chunk.Candidates[0].Content.Parts[0]
-		onChunk(part.Text) // raise callback func
-		allModelParts = append(allModelParts, part)
-
+		text := chunk.Text()
+		onChunk(text) // raise callback func
+		build.WriteString(text)
 	}
 
-	fullString := buildString(allModelParts)
-
-	// Combine all parts into a single part and add to chat history
-	modelResponse := genai.NewContentFromText(fullString, genai.RoleModel)
-	m.chatHistory = append(m.chatHistory, modelResponse)
-
-	// fileio.WriteMarkdown(fullString, "codereview.md")
-
-	return fullString, nil
+	return build.String(), nil
 }
 
-// uploads a file to gemini
-func (m *theModel) addAFile(ctx context.Context, client *genai.Client) (*genai.Part, string) {
-	// during the chat, we can continuously update the below file by providing
-	// a different diff. For example to get a diff for a golang repository,
-	// we can issue the following command:
-	// git diff -U10 7c904..dcfc69 -- . ':!vendor' > gitdiff.txt
-	// the hashes are examples from two consecutive git hashes found when
-	// simply doing a "git log" statement. Put the oldest hash first so that added
-	// lines get a + and removed lines get a -, or you get it backwards.
-	// note that the "-- . `:! vendor` part is to ignore the vendor file, as we are
-	// only interested in actual updates of changes.
-	fileContents, err := os.Open("./gitdiff.txt")
-	if err != nil {
-		panic(err)
+// blocked tells if the safety filters of gemini
+// stopped the prompt or the answer
+func blocked(chunk *genai.GenerateContentResponse) error {
+	if chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+		return &CallError{Kind: KindSafety,
+			Err: fmt.Errorf("the prompt was blocked: %s", chunk.PromptFeedback.BlockReason)}
 	}
-	upFile, err := client.Files.Upload(ctx, fileContents, &genai.UploadFileConfig{
-		MIMEType: "text/plain",
-	})
-	if err != nil {
-		panic(err)
+	if len(chunk.Candidates) == 0 {
+		return nil
+	}
+	switch reason := chunk.Candidates[0].FinishReason; reason {
+	case genai.FinishReasonSafety, genai.FinishReasonBlocklist, genai.FinishReasonProhibitedContent,
+		genai.FinishReasonSPII, genai.FinishReasonRecitation:
+		return &CallError{Kind: KindSafety, Err: fmt.Errorf("the answer stopped: %s", reason)}
 	}
 
-	return genai.NewPartFromURI(upFile.URI, upFile.MIMEType), upFile.URI
+	return nil
 }
 
-func printResponse(resp *genai.GenerateContentResponse) {
-	result := resp.Candidates[0].Content.Parts[0]
+// findingsSchema is the gemini response schema of review.Report
+func findingsSchema(categories []string) *genai.Schema {
+	severities := make([]string, 0, len(review.Severities))
+	for _, severity := range review.Severities {
+		severities = append(severities, string(severity))
+	}
 
-	if result != nil {
-		fmt.Print(".")
-	} else {
-		fmt.Print("-")
+	finding := &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"file":       {Type: genai.TypeString},
+			"startLine":  {Type: genai.TypeInteger},
+			"endLine":    {Type: genai.TypeInteger},
+			"severity":   {Type: genai.TypeString, Enum: severities},
+			"category":   {Type: genai.TypeString, Enum: categories},
+			"message":    {Type: genai.TypeString},
+			"suggestion": {Type: genai.TypeString},
+		},
+		PropertyOrdering: []string{"file", "startLine", "endLine", "severity",
+			"category", "message", "suggestion"},
+		Required: []string{"file", "startLine", "endLine", "severity", "category", "message"},
 	}
-}
 
-func buildString(resp []*genai.Part) string {
-	var build strings.Builder
-	for _, p := range resp {
+	return &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"findings": {Type: genai.TypeArray, Items: finding},
+		},
+		Required: []string{"findings"},
+	}
+}
 
-		build.WriteString(p.Text)
+// inlineReviewCommand puts the diff in the review command for
+// backends that can not upload files. Without a diff only the
+// instruction is used, for the consolidation of a batched review
+func inlineReviewCommand(diff, instruction string) string {
+	if diff == "" {
+		return instruction
 	}
+	if instruction != "" {
+		instruction += "\n\n"
+	}
+
+	return `* Do not include the provided diff output in the response.
+
+The following git diff output is to be reviewed:
+
+~~~diff
+` + diff + `
+~~~
 
-	return build.String()
+` + instruction + `AI OUTPUT:`
 }
@@ -0,0 +1,362 @@
+package genaimodel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/review"
+)
+
+const (
+	// OllamaDefaultURL is where the docker-compose.yaml
+	// of this repository exposes the local ollama server
+	OllamaDefaultURL   = "http://localhost:11434"
+	OllamaDefaultModel = "llama3.2"
+)
+
+// ollamaMessage is a single message of the ollama
+// /api/chat endpoint, both for request and response
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	// Format "json" makes ollama answer with valid json
+	Format  string         `json:"format,omitempty"`
+	Options *ollamaOptions `json:"options,omitempty"`
+}
+
+// ollamaOptions are the generation parameters that ollama
+// knows, it has no thinking budget
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	TopK        *int32   `json:"top_k,omitempty"`
+	NumPredict  int32    `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int32   `json:"seed,omitempty"`
+	// NumCtx is the context window, it overrides
+	// the OLLAMA_CONTEXT_LENGTH of the server
+	NumCtx int `json:"num_ctx,omitempty"`
+}
+
+// newOllamaOptions is nil when no parameter and
+// no context window is set
+func newOllamaOptions(params Params, window ContextWindow) *ollamaOptions {
+	options := ollamaOptions{
+		Temperature: params.Temperature,
+		TopP:        params.TopP,
+		TopK:        params.TopK,
+		NumPredict:  params.MaxTokens,
+		Stop:        params.StopSequences,
+		Seed:        params.Seed,
+		NumCtx:      window.Tokens,
+	}
+	if options.Temperature == nil && options.TopP == nil && options.TopK == nil &&
+		options.NumPredict == 0 && options.Stop == nil && options.Seed == nil && options.NumCtx == 0 {
+		return nil
+	}
+
+	return &options
+}
+
+// ollamaChatResponse is one line of the streamed
+// NDJSON answer. The last line has Done set to true
+type ollamaChatResponse struct {
+	Message ollamaMessage `json:"message"`
+	Done    bool          `json:"done"`
+	Error   string        `json:"error,omitempty"`
+	// the counted tokens are in the last line
+	PromptEvalCount int `json:"prompt_eval_count,omitempty"`
+	EvalCount       int `json:"eval_count,omitempty"`
+}
+
+type ollamaModel struct {
+	systemInstruction string
+	baseURL           string
+	modelName         string
+	httpClient        *http.Client
+	chatHistory       []ollamaMessage
+	params            Params
+	budget            budget
+	onUsage           UsageHandler
+	caller            caller
+}
+
+// NewOllamaModel sets up a client for a (local) ollama server.
+// An empty baseURL or model falls back to OllamaDefaultURL and
+// OllamaDefaultModel. The model has to be pulled upfront with
+// "ollama pull <model>"
+func NewOllamaModel(baseURL, model, systemInstruction string) (Action, error) {
+	if baseURL == "" {
+		baseURL = OllamaDefaultURL
+	}
+	if model == "" {
+		model = OllamaDefaultModel
+	}
+
+	return &ollamaModel{
+		systemInstruction: systemInstruction,
+		baseURL:           strings.TrimSuffix(baseURL, "/"),
+		modelName:         model,
+		httpClient:        http.DefaultClient,
+		budget:            budget{fallback: OllamaDefaultContextWindow},
+	}, nil
+}
+
+func (m *ollamaModel) GetHistoryLength() int {
+	return len(m.chatHistory)
+}
+
+func (m *ollamaModel) GetHistory() []Message {
+	return ollamaHistory(m.chatHistory)
+}
+
+// ollamaHistory maps the "assistant" role to RoleModel
+func ollamaHistory(messages []ollamaMessage) []Message {
+	history := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		role := RoleUser
+		if message.Role == "assistant" {
+			role = RoleModel
+		}
+		history = append(history, Message{Role: role, Text: message.Content})
+	}
+
+	return history
+}
+
+func (m *ollamaModel) SetHistory(history []Message) {
+	m.chatHistory = nil
+	for _, message := range history {
+		role := "user"
+		if message.Role == RoleModel {
+			role = "assistant"
+		}
+		m.chatHistory = append(m.chatHistory, ollamaMessage{Role: role, Content: message.Text})
+	}
+}
+
+func (m *ollamaModel) UpdateSystemInstruction(systemInstruction string) {
+	m.systemInstruction = systemInstruction
+}
+
+func (m *ollamaModel) GetParams() Params {
+	return m.params
+}
+
+func (m *ollamaModel) SetParams(params Params) {
+	m.params = params
+}
+
+func (m *ollamaModel) SetContextWindow(window ContextWindow) {
+	m.budget.window = window
+}
+
+func (m *ollamaModel) GetUsageHandler() UsageHandler {
+	return m.onUsage
+}
+
+func (m *ollamaModel) SetUsageHandler(handler UsageHandler) {
+	m.onUsage = handler
+}
+
+func (m *ollamaModel) SetRetryPolicy(policy RetryPolicy) {
+	m.caller.policy = policy
+}
+
+// DeleteFiles does nothing, the diff is sent inline
+func (m *ollamaModel) DeleteFiles(context.Context) error {
+	return nil
+}
+
+// ContextUsage estimates the tokens, ollama has no
+// endpoint to count them
+func (m *ollamaModel) ContextUsage(ctx context.Context) ContextUsage {
+	return m.budget.usage(ctx, m.systemInstruction, ollamaTexts(m.chatHistory))
+}
+
+func ollamaTexts(messages []ollamaMessage) []string {
+	texts := make([]string, 0, len(messages))
+	for _, message := range messages {
+		texts = append(texts, message.Content)
+	}
+
+	return texts
+}
+
+// ChatMessage sends the message together with the full
+// chat history to ollama and streams the answer to onChunk
+func (m *ollamaModel) ChatMessage(ctx context.Context, userPrompt string,
+	onChunk func(string)) (string, error) {
+	m.chatHistory = append(m.chatHistory, ollamaMessage{Role: "user", Content: userPrompt})
+
+	fullString, err := m.chat(ctx, m.chatHistory, false, onChunk)
+	if Interrupted(err) {
+		m.chatHistory = append(m.chatHistory, ollamaMessage{Role: "assistant", Content: fullString + InterruptedMarker})
+		return fullString, err
+	}
+	if err != nil {
+		// the message was not answered, it is not kept
+		m.chatHistory = m.chatHistory[:len(m.chatHistory)-1]
+		return "", err
+	}
+
+	m.chatHistory = append(m.chatHistory, ollamaMessage{Role: "assistant", Content: fullString})
+
+	return fullString, nil
+}
+
+// SendSystemPrompt asks the model to introduce itself. The
+// system instruction is sent along with every request, so
+// unlike the gemini model nothing is added to the history
+func (m *ollamaModel) SendSystemPrompt(ctx context.Context) (string, error) {
+	introduction := []ollamaMessage{{Role: "user", Content: "Hi - please introduce yourselve"}}
+
+	return m.chat(ctx, introduction, false, func(string) {})
+}
+
+// ReviewFile reviews the diff. Ollama has no file upload,
+// so the diff is inlined in the user message
+func (m *ollamaModel) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	fullString, err := review.Run(ctx, diff, review.Options{}, m.generateReview, onChunk)
+	if Interrupted(err) && fullString != "" {
+		m.chatHistory = append(m.chatHistory, ollamaMessage{Role: "assistant", Content: fullString + InterruptedMarker})
+	}
+	if err != nil {
+		return fullString, err
+	}
+
+	m.chatHistory = append(m.chatHistory, ollamaMessage{Role: "assistant", Content: fullString})
+
+	return fullString, nil
+}
+
+// ReviewFindings asks for a json answer, the rendered
+// markdown is added to the chat history
+func (m *ollamaModel) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	findings, err := review.RunFindings(ctx, diff, review.Options{Categories: categories},
+		m.generateReview, onChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	m.chatHistory = append(m.chatHistory, ollamaMessage{Role: "assistant", Content: review.RenderMarkdown(findings)})
+
+	return findings, nil
+}
+
+// generateReview sends the chat history with the review
+// command, the answer is not added to the history
+func (m *ollamaModel) generateReview(ctx context.Context, request review.Request,
+	onChunk func(string)) (string, error) {
+	messages := append([]ollamaMessage{}, m.chatHistory...)
+	messages = append(messages, ollamaMessage{Role: "user",
+		Content: inlineReviewCommand(request.Diff, request.Instruction)})
+
+	return m.chat(ctx, messages, request.JSON, onChunk)
+}
+
+// chat posts the messages to /api/chat with the system instruction
+// in front and collects the streamed NDJSON answer. The last
+// message is the request, the messages before it are left out
+// when they do not fit the context window. The jsonMode forces
+// the answer to be json. When the context is cancelled the
+// answer so far is returned with the error of the context
+func (m *ollamaModel) chat(ctx context.Context, messages []ollamaMessage,
+	jsonMode bool, onChunk func(string)) (string, error) {
+	last := len(messages) - 1
+	start, err := m.budget.fit(ctx, m.systemInstruction, ollamaHistory(messages[:last]),
+		messages[last].Content, int(m.params.MaxTokens))
+	if err != nil {
+		return "", err
+	}
+	messages = messages[start:]
+
+	request := ollamaChatRequest{
+		Model:   m.modelName,
+		Stream:  true,
+		Options: newOllamaOptions(m.params, m.budget.window),
+		Messages: append([]ollamaMessage{
+			{Role: "system", Content: m.systemInstruction},
+		}, messages...),
+	}
+	if jsonMode {
+		request.Format = "json"
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	return retry(ctx, &m.caller, onChunk, func(onChunk func(string)) (string, error) {
+		return m.post(ctx, body, onChunk)
+	})
+}
+
+// post sends a single request to /api/chat
+func (m *ollamaModel) post(ctx context.Context, body []byte, onChunk func(string)) (string, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		m.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.httpClient.Do(httpRequest)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		errorBody, _ := io.ReadAll(resp.Body)
+		return "", statusError(resp,
+			fmt.Errorf("ollama returned %s: %s", resp.Status, strings.TrimSpace(string(errorBody))))
+	}
+
+	var build strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var chunk ollamaChatResponse
+		err := decoder.Decode(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && ctx.Err() != nil {
+			// stopped by the user, keep what was received
+			return build.String(), ctx.Err()
+		}
+		if err != nil {
+			return "", err
+		}
+		if chunk.Error != "" {
+			return "", fmt.Errorf("ollama: %s", chunk.Error)
+		}
+
+		if chunk.Message.Content != "" {
+			onChunk(chunk.Message.Content) // raise callback func
+			build.WriteString(chunk.Message.Content)
+		}
+
+		if chunk.Done {
+			m.onUsage.report(Usage{InputTokens: chunk.PromptEvalCount, OutputTokens: chunk.EvalCount})
+			break
+		}
+	}
+
+	return build.String(), nil
+}
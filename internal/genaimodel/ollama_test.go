@@ -0,0 +1,240 @@
+package genaimodel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newOllamaStandIn starts an httptest server that answers /api/chat
+// with the given chunks as NDJSON and records every request
+func newOllamaStandIn(t *testing.T, chunks []string) (*httptest.Server, *[]ollamaChatRequest) {
+	t.Helper()
+	var requests []ollamaChatRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		var request ollamaChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, request)
+
+		for _, chunk := range chunks {
+			line, _ := json.Marshal(ollamaChatResponse{
+				Message: ollamaMessage{Role: "assistant", Content: chunk},
+			})
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":12,"eval_count":3}`)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestOllamaChatMessage(t *testing.T) {
+	server, requests := newOllamaStandIn(t, []string{"Hello", " there"})
+
+	model, err := NewOllamaModel(server.URL, "testmodel", "be brief")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var usages []Usage
+	model.SetUsageHandler(func(usage Usage) {
+		usages = append(usages, usage)
+	})
+
+	var chunks []string
+	result, err := model.ChatMessage(context.Background(), "hi", func(s string) {
+		chunks = append(chunks, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0] != (Usage{InputTokens: 12, OutputTokens: 3}) {
+		t.Errorf("unexpected usage %+v", usages)
+	}
+	if result != "Hello there" {
+		t.Errorf("unexpected result %q", result)
+	}
+	if len(chunks) != 2 {
+		t.Errorf("expected 2 chunks, got %d", len(chunks))
+	}
+	if model.GetHistoryLength() != 2 {
+		t.Errorf("expected history of 2, got %d", model.GetHistoryLength())
+	}
+
+	_, err = model.ChatMessage(context.Background(), "again", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := (*requests)[1]
+	if second.Model != "testmodel" || !second.Stream {
+		t.Errorf("unexpected request %+v", second)
+	}
+	// system + user + assistant + user
+	if len(second.Messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(second.Messages))
+	}
+	if second.Messages[0].Role != "system" || second.Messages[0].Content != "be brief" {
+		t.Errorf("system instruction not sent first: %+v", second.Messages[0])
+	}
+	if second.Messages[2].Role != "assistant" || second.Messages[2].Content != "Hello there" {
+		t.Errorf("history not sent: %+v", second.Messages[2])
+	}
+}
+
+func TestOllamaParams(t *testing.T) {
+	server, requests := newOllamaStandIn(t, []string{"ok"})
+	model, _ := NewOllamaModel(server.URL, "testmodel", "")
+
+	if _, err := model.ChatMessage(context.Background(), "hi", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	var params Params
+	for _, setting := range [][2]string{{ParamTopK, "40"}, {ParamStop, "###"}, {ParamMaxTokens, "64"},
+		{ParamThinkingBudget, "0"}} {
+		if err := params.Set(setting[0], setting[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model.SetParams(params)
+	if _, err := model.ReviewFile(context.Background(), "diff --git a/x b/x", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if (*requests)[0].Options != nil {
+		t.Errorf("options sent before they were set: %+v", (*requests)[0].Options)
+	}
+	options := (*requests)[1].Options
+	if options == nil || options.TopK == nil || *options.TopK != 40 || options.NumPredict != 64 ||
+		strings.Join(options.Stop, ",") != "###" || options.Temperature != nil {
+		t.Errorf("unexpected options %+v", options)
+	}
+}
+
+func TestOllamaContextWindow(t *testing.T) {
+	server, requests := newOllamaStandIn(t, []string{strings.Repeat("word ", 40)})
+	model, _ := NewOllamaModel(server.URL, "testmodel", "")
+	model.SetContextWindow(ContextWindow{Tokens: 100})
+
+	if _, err := model.ChatMessage(context.Background(), "first", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if usage := model.ContextUsage(context.Background()); usage.Used != 52 || usage.Limit != 100 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+	_, err := model.ChatMessage(context.Background(), strings.Repeat("more ", 40), func(string) {})
+	if !errors.Is(err, ErrContextFull) || len(*requests) != 1 || model.GetHistoryLength() != 2 {
+		t.Errorf("expected a full context before sending, got %v", err)
+	}
+
+	model.SetContextWindow(ContextWindow{Tokens: 100, Trim: true})
+	if _, err := model.ChatMessage(context.Background(), strings.Repeat("more ", 40), func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	last := (*requests)[1]
+	if len(last.Messages) != 2 || last.Options == nil || last.Options.NumCtx != 100 {
+		t.Errorf("expected the old messages left out and num_ctx set: %+v", last)
+	}
+	if model.GetHistoryLength() != 4 {
+		t.Errorf("the history keeps the messages that were left out, got %d", model.GetHistoryLength())
+	}
+}
+
+func TestOllamaHistory(t *testing.T) {
+	server, requests := newOllamaStandIn(t, []string{"ok"})
+	model, _ := NewOllamaModel(server.URL, "", "")
+
+	model.SetHistory([]Message{{Role: RoleUser, Text: "q"}, {Role: RoleModel, Text: "a"}})
+	history := model.GetHistory()
+	if len(history) != 2 || history[1].Role != RoleModel {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	_, err := model.ChatMessage(context.Background(), "next", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := (*requests)[0].Messages; len(sent) != 4 || sent[2].Role != "assistant" {
+		t.Errorf("restored history not sent as ollama roles: %+v", sent)
+	}
+}
+
+func TestOllamaReviewFile(t *testing.T) {
+	server, requests := newOllamaStandIn(t, []string{"Looks good"})
+
+	model, _ := NewOllamaModel(server.URL, "", "review this")
+	result, err := model.ReviewFile(context.Background(), "+added line\n", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Looks good" {
+		t.Errorf("unexpected result %q", result)
+	}
+
+	request := (*requests)[0]
+	if request.Model != OllamaDefaultModel {
+		t.Errorf("expected default model, got %s", request.Model)
+	}
+	if !strings.Contains(request.Messages[1].Content, "+added line") {
+		t.Errorf("diff not inlined: %s", request.Messages[1].Content)
+	}
+}
+
+func TestOllamaError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	model, _ := NewOllamaModel(server.URL, "missing", "")
+	_, err := model.ChatMessage(context.Background(), "hi", func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "model not found") {
+		t.Errorf("expected model not found error, got %v", err)
+	}
+	if model.GetHistoryLength() != 0 {
+		t.Errorf("expected the unanswered message to be left out of the history, got %d",
+			model.GetHistoryLength())
+	}
+}
+
+func TestOllamaCancel(t *testing.T) {
+	// the stand-in sends one chunk and hangs until the client leaves
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Partial"}}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	model, err := NewOllamaModel(server.URL, "testmodel", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result, err := model.ChatMessage(ctx, "hi", func(string) { cancel() })
+	if !Interrupted(err) {
+		t.Fatalf("expected an interrupted error, got %v", err)
+	}
+	if result != "Partial" {
+		t.Errorf("unexpected partial answer %q", result)
+	}
+	history := model.GetHistory()
+	if len(history) != 2 || history[1].Text != "Partial"+InterruptedMarker {
+		t.Errorf("partial answer not kept in the history: %+v", history)
+	}
+}
@@ -0,0 +1,421 @@
+package genaimodel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/review"
+)
+
+const (
+	OpenAIDefaultURL = "https://api.openai.com/v1"
+)
+
+// openaiMessage is a message of the /v1/chat/completions
+// protocol. The roles are "system", "user" and "assistant"
+type openaiMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openaiChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openaiMessage       `json:"messages"`
+	Stream         bool                  `json:"stream"`
+	ResponseFormat *openaiResponseFormat `json:"response_format,omitempty"`
+	// the generation parameters, top_k is no part of the
+	// protocol but vLLM and LiteLLM accept it
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	TopK        *int32   `json:"top_k,omitempty"`
+	MaxTokens   int32    `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int32   `json:"seed,omitempty"`
+	// StreamOptions asks for the usage in the last event
+	StreamOptions *openaiStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openaiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// openaiResponseFormat of type "json_object" is the json mode,
+// supported by most gateways
+type openaiResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// openaiChatChunk is the data of one server sent event
+type openaiChatChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	// Usage is only in the last event, without choices
+	Usage *struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage,omitempty"`
+	// Error is set when the server fails during the stream
+	Error *openaiStreamError `json:"error,omitempty"`
+}
+
+// openaiStreamError is an error event in the middle of the stream,
+// after the response was ok. Depending on the server the code is a
+// http status or a name like "rate_limit_exceeded"
+type openaiStreamError struct {
+	Message string          `json:"message"`
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+}
+
+type openaiErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type openaiModel struct {
+	systemInstruction string
+	baseURL           string
+	modelName         string
+	apiKey            string
+	httpClient        *http.Client
+	chatHistory       []openaiMessage
+	params            Params
+	budget            budget
+	onUsage           UsageHandler
+	caller            caller
+}
+
+// NewOpenAIModel sets up a client for any server that speaks the
+// OpenAI chat completions protocol, like vLLM, LM Studio or
+// LiteLLM. The baseURL includes the version, for example
+// "http://localhost:8000/v1". The apiKey may be empty for
+// gateways that do not need one
+func NewOpenAIModel(baseURL, model, apiKey, systemInstruction string) (Action, error) {
+	if baseURL == "" {
+		baseURL = OpenAIDefaultURL
+	}
+	if model == "" {
+		return nil, errors.New("no model given for the openai compatible backend")
+	}
+
+	return &openaiModel{
+		systemInstruction: systemInstruction,
+		baseURL:           strings.TrimSuffix(baseURL, "/"),
+		modelName:         model,
+		apiKey:            apiKey,
+		httpClient:        http.DefaultClient,
+		budget:            budget{fallback: OpenAIDefaultContextWindow},
+	}, nil
+}
+
+func (m *openaiModel) GetHistoryLength() int {
+	return len(m.chatHistory)
+}
+
+func (m *openaiModel) GetHistory() []Message {
+	return openaiHistory(m.chatHistory)
+}
+
+// openaiHistory maps the "assistant" role to RoleModel
+func openaiHistory(messages []openaiMessage) []Message {
+	history := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		role := RoleUser
+		if message.Role == "assistant" {
+			role = RoleModel
+		}
+		history = append(history, Message{Role: role, Text: message.Content})
+	}
+
+	return history
+}
+
+func (m *openaiModel) SetHistory(history []Message) {
+	m.chatHistory = nil
+	for _, message := range history {
+		role := "user"
+		if message.Role == RoleModel {
+			role = "assistant"
+		}
+		m.chatHistory = append(m.chatHistory, openaiMessage{Role: role, Content: message.Text})
+	}
+}
+
+func (m *openaiModel) UpdateSystemInstruction(systemInstruction string) {
+	m.systemInstruction = systemInstruction
+}
+
+func (m *openaiModel) GetParams() Params {
+	return m.params
+}
+
+func (m *openaiModel) SetParams(params Params) {
+	m.params = params
+}
+
+func (m *openaiModel) SetContextWindow(window ContextWindow) {
+	m.budget.window = window
+}
+
+func (m *openaiModel) GetUsageHandler() UsageHandler {
+	return m.onUsage
+}
+
+func (m *openaiModel) SetUsageHandler(handler UsageHandler) {
+	m.onUsage = handler
+}
+
+func (m *openaiModel) SetRetryPolicy(policy RetryPolicy) {
+	m.caller.policy = policy
+}
+
+// DeleteFiles does nothing, the diff is sent inline
+func (m *openaiModel) DeleteFiles(context.Context) error {
+	return nil
+}
+
+// ContextUsage estimates the tokens, the tokenizer
+// depends on the model behind the gateway
+func (m *openaiModel) ContextUsage(ctx context.Context) ContextUsage {
+	return m.budget.usage(ctx, m.systemInstruction, openaiTexts(m.chatHistory))
+}
+
+func openaiTexts(messages []openaiMessage) []string {
+	texts := make([]string, 0, len(messages))
+	for _, message := range messages {
+		texts = append(texts, message.Content)
+	}
+
+	return texts
+}
+
+// ChatMessage sends the message together with the full chat
+// history and streams the deltas of the answer to onChunk
+func (m *openaiModel) ChatMessage(ctx context.Context, userPrompt string,
+	onChunk func(string)) (string, error) {
+	m.chatHistory = append(m.chatHistory, openaiMessage{Role: "user", Content: userPrompt})
+
+	fullString, err := m.chat(ctx, m.chatHistory, false, onChunk)
+	if Interrupted(err) {
+		m.chatHistory = append(m.chatHistory, openaiMessage{Role: "assistant", Content: fullString + InterruptedMarker})
+		return fullString, err
+	}
+	if err != nil {
+		// the message was not answered, it is not kept
+		m.chatHistory = m.chatHistory[:len(m.chatHistory)-1]
+		return "", err
+	}
+
+	m.chatHistory = append(m.chatHistory, openaiMessage{Role: "assistant", Content: fullString})
+
+	return fullString, nil
+}
+
+// SendSystemPrompt asks the model to introduce itself, the
+// system message is part of every request
+func (m *openaiModel) SendSystemPrompt(ctx context.Context) (string, error) {
+	introduction := []openaiMessage{{Role: "user", Content: "Hi - please introduce yourselve"}}
+
+	return m.chat(ctx, introduction, false, func(string) {})
+}
+
+// ReviewFile reviews the diff, which is inlined
+// in the user message
+func (m *openaiModel) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	fullString, err := review.Run(ctx, diff, review.Options{}, m.generateReview, onChunk)
+	if Interrupted(err) && fullString != "" {
+		m.chatHistory = append(m.chatHistory, openaiMessage{Role: "assistant", Content: fullString + InterruptedMarker})
+	}
+	if err != nil {
+		return fullString, err
+	}
+
+	m.chatHistory = append(m.chatHistory, openaiMessage{Role: "assistant", Content: fullString})
+
+	return fullString, nil
+}
+
+// ReviewFindings asks for a json answer, the rendered
+// markdown is added to the chat history
+func (m *openaiModel) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	findings, err := review.RunFindings(ctx, diff, review.Options{Categories: categories},
+		m.generateReview, onChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	m.chatHistory = append(m.chatHistory, openaiMessage{Role: "assistant", Content: review.RenderMarkdown(findings)})
+
+	return findings, nil
+}
+
+// generateReview sends the chat history with the review
+// command, the answer is not added to the history
+func (m *openaiModel) generateReview(ctx context.Context, request review.Request,
+	onChunk func(string)) (string, error) {
+	messages := append([]openaiMessage{}, m.chatHistory...)
+	messages = append(messages, openaiMessage{Role: "user",
+		Content: inlineReviewCommand(request.Diff, request.Instruction)})
+
+	return m.chat(ctx, messages, request.JSON, onChunk)
+}
+
+// chat posts the messages to /chat/completions with the system
+// instruction as first message and reads the server sent events.
+// The last message is the request, the messages before it are
+// left out when they do not fit the context window. The jsonMode
+// forces the answer to be json. When the context is cancelled
+// the answer so far is returned with the error of the context
+func (m *openaiModel) chat(ctx context.Context, messages []openaiMessage,
+	jsonMode bool, onChunk func(string)) (string, error) {
+	last := len(messages) - 1
+	start, err := m.budget.fit(ctx, m.systemInstruction, openaiHistory(messages[:last]),
+		messages[last].Content, int(m.params.MaxTokens))
+	if err != nil {
+		return "", err
+	}
+	messages = messages[start:]
+
+	request := openaiChatRequest{
+		Model:  m.modelName,
+		Stream: true,
+		Messages: append([]openaiMessage{
+			{Role: "system", Content: m.systemInstruction},
+		}, messages...),
+		Temperature:   m.params.Temperature,
+		TopP:          m.params.TopP,
+		TopK:          m.params.TopK,
+		MaxTokens:     m.params.MaxTokens,
+		Stop:          m.params.StopSequences,
+		Seed:          m.params.Seed,
+		StreamOptions: &openaiStreamOptions{IncludeUsage: true},
+	}
+	if jsonMode {
+		request.ResponseFormat = &openaiResponseFormat{Type: "json_object"}
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	return retry(ctx, &m.caller, onChunk, func(onChunk func(string)) (string, error) {
+		return m.post(ctx, body, onChunk)
+	})
+}
+
+// post sends a single request to /chat/completions
+func (m *openaiModel) post(ctx context.Context, body []byte, onChunk func(string)) (string, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		m.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "text/event-stream")
+	if m.apiKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	resp, err := m.httpClient.Do(httpRequest)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp, openaiError(resp))
+	}
+
+	var build strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			// empty lines separate events, lines with
+			// a colon in front are comments
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openaiChatChunk
+		err := json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			return "", err
+		}
+		if chunk.Error != nil {
+			return build.String(), chunk.Error.callError()
+		}
+		if chunk.Usage != nil {
+			m.onUsage.report(Usage{InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens,
+				CachedTokens: chunk.Usage.PromptTokensDetails.CachedTokens})
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		onChunk(chunk.Choices[0].Delta.Content) // raise callback func
+		build.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() != nil {
+		// stopped by the user, keep what was received
+		return build.String(), ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return build.String(), nil
+}
+
+// callError classifies the error event like a response that is not ok
+func (e *openaiStreamError) callError() *CallError {
+	code := strings.Trim(string(e.Code), `"`)
+	status, _ := strconv.Atoi(code)
+	kindStatus := status
+	switch {
+	case status != 0:
+	case strings.Contains(e.Type+code, "rate_limit") || strings.Contains(e.Type+code, "insufficient_quota"):
+		kindStatus = http.StatusTooManyRequests
+	case e.Type == "server_error":
+		kindStatus = http.StatusInternalServerError
+	}
+
+	return &CallError{Kind: statusKind(kindStatus, e.Type+" "+code+" "+e.Message), Status: status,
+		Err: fmt.Errorf("openai stream error: %s", e.Message)}
+}
+
+// openaiError reads the error message from the response body,
+// or falls back to the plain body for non standard gateways
+func openaiError(resp *http.Response) error {
+	errorBody, _ := io.ReadAll(resp.Body)
+
+	var errorResponse openaiErrorResponse
+	if json.Unmarshal(errorBody, &errorResponse) == nil && errorResponse.Error.Message != "" {
+		return fmt.Errorf("openai returned %s: %s", resp.Status, errorResponse.Error.Message)
+	}
+
+	return fmt.Errorf("openai returned %s: %s", resp.Status, strings.TrimSpace(string(errorBody)))
+}
@@ -0,0 +1,110 @@
+package genaimodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIChatMessage(t *testing.T) {
+	var requests []openaiChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, `{"error":{"message":"bad key"}}`, http.StatusUnauthorized)
+			return
+		}
+		var request openaiChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, request)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"role":"assistant"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":"Hi"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":" you"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":2,`+
+			`"prompt_tokens_details":{"cached_tokens":4}}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	model, err := NewOpenAIModel(server.URL+"/v1/", "local-model", "secret", "be nice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var usage Usage
+	model.SetUsageHandler(func(u Usage) {
+		usage = u
+	})
+
+	var chunks []string
+	result, err := model.ChatMessage(context.Background(), "hello", func(s string) {
+		chunks = append(chunks, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Hi you" || len(chunks) != 2 {
+		t.Errorf("unexpected result %q from chunks %q", result, chunks)
+	}
+	if usage != (Usage{InputTokens: 9, OutputTokens: 2, CachedTokens: 4}) ||
+		requests[0].StreamOptions == nil || !requests[0].StreamOptions.IncludeUsage {
+		t.Errorf("usage not asked for or not read: %+v", usage)
+	}
+
+	var params Params
+	for name, value := range map[string]string{ParamTemperature: "0.2", ParamSeed: "7", ParamMaxTokens: "100"} {
+		if err := params.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model.SetParams(params)
+	_, err = model.ChatMessage(context.Background(), "again", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.GetHistoryLength() != 4 {
+		t.Errorf("expected history of 4, got %d", model.GetHistoryLength())
+	}
+
+	second := requests[1]
+	roles := []string{}
+	for _, message := range second.Messages {
+		roles = append(roles, message.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,user" {
+		t.Errorf("unexpected roles %v", roles)
+	}
+	if second.Messages[0].Content != "be nice" {
+		t.Errorf("system instruction not mapped: %+v", second.Messages[0])
+	}
+	if requests[0].Temperature != nil || requests[0].Seed != nil {
+		t.Errorf("parameters sent before they were set: %+v", requests[0])
+	}
+	if second.Temperature == nil || *second.Temperature != 0.2 || second.Seed == nil || *second.Seed != 7 ||
+		second.MaxTokens != 100 || second.TopP != nil {
+		t.Errorf("parameters not sent: %+v", second)
+	}
+
+	unauthorized, _ := NewOpenAIModel(server.URL+"/v1", "local-model", "", "")
+	_, err = unauthorized.ChatMessage(context.Background(), "hello", func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "bad key") {
+		t.Errorf("expected bad key error, got %v", err)
+	}
+	if unauthorized.GetHistoryLength() != 0 {
+		t.Errorf("expected the unanswered message to be left out of the history, got %d",
+			unauthorized.GetHistoryLength())
+	}
+}
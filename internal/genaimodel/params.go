@@ -0,0 +1,147 @@
+package genaimodel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Names of the generation parameters, for the
+// config, the flags and the /params command
+const (
+	ParamTemperature    = "temperature"
+	ParamTopP           = "top-p"
+	ParamTopK           = "top-k"
+	ParamMaxTokens      = "max-tokens"
+	ParamStop           = "stop"
+	ParamSeed           = "seed"
+	ParamThinkingBudget = "thinking-budget"
+)
+
+// ParamNames lists the generation parameters in the order
+// they are shown
+var ParamNames = []string{ParamTemperature, ParamTopP, ParamTopK, ParamMaxTokens,
+	ParamStop, ParamSeed, ParamThinkingBudget}
+
+// Params are the generation parameters of the requests to the
+// model. A nil or empty field keeps the default of the model.
+// A backend that does not know a parameter ignores it
+type Params struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"topP,omitempty"`
+	TopK        *int32   `json:"topK,omitempty"`
+	// MaxTokens limits the length of the answer
+	MaxTokens     int32    `json:"maxTokens,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+	Seed          *int32   `json:"seed,omitempty"`
+	// ThinkingBudget is the number of tokens a thinking model
+	// may think, 0 turns thinking off and -1 lets the model decide
+	ThinkingBudget *int32 `json:"thinkingBudget,omitempty"`
+}
+
+// Set changes a parameter by name. An empty value, or
+// "default", goes back to the default of the model. Every
+// stop sequence that is set is added to the others
+func (p *Params) Set(name, value string) error {
+	value = strings.TrimSpace(value)
+	reset := value == "" || value == "default"
+	var err error
+	switch name {
+	case ParamTemperature:
+		p.Temperature, err = parseFloat(value, reset, 0, 2)
+	case ParamTopP:
+		p.TopP, err = parseFloat(value, reset, 0, 1)
+	case ParamTopK:
+		p.TopK, err = parseInt(value, reset, 1)
+	case ParamMaxTokens:
+		var maxTokens *int32
+		maxTokens, err = parseInt(value, reset, 1)
+		p.MaxTokens = 0
+		if maxTokens != nil {
+			p.MaxTokens = *maxTokens
+		}
+	case ParamStop:
+		if reset {
+			p.StopSequences = nil
+		} else {
+			p.StopSequences = append(p.StopSequences, value)
+		}
+	case ParamSeed:
+		p.Seed, err = parseInt(value, reset, -1<<31)
+	case ParamThinkingBudget:
+		p.ThinkingBudget, err = parseInt(value, reset, -1)
+	default:
+		return fmt.Errorf("unknown parameter %q, use one of: %s", name, strings.Join(ParamNames, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func parseFloat(value string, reset bool, minimum, maximum float64) (*float32, error) {
+	if reset {
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number", value)
+	}
+	if number < minimum || number > maximum {
+		return nil, fmt.Errorf("%s is not between %g and %g", value, minimum, maximum)
+	}
+	result := float32(number)
+
+	return &result, nil
+}
+
+func parseInt(value string, reset bool, minimum int64) (*int32, error) {
+	if reset {
+		return nil, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a whole number", value)
+	}
+	if number < minimum {
+		return nil, fmt.Errorf("%s is less than %d", value, minimum)
+	}
+	result := int32(number)
+
+	return &result, nil
+}
+
+// String shows the parameters that are set as name=value
+func (p Params) String() string {
+	var set []string
+	add := func(name string, value string) {
+		set = append(set, name+"="+value)
+	}
+	if p.Temperature != nil {
+		add(ParamTemperature, strconv.FormatFloat(float64(*p.Temperature), 'g', -1, 32))
+	}
+	if p.TopP != nil {
+		add(ParamTopP, strconv.FormatFloat(float64(*p.TopP), 'g', -1, 32))
+	}
+	if p.TopK != nil {
+		add(ParamTopK, strconv.Itoa(int(*p.TopK)))
+	}
+	if p.MaxTokens != 0 {
+		add(ParamMaxTokens, strconv.Itoa(int(p.MaxTokens)))
+	}
+	for _, stop := range p.StopSequences {
+		add(ParamStop, strconv.Quote(stop))
+	}
+	if p.Seed != nil {
+		add(ParamSeed, strconv.Itoa(int(*p.Seed)))
+	}
+	if p.ThinkingBudget != nil {
+		add(ParamThinkingBudget, strconv.Itoa(int(*p.ThinkingBudget)))
+	}
+	if len(set) == 0 {
+		return "the defaults of the model"
+	}
+
+	return strings.Join(set, " ")
+}
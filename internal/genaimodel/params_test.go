@@ -0,0 +1,51 @@
+package genaimodel
+
+import (
+	"testing"
+)
+
+func TestParamsSet(t *testing.T) {
+	var params Params
+	settings := [][2]string{
+		{ParamTemperature, "0.3"},
+		{ParamTopP, "0.9"},
+		{ParamTopK, "20"},
+		{ParamMaxTokens, "2048"},
+		{ParamStop, "END"},
+		{ParamStop, "---"},
+		{ParamSeed, "42"},
+		{ParamThinkingBudget, "-1"},
+	}
+	for _, setting := range settings {
+		if err := params.Set(setting[0], setting[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `temperature=0.3 top-p=0.9 top-k=20 max-tokens=2048 stop="END" stop="---" seed=42 thinking-budget=-1`
+	if params.String() != want {
+		t.Errorf("got %s, want %s", params.String(), want)
+	}
+
+	for _, name := range ParamNames {
+		if err := params.Set(name, "default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if params.String() != "the defaults of the model" {
+		t.Errorf("parameters not reset: %s", params.String())
+	}
+
+	wrong := [][2]string{
+		{ParamTemperature, "3"},
+		{ParamTopP, "high"},
+		{ParamTopK, "0"},
+		{ParamMaxTokens, "1.5"},
+		{ParamThinkingBudget, "-2"},
+		{"top_p", "0.5"},
+	}
+	for _, setting := range wrong {
+		if err := params.Set(setting[0], setting[1]); err == nil {
+			t.Errorf("expected an error for %s=%s", setting[0], setting[1])
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package genaimodel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+const (
+	// DefaultAttempts is the number of calls of a request
+	// when no retry policy is configured
+	DefaultAttempts = 4
+	// retryBase is the first backoff, it doubles on every
+	// attempt up to retryMax
+	retryBase = time.Second
+	retryMax  = 30 * time.Second
+	// retryAfterMax is the longest wait a service may ask
+	// for, a longer wait fails the request right away
+	retryAfterMax = 2 * time.Minute
+)
+
+// ErrorKind tells why a call to a model failed
+type ErrorKind string
+
+// Kinds of failed calls, only a rate limit and a
+// transient error are tried again
+const (
+	KindRateLimit ErrorKind = "rate limit"
+	KindQuota     ErrorKind = "quota"
+	KindTransient ErrorKind = "transient"
+	KindAuth      ErrorKind = "auth"
+	KindSafety    ErrorKind = "safety block"
+	KindOther     ErrorKind = "other"
+)
+
+// CallError is a call to a model that failed, also
+// after trying again when that made sense
+type CallError struct {
+	Kind ErrorKind
+	// Status is the http status, 0 without response
+	Status int
+	// RetryAfter is the wait the service asked for
+	RetryAfter time.Duration
+	// Attempts is the number of calls that were made
+	Attempts int
+	Err      error
+}
+
+func (e *CallError) Error() string {
+	tried := ""
+	if e.Attempts > 1 {
+		tried = fmt.Sprintf(", gave up after %d attempts", e.Attempts)
+	}
+	switch e.Kind {
+	case KindRateLimit:
+		return fmt.Sprintf("the model is rate limited%s: %v", tried, e.Err)
+	case KindQuota:
+		return fmt.Sprintf("the quota of the model is used up: %v", e.Err)
+	case KindTransient:
+		return fmt.Sprintf("the model is not available%s: %v", tried, e.Err)
+	case KindAuth:
+		return fmt.Sprintf("the api key is refused, check the key of the provider: %v", e.Err)
+	case KindSafety:
+		return fmt.Sprintf("the answer was blocked by the safety filters: %v", e.Err)
+	}
+
+	return e.Err.Error()
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// retryable are the kinds that may work on a next attempt
+func (e *CallError) retryable() bool {
+	return e.Kind == KindRateLimit || e.Kind == KindTransient
+}
+
+// RetryPolicy tells how often a failed request is tried
+// again and how many requests a minute may be sent
+type RetryPolicy struct {
+	// Attempts is the number of calls of a request, 0 uses
+	// DefaultAttempts and 1 never tries again
+	Attempts int `json:"attempts,omitempty"`
+	// RequestsPerMinute spaces the requests, 0 is no limit
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts <= 0 {
+		return DefaultAttempts
+	}
+
+	return p.Attempts
+}
+
+// caller sends the requests of a backend with the retry policy
+type caller struct {
+	policy RetryPolicy
+	// sleep waits between attempts, replaced in tests
+	sleep func(ctx context.Context, delay time.Duration) error
+
+	mutex sync.Mutex
+	// next is the earliest time of the next request
+	next time.Time
+}
+
+// limit waits until the rate limiter lets the next request go
+func (c *caller) limit(ctx context.Context) error {
+	if c.policy.RequestsPerMinute <= 0 {
+		return nil
+	}
+	c.mutex.Lock()
+	now := time.Now()
+	at := c.next
+	if at.Before(now) {
+		at = now
+	}
+	c.next = at.Add(time.Minute / time.Duration(c.policy.RequestsPerMinute))
+	c.mutex.Unlock()
+
+	return c.wait(ctx, at.Sub(now))
+}
+
+func (c *caller) wait(ctx context.Context, delay time.Duration) error {
+	if c.sleep != nil {
+		return c.sleep(ctx, delay)
+	}
+
+	return wait(ctx, delay)
+}
+
+// wait sleeps for the delay, or returns the error
+// of the context when it is cancelled before
+func wait(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoff is the wait before the attempt after the given one,
+// with full jitter. The wait the service asked for is the minimum
+func backoff(attempt int, retryAfter time.Duration) time.Duration {
+	ceiling := retryBase << (attempt - 1)
+	if ceiling > retryMax || ceiling <= 0 {
+		ceiling = retryMax
+	}
+	delay := rand.N(ceiling) + 1
+
+	return max(delay, retryAfter)
+}
+
+// retry calls the request until it succeeds, fails with an error
+// that does not go away or the attempts are used up. A request
+// that already streamed a chunk is not tried again, the user saw
+// the chunks. A stopped request returns its partial answer
+func retry[T any](ctx context.Context, c *caller, onChunk func(string),
+	request func(onChunk func(string)) (T, error)) (T, error) {
+	attempts := c.policy.attempts()
+	for attempt := 1; ; attempt++ {
+		var result T
+		if err := c.limit(ctx); err != nil {
+			return result, err
+		}
+		streamed := false
+		result, err := request(func(chunk string) {
+			streamed = true
+			onChunk(chunk)
+		})
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			// stopped by the user, the partial answer is kept
+			return result, ctx.Err()
+		}
+
+		callErr := classify(err)
+		callErr.Attempts = attempt
+		if !callErr.retryable() || streamed || attempt >= attempts || callErr.RetryAfter > retryAfterMax {
+			return result, callErr
+		}
+		delay := backoff(attempt, callErr.RetryAfter)
+		log.Printf("attempt %d of %d failed, %s, trying again in %s: %v",
+			attempt, attempts, callErr.Kind, delay.Round(time.Millisecond), err)
+		if err := c.wait(ctx, delay); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+// classify finds the kind of the error of a backend
+func classify(err error) *CallError {
+	var callErr *CallError
+	if errors.As(err, &callErr) {
+		return callErr
+	}
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return &CallError{Kind: statusKind(apiErr.Code, apiErr.Message), Status: apiErr.Code,
+			RetryAfter: geminiRetryDelay(apiErr.Details), Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &CallError{Kind: KindTransient, Err: err}
+	}
+
+	return &CallError{Kind: KindOther, Err: err}
+}
+
+// statusKind classifies a http status, a 429 is a quota
+// when the message tells the quota of a day is used up
+func statusKind(status int, message string) ErrorKind {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return KindAuth
+	case http.StatusTooManyRequests:
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "per day") || strings.Contains(lower, "perday") ||
+			strings.Contains(lower, "insufficient_quota") || strings.Contains(lower, "billing") {
+			return KindQuota
+		}
+		return KindRateLimit
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return KindTransient
+	}
+
+	return KindOther
+}
+
+// statusError is the error of a response of the
+// ollama and openai backends that is not ok
+func statusError(resp *http.Response, err error) *CallError {
+	return &CallError{Kind: statusKind(resp.StatusCode, err.Error()), Status: resp.StatusCode,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")), Err: err}
+}
+
+// retryAfter reads the Retry-After header, in
+// seconds or as http date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+
+	return 0
+}
+
+// geminiRetryDelay reads the retryDelay of the RetryInfo
+// in the details of a gemini error, like "37s"
+func geminiRetryDelay(details []map[string]any) time.Duration {
+	for _, detail := range details {
+		if detail["@type"] != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		value, _ := detail["retryDelay"].(string)
+		delay, err := time.ParseDuration(value)
+		if err == nil {
+			return delay
+		}
+	}
+
+	return 0
+}
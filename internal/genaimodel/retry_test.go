@@ -0,0 +1,225 @@
+package genaimodel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		kind       ErrorKind
+		retryAfter time.Duration
+	}{
+		{"gemini rate limit", genai.APIError{Code: 429, Message: "Resource has been exhausted",
+			Details: []map[string]any{{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "37s"}}},
+			KindRateLimit, 37 * time.Second},
+		{"gemini daily quota", fmt.Errorf("chat: %w", genai.APIError{Code: 429,
+			Message: "Quota exceeded for metric GenerateRequestsPerDayPerProjectPerModel"}), KindQuota, 0},
+		{"gemini key", genai.APIError{Code: 403, Message: "API key not valid"}, KindAuth, 0},
+		{"gemini unavailable", genai.APIError{Code: 503, Message: "overloaded"}, KindTransient, 0},
+		{"bad request", genai.APIError{Code: 400, Message: "invalid"}, KindOther, 0},
+		{"broken stream", io.ErrUnexpectedEOF, KindTransient, 0},
+		{"blocked", &CallError{Kind: KindSafety, Err: errors.New("SAFETY")}, KindSafety, 0},
+		{"unknown", errors.New("boom"), KindOther, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callErr := classify(tt.err)
+			if callErr.Kind != tt.kind || callErr.RetryAfter != tt.retryAfter {
+				t.Errorf("expected %s after %s, got %s after %s", tt.kind, tt.retryAfter,
+					callErr.Kind, callErr.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := backoff(attempt, 0)
+		if delay <= 0 || delay > retryMax || delay > retryBase<<(attempt-1) {
+			t.Errorf("attempt %d waits %s", attempt, delay)
+		}
+	}
+	if delay := backoff(1, time.Minute); delay != time.Minute {
+		t.Errorf("expected the Retry-After as minimum, got %s", delay)
+	}
+	if retryAfter("12") != 12*time.Second || retryAfter("") != 0 || retryAfter("soon") != 0 {
+		t.Error("Retry-After in seconds not read")
+	}
+	if delay := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); delay < 59*time.Minute {
+		t.Errorf("Retry-After as date not read, got %s", delay)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var waits []time.Duration
+	c := &caller{policy: RetryPolicy{Attempts: 3}, sleep: func(_ context.Context, delay time.Duration) error {
+		waits = append(waits, delay)
+		return nil
+	}}
+	unavailable := genai.APIError{Code: 503, Message: "overloaded"}
+
+	calls := 0
+	result, err := retry(context.Background(), c, func(string) {}, func(func(string)) (string, error) {
+		calls++
+		if calls < 3 {
+			return "", unavailable
+		}
+		return "ok", nil
+	})
+	if err != nil || result != "ok" || calls != 3 || len(waits) != 2 {
+		t.Errorf("expected success on the third call, got %q %v after %d calls", result, err, calls)
+	}
+
+	calls = 0
+	_, err = retry(context.Background(), c, func(string) {}, func(func(string)) (string, error) {
+		calls++
+		return "", unavailable
+	})
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Attempts != 3 || calls != 3 ||
+		!strings.Contains(err.Error(), "gave up after 3 attempts") {
+		t.Errorf("expected to give up after 3 attempts, got %v", err)
+	}
+
+	calls = 0
+	_, err = retry(context.Background(), c, func(string) {}, func(func(string)) (string, error) {
+		calls++
+		return "", genai.APIError{Code: 401, Message: "no key"}
+	})
+	if !errors.As(err, &callErr) || callErr.Kind != KindAuth || calls != 1 {
+		t.Errorf("an auth error should not be tried again, got %v after %d calls", err, calls)
+	}
+
+	// the user saw the first chunk, a new attempt would repeat it
+	calls = 0
+	result, err = retry(context.Background(), c, func(string) {}, func(onChunk func(string)) (string, error) {
+		calls++
+		onChunk("Hel")
+		return "Hel", io.ErrUnexpectedEOF
+	})
+	if err == nil || result != "Hel" || calls != 1 {
+		t.Errorf("a streamed answer should not be tried again, got %q %v after %d calls", result, err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	_, err = retry(ctx, c, func(string) {}, func(func(string)) (string, error) {
+		calls++
+		cancel()
+		return "", unavailable
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("a stopped request should not be tried again, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var waits []time.Duration
+	c := &caller{policy: RetryPolicy{RequestsPerMinute: 60}, sleep: func(_ context.Context, delay time.Duration) error {
+		waits = append(waits, delay)
+		return nil
+	}}
+	for range 3 {
+		if err := c.limit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(waits) != 3 || waits[0] > 0 || waits[1] < 900*time.Millisecond || waits[2] < 1900*time.Millisecond {
+		t.Errorf("requests not spaced a second apart: %v", waits)
+	}
+}
+
+func TestOllamaRetriesRateLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Hi"},"done":true}`)
+	}))
+	defer server.Close()
+
+	action, _ := NewOllamaModel(server.URL, "testmodel", "")
+	model := action.(*ollamaModel)
+	var waits []time.Duration
+	model.caller.sleep = func(_ context.Context, delay time.Duration) error {
+		waits = append(waits, delay)
+		return nil
+	}
+
+	result, err := model.ChatMessage(context.Background(), "hi", func(string) {})
+	if err != nil || result != "Hi" || calls != 2 {
+		t.Fatalf("expected the second call to answer, got %q %v after %d calls", result, err, calls)
+	}
+	if len(waits) != 1 || waits[0] < 3*time.Second {
+		t.Errorf("the Retry-After of 3s was not honoured: %v", waits)
+	}
+
+	model.SetRetryPolicy(RetryPolicy{Attempts: 1})
+	calls = 0
+	_, err = model.ChatMessage(context.Background(), "again", func(string) {})
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Kind != KindRateLimit || calls != 1 {
+		t.Errorf("expected a rate limit without retry, got %v after %d calls", err, calls)
+	}
+}
+
+func TestOpenAIQuotaIsNotRetried(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"You exceeded your current quota, please check your plan and billing details."}}`)
+	}))
+	defer server.Close()
+
+	model, _ := NewOpenAIModel(server.URL, "local-model", "", "")
+	_, err := model.ChatMessage(context.Background(), "hi", func(string) {})
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Kind != KindQuota || calls != 1 ||
+		!strings.HasPrefix(err.Error(), "the quota of the model is used up") {
+		t.Errorf("expected a quota error without retry, got %v after %d calls", err, calls)
+	}
+}
+
+func TestOpenAIStreamError(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/event-stream")
+		if calls == 1 {
+			// fails before the first chunk, tried again
+			fmt.Fprint(w, `data: {"error":{"message":"overloaded","type":"server_error","code":null}}`+"\n\n")
+			return
+		}
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"content":"Hi"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"error":{"message":"Rate limit reached","code":"rate_limit_exceeded"}}`+"\n\n")
+	}))
+	defer server.Close()
+
+	model, _ := NewOpenAIModel(server.URL, "local-model", "", "")
+	model.(*openaiModel).caller.sleep = func(context.Context, time.Duration) error { return nil }
+	result, err := model.ChatMessage(context.Background(), "hi", func(string) {})
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Kind != KindRateLimit || calls != 2 || result != "" {
+		t.Errorf("expected a rate limit after the chunk without retry, got %q, %v after %d calls", result, err, calls)
+	}
+	if model.GetHistoryLength() != 0 {
+		t.Errorf("the failed message should not be kept, history is %d", model.GetHistoryLength())
+	}
+}
@@ -0,0 +1,51 @@
+package genaimodel
+
+import "google.golang.org/genai"
+
+// Usage are the tokens of a single request as the backend
+// counted them. InputTokens includes the CachedTokens
+type Usage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	CachedTokens int `json:"cachedTokens,omitempty"`
+}
+
+// Price is the price in dollars of a million tokens
+type Price struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cachedInput,omitempty"`
+	Output      float64 `json:"output"`
+}
+
+// Cost of the usage in dollars
+func (p Price) Cost(u Usage) float64 {
+	uncached := u.InputTokens - u.CachedTokens
+
+	return (float64(uncached)*p.Input + float64(u.CachedTokens)*p.CachedInput +
+		float64(u.OutputTokens)*p.Output) / 1000000
+}
+
+// UsageHandler receives the usage of every request that
+// reached the model, also of a request that was stopped
+type UsageHandler func(Usage)
+
+// report is safe to call without handler
+func (h UsageHandler) report(u Usage) {
+	if h != nil && (u.InputTokens > 0 || u.OutputTokens > 0) {
+		h(u)
+	}
+}
+
+// geminiUsage reads the metadata of the last chunk of a stream,
+// the thinking of the model is paid as output
+func geminiUsage(metadata *genai.GenerateContentResponseUsageMetadata) Usage {
+	if metadata == nil {
+		return Usage{}
+	}
+
+	return Usage{
+		InputTokens:  int(metadata.PromptTokenCount),
+		OutputTokens: int(metadata.CandidatesTokenCount + metadata.ThoughtsTokenCount),
+		CachedTokens: int(metadata.CachedContentTokenCount),
+	}
+}
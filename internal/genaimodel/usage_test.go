@@ -0,0 +1,20 @@
+package genaimodel
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPriceCost(t *testing.T) {
+	price := Price{Input: 0.30, CachedInput: 0.075, Output: 2.50}
+	usage := Usage{InputTokens: 1000000, CachedTokens: 400000, OutputTokens: 200000}
+
+	// 0.6M uncached, 0.4M cached and 0.2M output tokens
+	want := 0.6*0.30 + 0.4*0.075 + 0.2*2.50
+	if got := price.Cost(usage); math.Abs(got-want) > 1e-9 {
+		t.Errorf("expected %f, got %f", want, got)
+	}
+	if cost := (Price{}).Cost(usage); cost != 0 {
+		t.Errorf("a model without price is free, got %f", cost)
+	}
+}
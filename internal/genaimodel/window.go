@@ -0,0 +1,207 @@
+package genaimodel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MelleKoning/aifun/internal/tokens"
+)
+
+// Context windows of the backends when none is configured
+const (
+	// GeminiDefaultContextWindow is used when the model
+	// can not be asked for its input token limit
+	GeminiDefaultContextWindow = 1048576
+	// OllamaDefaultContextWindow is the OLLAMA_CONTEXT_LENGTH
+	// of the docker-compose.yaml
+	OllamaDefaultContextWindow = 30000
+	OpenAIDefaultContextWindow = 128000
+)
+
+// nearlyFull is the percentage of the context window
+// from where the usage is shown as a warning
+const nearlyFull = 80
+
+// ErrContextFull is returned, before anything is sent, for a
+// request that does not fit in the context window of the model
+var ErrContextFull = errors.New("the context window of the model is full")
+
+// ContextWindow is the number of tokens a model accepts in a
+// request: the system instruction, the chat history and the
+// new message. A request that does not fit fails, with Trim
+// the oldest messages of the history are left out instead.
+// They stay in the chat history and the saved session
+type ContextWindow struct {
+	// Tokens is the size, 0 uses the default of the backend
+	Tokens int  `json:"tokens,omitempty"`
+	Trim   bool `json:"trim,omitempty"`
+	// CompactAt is the percentage of the window from where a
+	// saved session summarises its older messages, 0 uses the
+	// default and 100 or more never compacts
+	CompactAt int `json:"compactAt,omitempty"`
+}
+
+// ContextUsage is how much of the context window the
+// system instruction and the chat history use
+type ContextUsage struct {
+	Used  int
+	Limit int
+}
+
+// Percent is the used part of the window, 0 when
+// the limit is unknown
+func (u ContextUsage) Percent() int {
+	if u.Limit <= 0 {
+		return 0
+	}
+
+	return u.Used * 100 / u.Limit
+}
+
+// NearlyFull is true when the next messages may not fit
+func (u ContextUsage) NearlyFull() bool {
+	return u.Percent() >= nearlyFull
+}
+
+// String shows the usage like "Context: 12.3k/32k tokens (38%)"
+func (u ContextUsage) String() string {
+	if u.Limit <= 0 {
+		return fmt.Sprintf("Context: %s tokens", formatTokens(u.Used))
+	}
+	text := fmt.Sprintf("Context: %s/%s tokens (%d%%)", formatTokens(u.Used), formatTokens(u.Limit), u.Percent())
+	if u.NearlyFull() {
+		text += ", nearly full"
+	}
+
+	return text
+}
+
+// formatTokens shortens large numbers to k and M
+func formatTokens(count int) string {
+	format := func(value float64, unit string) string {
+		return strings.TrimSuffix(strconv.FormatFloat(value, 'f', 1, 64), ".0") + unit
+	}
+	switch {
+	case count >= 1000000:
+		return format(float64(count)/1000000, "M")
+	case count >= 1000:
+		return format(float64(count)/1000, "k")
+	}
+
+	return strconv.Itoa(count)
+}
+
+// budget keeps the requests of a backend within its context
+// window. The tokens of every message are counted once
+type budget struct {
+	window ContextWindow
+	// fallback is the window when none is configured
+	fallback int
+	// count counts the tokens of a text with the tokenizer of
+	// the model, nil estimates them
+	count func(ctx context.Context, text string) (int, error)
+
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (b *budget) limit() int {
+	if b.window.Tokens > 0 {
+		return b.window.Tokens
+	}
+
+	return b.fallback
+}
+
+// tokens counts the text, the estimate is used
+// when the model can not count it
+func (b *budget) tokens(ctx context.Context, text string) int {
+	if text == "" {
+		return 0
+	}
+	b.mutex.Lock()
+	count, ok := b.counts[text]
+	b.mutex.Unlock()
+	if ok {
+		return count
+	}
+
+	count = tokens.Estimate(text)
+	// after a timeout the rest is estimated
+	if b.count != nil && ctx.Err() == nil {
+		counted, err := b.count(ctx, text)
+		if err != nil {
+			log.Printf("counting tokens, using an estimate: %v", err)
+			return count
+		}
+		count = counted
+	}
+	b.mutex.Lock()
+	if b.counts == nil {
+		b.counts = map[string]int{}
+	}
+	b.counts[text] = count
+	b.mutex.Unlock()
+
+	return count
+}
+
+// usage sums the tokens of the instruction and the history
+func (b *budget) usage(ctx context.Context, instruction string, history []string) ContextUsage {
+	used := b.tokens(ctx, instruction)
+	for _, message := range history {
+		used += b.tokens(ctx, message)
+	}
+
+	return ContextUsage{Used: used, Limit: b.limit()}
+}
+
+// fit returns the index of the first message of the history
+// that is sent with the request. The reserve keeps room for
+// the answer. Without Trim a request that does not fit fails
+// with ErrContextFull, with Trim the oldest questions and
+// answers are left out until it fits
+func (b *budget) fit(ctx context.Context, instruction string, history []Message,
+	request string, reserve int) (int, error) {
+	limit := b.limit()
+	if limit <= 0 {
+		return 0, nil
+	}
+
+	sizes := make([]int, len(history))
+	total := reserve + b.tokens(ctx, instruction) + b.tokens(ctx, request)
+	for i, message := range history {
+		sizes[i] = b.tokens(ctx, message.Text)
+		total += sizes[i]
+	}
+	if total <= limit {
+		return 0, nil
+	}
+	if !b.window.Trim {
+		return 0, fmt.Errorf("%w: the request needs %d of %d tokens, start a new chat with /clear "+
+			"or leave out the oldest messages with --trim-history", ErrContextFull, total, limit)
+	}
+
+	start := 0
+	for total > limit && start < len(history) {
+		// a question goes together with its answer, so the
+		// history that is left starts with a question
+		total -= sizes[start]
+		start++
+		for start < len(history) && history[start].Role != RoleUser {
+			total -= sizes[start]
+			start++
+		}
+	}
+	if total > limit {
+		return 0, fmt.Errorf("%w: the request alone needs %d of %d tokens", ErrContextFull, total, limit)
+	}
+	log.Printf("left out the %d oldest messages to fit the context window of %d tokens", start, limit)
+
+	return start, nil
+}
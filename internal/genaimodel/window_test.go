@@ -0,0 +1,61 @@
+package genaimodel
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestContextUsage(t *testing.T) {
+	tests := map[string]ContextUsage{
+		"Context: 512 tokens":                        {Used: 512},
+		"Context: 12.3k/32k tokens (38%)":            {Used: 12345, Limit: 32000},
+		"Context: 900k/1M tokens (85%), nearly full": {Used: 900000, Limit: 1048576},
+	}
+	for want, usage := range tests {
+		if usage.String() != want {
+			t.Errorf("got %q, want %q", usage.String(), want)
+		}
+	}
+}
+
+func TestBudgetFit(t *testing.T) {
+	// every message is 10 tokens
+	message := strings.Repeat("a", 40)
+	history := []Message{{RoleUser, message}, {RoleModel, message}, {RoleUser, message}, {RoleModel, message}}
+	b := &budget{fallback: 55}
+
+	start, err := b.fit(context.Background(), "", history[:2], message, 0)
+	if err != nil || start != 0 {
+		t.Errorf("a request that fits is sent with all history: %d %v", start, err)
+	}
+	if _, err := b.fit(context.Background(), message, history, message, 0); !errors.Is(err, ErrContextFull) {
+		t.Errorf("expected a full context, got %v", err)
+	}
+
+	b.window = ContextWindow{Trim: true}
+	start, err = b.fit(context.Background(), message, history, message, 0)
+	if err != nil || start != 2 {
+		t.Errorf("expected the oldest question and answer left out: %d %v", start, err)
+	}
+	if _, err := b.fit(context.Background(), message, history, message, 40); !errors.Is(err, ErrContextFull) {
+		t.Errorf("the reserve for the answer does not fit, got %v", err)
+	}
+	// the introduction of the model comes before the first question
+	introduced := append([]Message{{RoleModel, message}}, history...)
+	start, err = b.fit(context.Background(), message, introduced, message, 0)
+	if err != nil || start != 3 || introduced[start].Role != RoleUser {
+		t.Errorf("expected the history to start at a question: %d %v", start, err)
+	}
+
+	counted := 0
+	b.count = func(context.Context, string) (int, error) {
+		counted++
+		return 1, nil
+	}
+	b.counts = nil
+	if usage := b.usage(context.Background(), "", []string{message, message, message, message}); usage.Used != 4 || usage.Limit != 55 || counted != 1 {
+		t.Errorf("every text is counted once: %+v after %d counts", usage, counted)
+	}
+}
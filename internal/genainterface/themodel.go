@@ -25,9 +25,9 @@ type theModel struct {
 	chatHistory       []*genai.Content
 }
 
-// This interface is not being worked on anymore at the moment
-// but supports the /cmd/diffreviewer entry point
-// the later entrypoint is /cmd/tviewchat
+// Only kept for documentation purposes - superseded by
+// the genaimodel package. /cmd/diffreviewer now gets its
+// model from the provider package, like /cmd/tviewchat
 type Action interface {
 	ReviewFile() error
 	ChatMessage(string)
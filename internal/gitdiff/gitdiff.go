@@ -0,0 +1,258 @@
+// Package gitdiff produces the git diff that is to be
+// reviewed, so there is no need to craft a gitdiff.txt
+// by hand anymore
+package gitdiff
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	DefaultContext = 10
+)
+
+// Options select what is diffed. Without Base, Commit,
+// Staged or DiffFile the uncommitted changes of the
+// working tree are diffed against HEAD
+type Options struct {
+	// Base and Head give a revision range, the oldest
+	// revision is the Base. An empty Head is HEAD
+	Base string
+	Head string
+	// MergeBase diffs Head against the merge base of Base
+	// and Head, the changes of a branch like "main...HEAD"
+	MergeBase bool
+	// Commit diffs a single commit against its parent
+	Commit string
+	// Staged diffs the index against HEAD
+	Staged bool
+	// DiffFile reads a prepared diff, like the
+	// gitdiff.txt of earlier versions
+	DiffFile string
+	// Context is the number of unchanged lines around
+	// each change, the -U flag of git diff
+	Context int
+	// Excludes are pathspecs that are left out of the diff
+	Excludes []string
+}
+
+// DefaultOptions diff the working tree without the vendor folder
+func DefaultOptions() Options {
+	return Options{
+		Context:  DefaultContext,
+		Excludes: []string{"vendor"},
+	}
+}
+
+// RegisterFlags adds the flags for selecting the diff
+func (o *Options) RegisterFlags(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&o.Base, "base", o.Base, "base revision of the range to review, e.g. main")
+	flagSet.StringVar(&o.Head, "head", o.Head, "head revision of the range to review, default HEAD")
+	flagSet.Func("range", "revision range to review, base..head or base...head", o.SetRange)
+	flagSet.StringVar(&o.Commit, "commit", o.Commit, "review a single commit")
+	flagSet.BoolVar(&o.Staged, "staged", o.Staged, "review the staged changes")
+	flagSet.StringVar(&o.DiffFile, "diff-file", o.DiffFile, "review a prepared diff file, like gitdiff.txt")
+	flagSet.IntVar(&o.Context, "context", o.Context, "lines of context around each change")
+	flagSet.Var(&excludeList{list: &o.Excludes}, "exclude",
+		"pathspec to leave out of the diff, can be repeated (default vendor)")
+}
+
+// SetRange sets Base and Head from "base..head". With three
+// dots, "base...head", the merge base of both is diffed
+func (o *Options) SetRange(revisionRange string) error {
+	separator := ".."
+	if strings.Contains(revisionRange, "...") {
+		separator = "..."
+	}
+	base, head, found := strings.Cut(revisionRange, separator)
+	if !found || base == "" {
+		return fmt.Errorf("invalid range %q, use base..head", revisionRange)
+	}
+	o.Base, o.Head = base, head
+	o.MergeBase = separator == "..."
+
+	return nil
+}
+
+// Validate checks that only one way of selecting the diff is used
+func (o Options) Validate() error {
+	modes := 0
+	for _, selected := range []bool{o.Base != "", o.Commit != "", o.Staged, o.DiffFile != ""} {
+		if selected {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return errors.New("use only one of --base or --range, --commit, --staged and --diff-file")
+	}
+	if o.Head != "" && o.Base == "" {
+		return errors.New("--head needs a --base")
+	}
+	if o.Context < 0 {
+		return errors.New("--context can not be negative")
+	}
+
+	return nil
+}
+
+// Describe tells what is diffed, to show to the user
+func (o Options) Describe() string {
+	switch {
+	case o.DiffFile != "":
+		return "file " + o.DiffFile
+	case o.Commit != "":
+		return "commit " + o.Commit
+	case o.Staged:
+		return "staged changes"
+	case o.Base != "" && o.MergeBase:
+		return o.Base + "..." + o.head()
+	case o.Base != "":
+		return o.Base + ".." + o.head()
+	default:
+		return "working tree"
+	}
+}
+
+// Args returns the arguments for git
+func (o Options) Args() []string {
+	args := []string{"diff", "--no-color", "--no-ext-diff", fmt.Sprintf("-U%d", o.Context)}
+
+	switch {
+	case o.Commit != "":
+		// diff-tree also shows the root commit, which has no
+		// parent, a merge is compared with its first parent
+		args = []string{"diff-tree", "-p", "--root", "--no-commit-id", "-m", "--first-parent",
+			"--no-color", "--no-ext-diff", fmt.Sprintf("-U%d", o.Context), o.Commit}
+	case o.Staged:
+		args = append(args, "--cached")
+	case o.Base != "" && o.MergeBase:
+		args = append(args, o.Base+"..."+o.head())
+	case o.Base != "":
+		// the oldest revision first, so that added lines
+		// get a + and removed lines get a -
+		args = append(args, o.Base, o.head())
+	default:
+		args = append(args, "HEAD")
+	}
+
+	args = append(args, "--", ".")
+	for _, exclude := range o.Excludes {
+		args = append(args, ":(exclude)"+exclude)
+	}
+
+	return args
+}
+
+// Diff runs git diff in the current folder, or reads the DiffFile
+func Diff(ctx context.Context, o Options) (string, error) {
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
+
+	if o.DiffFile != "" {
+		contents, err := os.ReadFile(o.DiffFile)
+		if err != nil {
+			return "", err
+		}
+		return string(contents), nil
+	}
+
+	output, err := git(ctx, o.Args()...)
+	if err != nil {
+		return "", fmt.Errorf("git diff %s: %w", o.Describe(), err)
+	}
+
+	return output, nil
+}
+
+// Branch is the name of the current branch, "HEAD"
+// when no branch is checked out
+func Branch(ctx context.Context) (string, error) {
+	output, err := git(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("git branch: %w", err)
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// Commits are the short hashes and subjects of the commits
+// that are diffed, newest first. The working tree, the index
+// and a diff file have no commits
+func (o Options) Commits(ctx context.Context) ([]string, error) {
+	var revisions []string
+	switch {
+	case o.DiffFile != "" || o.Staged:
+		return nil, nil
+	case o.Commit != "":
+		revisions = []string{"-1", o.Commit}
+	case o.Base != "":
+		revisions = []string{o.Base + ".." + o.head()}
+	default:
+		return nil, nil
+	}
+
+	output, err := git(ctx, append([]string{"log", "--no-color", "--format=%h %s"}, revisions...)...)
+	if err != nil {
+		return nil, fmt.Errorf("git log %s: %w", o.Describe(), err)
+	}
+
+	return strings.FieldsFunc(output, func(r rune) bool { return r == '\n' }), nil
+}
+
+// git runs git with the arguments and returns its output,
+// the error holds what git wrote to stderr
+func git(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+func (o Options) head() string {
+	if o.Head == "" {
+		return "HEAD"
+	}
+
+	return o.Head
+}
+
+// excludeList is a repeatable flag, the first value
+// given replaces the default excludes
+type excludeList struct {
+	list *[]string
+	set  bool
+}
+
+func (e *excludeList) String() string {
+	if e.list == nil {
+		return ""
+	}
+
+	return strings.Join(*e.list, ",")
+}
+
+func (e *excludeList) Set(value string) error {
+	if !e.set {
+		*e.list = nil
+		e.set = true
+	}
+	if value != "" {
+		*e.list = append(*e.list, value)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package gitdiff
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		options Options
+		want    string
+	}{
+		{DefaultOptions(), "diff --no-color --no-ext-diff -U10 HEAD -- . :(exclude)vendor"},
+		{Options{Base: "main", Context: 3}, "diff --no-color --no-ext-diff -U3 main HEAD -- ."},
+		{Options{Base: "a1", Head: "b2"}, "diff --no-color --no-ext-diff -U0 a1 b2 -- ."},
+		{Options{Base: "main", MergeBase: true}, "diff --no-color --no-ext-diff -U0 main...HEAD -- ."},
+		{Options{Commit: "abc"},
+			"diff-tree -p --root --no-commit-id -m --first-parent --no-color --no-ext-diff -U0 abc -- ."},
+		{Options{Staged: true, Excludes: []string{"vendor", "*.pb.go"}},
+			"diff --no-color --no-ext-diff -U0 --cached -- . :(exclude)vendor :(exclude)*.pb.go"},
+	}
+
+	for _, test := range tests {
+		got := strings.Join(test.options.Args(), " ")
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.options.Describe(), got, test.want)
+		}
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	var o Options
+	if err := o.SetRange("main..feature"); err != nil || o.Base != "main" || o.Head != "feature" || o.MergeBase {
+		t.Errorf("unexpected options %+v, %v", o, err)
+	}
+	if err := o.SetRange("main...HEAD"); err != nil || o.Base != "main" || o.Head != "HEAD" || !o.MergeBase {
+		t.Errorf("unexpected options %+v, %v", o, err)
+	}
+	if err := o.SetRange("main"); err == nil {
+		t.Error("expected error for a range without ..")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (Options{Base: "main", Staged: true}).Validate(); err == nil {
+		t.Error("expected error for --base with --staged")
+	}
+	if err := (Options{Head: "HEAD"}).Validate(); err == nil {
+		t.Error("expected error for --head without --base")
+	}
+}
+
+func TestDiffWorkingTree(t *testing.T) {
+	t.Chdir(t.TempDir())
+	git := func(args ...string) {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "test")
+	writeFile(t, "main.go", "package main\n")
+	writeFile(t, "vendor/lib.go", "package lib\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+
+	// the first commit has no parent to compare with
+	root := DefaultOptions()
+	root.Commit = "HEAD"
+	diff, err := Diff(context.Background(), root)
+	if err != nil || !strings.Contains(diff, "+package main") || strings.Contains(diff, "vendor") {
+		t.Errorf("unexpected diff of the root commit %q %v", diff, err)
+	}
+
+	writeFile(t, "main.go", "package main\n\nfunc main() {}\n")
+	writeFile(t, "vendor/lib.go", "package lib\n\nvar x = 1\n")
+
+	diff, err = Diff(context.Background(), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "+func main() {}") {
+		t.Errorf("change to main.go missing in %q", diff)
+	}
+	if strings.Contains(diff, "vendor") {
+		t.Errorf("vendor is not excluded in %q", diff)
+	}
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	if err := os.MkdirAll("vendor", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBranchAndCommits(t *testing.T) {
+	t.Chdir(t.TempDir())
+	git := func(args ...string) {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "test")
+	git("commit", "-q", "--allow-empty", "-m", "first")
+	git("checkout", "-q", "-b", "feature/ABC-12")
+	git("commit", "-q", "--allow-empty", "-m", "second")
+	git("commit", "-q", "--allow-empty", "-m", "third")
+
+	ctx := context.Background()
+	if branch, err := Branch(ctx); err != nil || branch != "feature/ABC-12" {
+		t.Errorf("unexpected branch %q %v", branch, err)
+	}
+
+	commits, err := Options{Base: "main"}.Commits(ctx)
+	if err != nil || len(commits) != 2 || !strings.HasSuffix(commits[0], " third") {
+		t.Errorf("unexpected commits %q %v", commits, err)
+	}
+	if commits, _ := (Options{Commit: "HEAD~1"}).Commits(ctx); len(commits) != 1 ||
+		!strings.HasSuffix(commits[0], " second") {
+		t.Errorf("unexpected commit %q", commits)
+	}
+	if commits, _ := DefaultOptions().Commits(ctx); commits != nil {
+		t.Errorf("the working tree has no commits, got %q", commits)
+	}
+}
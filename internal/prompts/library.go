@@ -0,0 +1,395 @@
+package prompts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/MelleKoning/aifun/internal/config"
+)
+
+const (
+	dirName   = "prompts"
+	extension = ".md"
+	// frontMatter starts and ends the settings of a prompt file
+	frontMatter = "---"
+)
+
+// Output formats of a prompt
+const (
+	FormatMarkdown = "markdown"
+	FormatFindings = "findings"
+)
+
+// Default is the library of the tools, it holds the built-in
+// prompts until Load reads the prompt files
+var Default = NewLibrary(DefaultDirs()...)
+
+// Library holds the built-in prompts merged with the prompt
+// files of the user and of the repository. A file prompt with
+// the name of a built-in prompt replaces it, the files of a
+// later folder replace the ones of an earlier folder
+type Library struct {
+	Dirs []string
+
+	mu      sync.RWMutex
+	prompts []Prompt
+	stamp   string
+}
+
+// NewLibrary reads the prompt files from the folders on Load
+func NewLibrary(dirs ...string) *Library {
+	return &Library{Dirs: dirs, prompts: PromptList}
+}
+
+// DefaultDirs are ~/.aifun/prompts of the user and
+// .aifun/prompts of the current repository
+func DefaultDirs() []string {
+	return append(UserDirs(), filepath.Join(config.DirName, dirName))
+}
+
+// UserDirs is ~/.aifun/prompts of the user, without the
+// prompts of the repository that is checked out
+func UserDirs() []string {
+	userDir, err := config.UserDir()
+	if err != nil {
+		return nil
+	}
+
+	return []string{filepath.Join(userDir, dirName)}
+}
+
+// Load reads the prompt files. Files that can not be read
+// are logged and skipped, missing folders are no error
+func (l *Library) Load() error {
+	list := append([]Prompt(nil), PromptList...)
+	for _, dir := range l.Dirs {
+		files, err := promptFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, path := range files {
+			prompt, err := ReadFile(path)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			list = merge(list, prompt)
+		}
+	}
+	stamp, err := l.fingerprint()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prompts = list
+	l.stamp = stamp
+
+	return nil
+}
+
+// merge replaces the prompt with the same name, or adds it
+func merge(list []Prompt, prompt Prompt) []Prompt {
+	for i := range list {
+		if strings.EqualFold(list[i].Name, prompt.Name) {
+			list[i] = prompt
+			return list
+		}
+	}
+
+	return append(list, prompt)
+}
+
+// promptFiles are the markdown files of the folder, sorted
+func promptFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), extension) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// fingerprint changes when a prompt file is added,
+// removed or written
+func (l *Library) fingerprint() (string, error) {
+	var stamp strings.Builder
+	for _, dir := range l.Dirs {
+		files, err := promptFiles(dir)
+		if err != nil {
+			return "", err
+		}
+		for _, path := range files {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&stamp, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	return stamp.String(), nil
+}
+
+// Watch loads the prompts again when the files change, and
+// calls onReload after. It checks every interval until the
+// context is done
+func (l *Library) Watch(ctx context.Context, interval time.Duration, onReload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamp, err := l.fingerprint()
+			l.mu.RLock()
+			changed := err == nil && stamp != l.stamp
+			l.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := l.Load(); err != nil {
+				log.Println(err)
+				continue
+			}
+			onReload()
+		}
+	}
+}
+
+// List returns the prompts, the built-ins first
+func (l *Library) List() []Prompt {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]Prompt(nil), l.prompts...)
+}
+
+// Find looks up a prompt by its name, ignoring case, or
+// by its number in the list starting at 1
+func (l *Library) Find(name string) (Prompt, bool) {
+	list := l.List()
+	name = strings.TrimSpace(name)
+	for _, prompt := range list {
+		if strings.EqualFold(prompt.Name, name) {
+			return prompt, true
+		}
+	}
+	number, err := strconv.Atoi(name)
+	if err == nil && number >= 1 && number <= len(list) {
+		return list[number-1], true
+	}
+
+	return Prompt{}, false
+}
+
+// ByInstruction finds the prompt that has the system
+// instruction, for example of a resumed session. A template
+// matches when it is filled in without variables
+func (l *Library) ByInstruction(instruction string) (Prompt, bool) {
+	for _, prompt := range l.List() {
+		if prompt.Prompt == instruction || prompt.Instruction(Vars{}) == instruction {
+			return prompt, true
+		}
+	}
+
+	return Prompt{}, false
+}
+
+// Save writes the prompt to its file, a built-in prompt gets a
+// file in the last folder, the one of the repository. The
+// prompts are loaded again, the saved prompt is returned
+func (l *Library) Save(prompt Prompt) (Prompt, error) {
+	if _, err := Parse(prompt.File()); err != nil {
+		return Prompt{}, err
+	}
+	path := prompt.Source
+	if path == "" {
+		if len(l.Dirs) == 0 {
+			return Prompt{}, errors.New("no folder to save the prompt in")
+		}
+		dir := l.Dirs[len(l.Dirs)-1]
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return Prompt{}, err
+		}
+		path = filepath.Join(dir, fileName(prompt.Name))
+	}
+	if err := os.WriteFile(path, []byte(prompt.File()), 0o644); err != nil {
+		return Prompt{}, err
+	}
+	prompt.Source = path
+
+	return prompt, l.Load()
+}
+
+// fileName turns the name of a prompt into a file name
+func fileName(name string) string {
+	var file strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			file.WriteRune(r)
+			dash = false
+		} else if !dash && file.Len() > 0 {
+			file.WriteRune('-')
+			dash = true
+		}
+	}
+
+	return strings.TrimSuffix(file.String(), "-") + extension
+}
+
+// File is the prompt as the contents of a prompt file,
+// the settings that are set are written as front-matter
+func (p Prompt) File() string {
+	var file strings.Builder
+	file.WriteString(frontMatter + "\n")
+	fmt.Fprintf(&file, "name: %s\n", p.Name)
+	settings := []struct{ key, value string }{
+		{"description", p.Description},
+		{"tags", strings.Join(p.Tags, ", ")},
+		{"model", p.Model},
+		{"format", p.Format},
+		{"categories", strings.Join(p.Categories, ", ")},
+	}
+	for _, setting := range settings {
+		if setting.value != "" {
+			fmt.Fprintf(&file, "%s: %s\n", setting.key, setting.value)
+		}
+	}
+	file.WriteString(frontMatter + "\n")
+	file.WriteString(strings.TrimSpace(p.Prompt) + "\n")
+
+	return file.String()
+}
+
+// ReadFile reads a prompt file. The file starts with optional
+// front-matter between "---" lines with "key: value" settings:
+// name, description, tags, model, format and categories. Lists
+// are written as [a, b] or a, b. Without a name the file name
+// is the name of the prompt
+func ReadFile(path string) (Prompt, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	prompt, err := Parse(string(contents))
+	if err != nil {
+		return Prompt{}, fmt.Errorf("prompt %s: %w", path, err)
+	}
+	if prompt.Name == "" {
+		prompt.Name = strings.TrimSuffix(filepath.Base(path), extension)
+	}
+	prompt.Source = path
+
+	return prompt, nil
+}
+
+// Parse reads the front-matter and the text of a prompt
+func Parse(contents string) (Prompt, error) {
+	var prompt Prompt
+	body := contents
+	if rest, found := strings.CutPrefix(contents, frontMatter+"\n"); found {
+		settings, text, found := strings.Cut(rest, "\n"+frontMatter)
+		if !found {
+			return Prompt{}, errors.New("front-matter does not end with " + frontMatter)
+		}
+		err := prompt.set(settings)
+		if err != nil {
+			return Prompt{}, err
+		}
+		// the rest of the closing line is not part of the text
+		_, body, _ = strings.Cut(text, "\n")
+	}
+
+	prompt.Prompt = strings.TrimSpace(body)
+	if prompt.Prompt == "" {
+		return Prompt{}, errors.New("the prompt has no text")
+	}
+	// a broken template is reported when the file is read,
+	// not when the diff is reviewed
+	if _, err := Render(prompt.Prompt, Vars{}); err != nil {
+		return Prompt{}, err
+	}
+	switch prompt.Format {
+	case "", FormatMarkdown, FormatFindings:
+	default:
+		return Prompt{}, fmt.Errorf("unknown format %q, use %s or %s",
+			prompt.Format, FormatMarkdown, FormatFindings)
+	}
+
+	return prompt, nil
+}
+
+// set applies the "key: value" lines of the front-matter
+func (p *Prompt) set(settings string) error {
+	scanner := bufio.NewScanner(strings.NewReader(settings))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return fmt.Errorf("front-matter line %q is not key: value", line)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "name":
+			p.Name = value
+		case "description":
+			p.Description = value
+		case "tags":
+			p.Tags = list(value)
+		case "model":
+			p.Model = value
+		case "format":
+			p.Format = strings.ToLower(value)
+		case "categories":
+			p.Categories = list(value)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// list splits "[a, b]" or "a, b"
+func list(value string) []string {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.Trim(strings.TrimSpace(item), `"'`)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,159 @@
+package prompts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	prompt, err := Parse(`---
+name: Security review
+description: looks for secrets
+tags: [security, "go"]
+model: gemini-2.5-pro
+format: findings
+categories: Injection, Secrets
+---
+You review diffs for security issues.
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Prompt{
+		Name:        "Security review",
+		Prompt:      "You review diffs for security issues.",
+		Categories:  []string{"Injection", "Secrets"},
+		Description: "looks for secrets",
+		Tags:        []string{"security", "go"},
+		Model:       "gemini-2.5-pro",
+		Format:      FormatFindings,
+	}
+	if !reflect.DeepEqual(prompt, want) {
+		t.Errorf("got %+v", prompt)
+	}
+
+	if prompt, err := Parse("Just a prompt\n"); err != nil || prompt.Prompt != "Just a prompt" {
+		t.Errorf("a file without front-matter: %+v %v", prompt, err)
+	}
+	for _, broken := range []string{"---\nname: open\nno end", "---\nformat: pdf\n---\ntext", "---\nname: x\n---\n"} {
+		if _, err := Parse(broken); err == nil {
+			t.Errorf("expected an error for %q", broken)
+		}
+	}
+}
+
+func writePrompt(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMergesFolders(t *testing.T) {
+	userDir := filepath.Join(t.TempDir(), "user")
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	writePrompt(t, userDir, "team.md", "---\nname: Team\n---\nuser version")
+	writePrompt(t, userDir, "broken.md", "---\nname: broken")
+	writePrompt(t, repoDir, "team.md", "---\nname: team\n---\nrepo version")
+	writePrompt(t, repoDir, "override.md", "---\nname: "+PromptList[0].Name+"\n---\nour review")
+	writePrompt(t, repoDir, "short.md", "named after the file")
+	writePrompt(t, repoDir, "notes.txt", "not a prompt")
+
+	library := NewLibrary(userDir, repoDir, filepath.Join(t.TempDir(), "missing"))
+	if err := library.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	list := library.List()
+	if len(list) != len(PromptList)+2 {
+		t.Fatalf("expected the built-ins and 2 files, got %d prompts", len(list))
+	}
+	if list[0].Prompt != "our review" || list[0].Source == "" {
+		t.Errorf("built-in not replaced by the repository: %+v", list[0])
+	}
+	if team, ok := library.Find("TEAM"); !ok || team.Prompt != "repo version" {
+		t.Errorf("the repository should override the user: %+v", team)
+	}
+	if _, ok := library.Find("short"); !ok {
+		t.Error("a prompt without name is named after the file")
+	}
+	if PromptList[0].Prompt == "our review" {
+		t.Error("the built-ins are changed")
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	dir := t.TempDir()
+	writePrompt(t, dir, "team.md", "first")
+	library := NewLibrary(dir)
+	if err := library.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan bool, 1)
+	go library.Watch(ctx, 10*time.Millisecond, func() { reloaded <- true })
+
+	writePrompt(t, dir, "team.md", "second version")
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not noticed")
+	}
+	if team, _ := library.Find("team"); team.Prompt != "second version" {
+		t.Errorf("prompt not reloaded: %q", team.Prompt)
+	}
+}
+
+func TestParseChecksTemplate(t *testing.T) {
+	if _, err := Parse("Review {{.Branch"); err == nil {
+		t.Error("expected an error for a broken template")
+	}
+	if _, err := Parse("Review the branch {{.Branch}}"); err != nil {
+		t.Error(err)
+	}
+	if _, err := Parse("Check the {{ variable }} of the jinja templates"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	userDir := filepath.Join(t.TempDir(), "user")
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	library := NewLibrary(userDir, repoDir)
+
+	edited := PromptList[0]
+	edited.Prompt = "Only look for typos."
+	saved, err := library.Save(edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Source != filepath.Join(repoDir, "gitreview-prompt.md") {
+		t.Errorf("built-in saved to %q", saved.Source)
+	}
+	if prompt, _ := library.Find(edited.Name); prompt.Prompt != "Only look for typos." ||
+		!reflect.DeepEqual(prompt.Categories, edited.Categories) {
+		t.Errorf("saved prompt not loaded: %+v", prompt)
+	}
+
+	saved.Prompt = "Look for typos and grammar."
+	if _, err := library.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	if list := library.List(); len(list) != len(PromptList) || list[0].Prompt != saved.Prompt {
+		t.Errorf("the file was not written in place: %d prompts", len(list))
+	}
+
+	saved.Prompt = " "
+	if _, err := library.Save(saved); err == nil {
+		t.Error("expected an error for an empty prompt")
+	}
+}
@@ -3,15 +3,34 @@ package prompts
 type Prompt struct {
 	Name   string
 	Prompt string
+	// Categories are the review tasks of the prompt, used
+	// as category of the findings of a structured review
+	Categories  []string
+	Description string
+	Tags        []string
+	// Model is the recommended model for the prompt
+	Model string
+	// Format is the output of a review, FormatFindings
+	// asks for a structured review. Empty is markdown
+	Format string
+	// Source is the file of the prompt, empty for the
+	// built-in prompts
+	Source string
 }
 
+// PromptList holds the built-in prompts
 var PromptList = []Prompt{
 	{Name: "gitreview prompt",
+		Categories: []string{"Description", "Obvious errors", "Improvements", "Friendly advice"},
 		Prompt: `You are an expert developer and git super user. You do code reviews based on the git diff output between two commits.
 
 	* The diff contains a few unchanged lines of code. Focus on the code that changed. Changed are added and removed lines.
 
 	* The added lines start with a "+" and the removed lines that start with a "-"
+
+	Context of the change:
+{{template "context" .}}
+
 	Complete the following tasks, and be extremely critical and precise in your review:
 
 	* [Description] Describe the code change.
@@ -27,6 +46,9 @@ var PromptList = []Prompt{
 	{
 
 		Name: "gitreview prompt - only top 2",
+		Categories: []string{"Correctness and Error Handling", "Code Quality and Readability",
+			"Object-Oriented Principles", "Clean Code Practices", "Performance and Security",
+			"Testability and Test Implications"},
 		Prompt: `Please perform a thorough code review of the following git diff. Your review should address the following top 6 tasks:
 **Task 1:  Correctness and Error Handling**
 
@@ -71,13 +93,12 @@ Before answering take the top 2 suggestions as response. Do not respond more tha
 	},
 	{
 		Name: "gitreview actionable prompt - Address top 2 tasks in each category",
+		Categories: []string{"Correctness & Logic", "Readability & Style", "OO Principles & Design",
+			"Clean Code", "Performance & Security", "Testing"},
 		Prompt: `Please perform a focused code review of the following git diff, providing specific examples  Address the top 2 tasks in each category:
 
 **Context:**
-
-* Brief description of the purpose and context of these changes:
-* Relevant background information or related issues:
-* Any specific areas you would like the reviewer to pay particular attention to:
+{{template "context" .}}
 
 **Review Tasks:**
 
@@ -116,12 +137,12 @@ Provide your review organized by category, with detailed code examples, to illus
 	},
 	{
 		Name: "concise prompt - code optimization focused - before and after changes",
+		Categories: []string{"Performance Optimization", "Code Duplication & Maintainability",
+			"Optimization-Enabling Refactoring", "Testability Impact"},
 		Prompt: `Please provide a code optimization-focused review of the following git diff. Provide "before" and "after" code snippets to illustrate each suggestion.
 
 **Context:**
-
-* Brief description of the purpose and context of these changes:
-* Relevant background information:
+{{template "context" .}}
 
 **Optimization Targets (Focus your review on these):**
 
@@ -152,12 +173,12 @@ Provide detailed explanations for each optimization suggestion, with "before" an
 	},
 	{
 		Name: "diff refactoring focus - DRY, SOLID",
+		Categories: []string{"Function Size", "OO Opportunities", "Function Naming",
+			"Code Organization"},
 		Prompt: `Please provide a refactoring-focused review of the following git diff, with detailed "before" and "after" code examples *within the scope of the diff*.
 
 **Context:**
-
-* Brief description of the purpose and context of these changes:
-* Relevant background information:
+{{template "context" .}}
 
 **Important:** Remember that you are reviewing a *diff*. "Before" code should represent the original code *as shown in the diff* (the "-" lines), and "after" code should represent the changed code *as shown in the diff* (the "+" lines), incorporating refactoring suggestions.
 
@@ -198,3 +219,20 @@ Show suggested code as code, not as diff.
 `,
 	},
 }
+
+// List returns the prompts of the Default library
+func List() []Prompt {
+	return Default.List()
+}
+
+// Find looks up a prompt of the Default library by its name,
+// ignoring case, or by its number in the list starting at 1
+func Find(name string) (Prompt, bool) {
+	return Default.Find(name)
+}
+
+// ByInstruction finds the prompt of the Default library that
+// has the system instruction, for example of a resumed session
+func ByInstruction(instruction string) (Prompt, bool) {
+	return Default.ByInstruction(instruction)
+}
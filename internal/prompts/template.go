@@ -0,0 +1,257 @@
+package prompts
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/MelleKoning/aifun/internal/diffparse"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+)
+
+// maxFiles is the number of changed files a prompt lists,
+// a large diff would make the instruction too long
+const maxFiles = 50
+
+// contextTemplate is the "context" template every prompt can
+// use with {{template "context" .}}, it lists what is known
+// of the change. Every item starts on a new line
+const contextTemplate = `{{define "context" -}}
+{{- with .Range}}
+* Reviewed: {{.}}
+{{- end}}
+{{- with .Description}}
+* Purpose and context of these changes: {{.}}
+{{- end}}
+{{- with .Ticket}}
+* Related issue: {{.}}
+{{- end}}
+{{- with .Branch}}
+* Branch: {{.}}
+{{- end}}
+{{- with .Commits}}
+* Commits:
+{{- range .}}
+  * {{.}}
+{{- end}}
+{{- end}}
+{{- with .Files}}
+* Changed files: {{join . ", "}}
+{{- end}}
+{{- with .Languages}}
+* Languages: {{.}}
+{{- end}}
+{{- end}}`
+
+// ticketPattern finds a ticket like ABC-123 or #123
+// in the branch name or the commit messages
+var ticketPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-[0-9]+\b|#[0-9]+\b`)
+
+// actionPattern finds the start of a template action on a
+// variable, or with a keyword or function of the templates
+var actionPattern = regexp.MustCompile(
+	`\{\{-?\s*(\.|"|/\*|(template|define|block|if|else|end|with|range|join|not|and|or|len|index|eq|ne|print|printf)\b)`)
+
+// languages names the language of a file extension
+var languages = map[string]string{
+	".go": "Go", ".py": "Python", ".js": "JavaScript", ".ts": "TypeScript",
+	".tsx": "TypeScript", ".jsx": "JavaScript", ".java": "Java", ".kt": "Kotlin",
+	".cs": "C#", ".c": "C", ".h": "C", ".cpp": "C++", ".rs": "Rust", ".rb": "Ruby",
+	".php": "PHP", ".swift": "Swift", ".scala": "Scala", ".sh": "Shell",
+	".sql": "SQL", ".md": "Markdown", ".yaml": "YAML", ".yml": "YAML",
+	".json": "JSON", ".proto": "Protobuf", ".html": "HTML", ".css": "CSS",
+}
+
+// Vars are the variables of a prompt template, like
+// {{.Branch}} or {{range .Commits}}
+type Vars struct {
+	// Range describes what is diffed
+	Range  string
+	Branch string
+	// Commits are the short hashes and subjects of the
+	// reviewed commits, newest first
+	Commits []string
+	Files   []string
+	// Languages is the language mix weighted by the
+	// changed lines, like "Go 80%, Markdown 20%"
+	Languages   string
+	Description string
+	Ticket      string
+}
+
+// Details is what the diff can not tell: the description of
+// the change, like the body of the pull request, and its ticket
+type Details struct {
+	Description string
+	Ticket      string
+}
+
+// DefaultDetails reads AIFUN_DESCRIPTION and AIFUN_TICKET, in
+// a pipeline the description of the merge or pull request is
+// used when AIFUN_DESCRIPTION is not set
+func DefaultDetails() Details {
+	details := Details{
+		Description: os.Getenv("AIFUN_DESCRIPTION"),
+		Ticket:      os.Getenv("AIFUN_TICKET"),
+	}
+	if details.Description == "" {
+		details.Description = os.Getenv("CI_MERGE_REQUEST_DESCRIPTION")
+	}
+	if details.Description == "" {
+		details.Description = pullRequestBody(os.Getenv("GITHUB_EVENT_PATH"))
+	}
+
+	return details
+}
+
+// pullRequestBody reads the description from the event
+// of a GitHub workflow, empty when it is no pull request
+func pullRequestBody(eventPath string) string {
+	if eventPath == "" {
+		return ""
+	}
+	contents, err := os.ReadFile(eventPath)
+	if err != nil {
+		return ""
+	}
+	var event struct {
+		PullRequest struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		} `json:"pull_request"`
+	}
+	if json.Unmarshal(contents, &event) != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.Join([]string{event.PullRequest.Title, event.PullRequest.Body}, "\n\n"))
+}
+
+// RegisterFlags adds --description and --ticket
+func (d *Details) RegisterFlags(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&d.Description, "description", d.Description,
+		"purpose of the change, for the context of the prompt (default $AIFUN_DESCRIPTION)")
+	flagSet.StringVar(&d.Ticket, "ticket", d.Ticket,
+		"ticket of the change, found in the branch or commits when empty")
+}
+
+// Collect gathers the variables of the diff. What git can not
+// tell, for example outside a repository, is left empty
+func Collect(ctx context.Context, options gitdiff.Options, details Details, diff string) Vars {
+	vars := Vars{
+		Range:       options.Describe(),
+		Description: details.Description,
+		Ticket:      details.Ticket,
+	}
+	if options.DiffFile == "" {
+		vars.Branch, _ = gitdiff.Branch(ctx)
+		if vars.Branch == "HEAD" {
+			// a detached head has no branch name
+			vars.Branch = ""
+		}
+		vars.Commits, _ = options.Commits(ctx)
+	}
+	if files, err := diffparse.Parse(diff); err == nil {
+		vars.Files, vars.Languages = changedFiles(files)
+	}
+	if vars.Ticket == "" {
+		vars.Ticket = ticketPattern.FindString(strings.Join(append([]string{vars.Branch}, vars.Commits...), "\n"))
+	}
+
+	return vars
+}
+
+// changedFiles lists the names of the files and the
+// share of the languages in the changed lines
+func changedFiles(files []*diffparse.File) ([]string, string) {
+	var names []string
+	changes := map[string]int{}
+	total := 0
+	for _, file := range files {
+		if len(names) < maxFiles {
+			names = append(names, file.Name())
+		}
+		language, ok := languages[strings.ToLower(filepath.Ext(file.Name()))]
+		if !ok {
+			continue
+		}
+		added, removed := file.Stats()
+		changes[language] += added + removed
+		total += added + removed
+	}
+	if len(files) > maxFiles {
+		names = append(names, fmt.Sprintf("and %d more", len(files)-maxFiles))
+	}
+	if total == 0 {
+		return names, ""
+	}
+
+	mix := make([]string, 0, len(changes))
+	for language := range changes {
+		mix = append(mix, language)
+	}
+	sort.Slice(mix, func(i, j int) bool {
+		if changes[mix[i]] != changes[mix[j]] {
+			return changes[mix[i]] > changes[mix[j]]
+		}
+		return mix[i] < mix[j]
+	})
+	for i, language := range mix {
+		mix[i] = fmt.Sprintf("%s %d%%", language, (changes[language]*100+total/2)/total)
+	}
+
+	return names, strings.Join(mix, ", ")
+}
+
+// IsTemplate is true when the text uses template actions. Other
+// text between {{ and }}, like {{ name }} of another template
+// language, is no action and the text is used as is
+func IsTemplate(text string) bool {
+	return actionPattern.MatchString(text)
+}
+
+// Render fills in the variables of a prompt template. Text
+// without template actions is returned as is
+func Render(text string, vars Vars) (string, error) {
+	if !IsTemplate(text) {
+		return text, nil
+	}
+	tmpl, err := template.New("prompt").
+		Funcs(template.FuncMap{"join": strings.Join}).
+		Option("missingkey=error").
+		Parse(contextTemplate)
+	if err == nil {
+		_, err = tmpl.Parse(text)
+	}
+	if err != nil {
+		return "", fmt.Errorf("prompt template: %w", err)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, vars); err != nil {
+		return "", fmt.Errorf("prompt template: %w", err)
+	}
+
+	return rendered.String(), nil
+}
+
+// Instruction is the prompt with the variables filled in. The
+// files are checked on load, a template that still fails is
+// logged and given as is
+func (p Prompt) Instruction(vars Vars) string {
+	instruction, err := Render(p.Prompt, vars)
+	if err != nil {
+		log.Printf("%s: %v", p.Name, err)
+		return p.Prompt
+	}
+
+	return instruction
+}
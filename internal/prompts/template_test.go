@@ -0,0 +1,116 @@
+package prompts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+)
+
+const templateDiff = `diff --git a/main.go b/main.go
+--- a/main.go
++++ b/main.go
+@@ -1 +1,4 @@
+ package main
++
++func main() {}
++// done
+diff --git a/README.md b/README.md
+--- a/README.md
++++ b/README.md
+@@ -1 +1 @@
+-# old
++# new
+`
+
+func TestRender(t *testing.T) {
+	vars := Vars{
+		Range:       "main..HEAD",
+		Branch:      "feature/ABC-12",
+		Commits:     []string{"abc123 second", "def456 first"},
+		Files:       []string{"main.go", "README.md"},
+		Languages:   "Go 60%, Markdown 40%",
+		Description: "adds a main",
+	}
+	got, err := Render("**Context:**\n{{template \"context\" .}}\n\nBranch {{.Branch}}", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `**Context:**
+
+* Reviewed: main..HEAD
+* Purpose and context of these changes: adds a main
+* Branch: feature/ABC-12
+* Commits:
+  * abc123 second
+  * def456 first
+* Changed files: main.go, README.md
+* Languages: Go 60%, Markdown 40%
+
+Branch feature/ABC-12`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if got, err := Render("no {template} here", vars); err != nil || got != "no {template} here" {
+		t.Errorf("text without actions changed: %q %v", got, err)
+	}
+	if got, err := Render("fill in {{ user.name }}", vars); err != nil || got != "fill in {{ user.name }}" {
+		t.Errorf("text of another template language changed: %q %v", got, err)
+	}
+	if got, err := Render(`{{"{{"}}.Branch}} is {{.Branch}}`, vars); err != nil || got != "{{.Branch}} is feature/ABC-12" {
+		t.Errorf("escaped braces not kept: %q %v", got, err)
+	}
+	if _, err := Render("{{.Unknown}}", vars); err == nil {
+		t.Error("expected an error for an unknown variable")
+	}
+	for _, prompt := range PromptList {
+		if _, err := Render(prompt.Prompt, Vars{}); err != nil {
+			t.Errorf("%s: %v", prompt.Name, err)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	diffFile := filepath.Join(t.TempDir(), "gitdiff.txt")
+	if err := os.WriteFile(diffFile, []byte(templateDiff), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	options := gitdiff.Options{DiffFile: diffFile}
+
+	vars := Collect(context.Background(), options, Details{Description: "adds a main"}, templateDiff)
+	if vars.Range != options.Describe() || vars.Description != "adds a main" || vars.Branch != "" {
+		t.Errorf("unexpected vars %+v", vars)
+	}
+	if strings.Join(vars.Files, ",") != "main.go,README.md" || vars.Languages != "Go 60%, Markdown 40%" {
+		t.Errorf("unexpected files %q and languages %q", vars.Files, vars.Languages)
+	}
+
+	vars = Collect(context.Background(), options, Details{Ticket: "OPS-1"}, templateDiff)
+	if vars.Ticket != "OPS-1" {
+		t.Errorf("the given ticket is not used: %q", vars.Ticket)
+	}
+	if ticket := ticketPattern.FindString("fix login, closes #42"); ticket != "#42" {
+		t.Errorf("unexpected ticket %q", ticket)
+	}
+}
+
+func TestDefaultDetails(t *testing.T) {
+	event := filepath.Join(t.TempDir(), "event.json")
+	contents := `{"pull_request": {"title": "Add main", "body": "So it runs"}}`
+	if err := os.WriteFile(event, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AIFUN_DESCRIPTION", "")
+	t.Setenv("CI_MERGE_REQUEST_DESCRIPTION", "")
+	t.Setenv("GITHUB_EVENT_PATH", event)
+	t.Setenv("AIFUN_TICKET", "ABC-1")
+
+	details := DefaultDetails()
+	if details.Description != "Add main\n\nSo it runs" || details.Ticket != "ABC-1" {
+		t.Errorf("unexpected details %+v", details)
+	}
+}
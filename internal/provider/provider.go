@@ -0,0 +1,229 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+// Provider knows how to check the settings of a
+// backend and how to create the model for it
+type Provider struct {
+	Description string
+	// DefaultModel is used when no model is configured
+	DefaultModel string
+	// Validate checks the provider specific settings
+	// before any model is created. It may fill in
+	// defaults, for example from environment variables
+	Validate func(cfg *config.Config) error
+	New      func(ctx context.Context, cfg config.Config,
+		systemInstruction string) (genaimodel.Action, error)
+}
+
+var registry = map[string]Provider{
+	"gemini": {
+		Description:  "Google Gemini API, needs GEMINI_API_KEY",
+		DefaultModel: genaimodel.GeminiDefaultModel,
+		Validate:     validateGemini,
+		New: func(ctx context.Context, cfg config.Config, systemInstruction string) (genaimodel.Action, error) {
+			return genaimodel.NewGeminiModel(ctx, cfg.APIKey, cfg.Model, systemInstruction)
+		},
+	},
+	"ollama": {
+		Description:  "local ollama server, see docker-compose.yaml",
+		DefaultModel: genaimodel.OllamaDefaultModel,
+		Validate:     validateOllama,
+		New: func(ctx context.Context, cfg config.Config, systemInstruction string) (genaimodel.Action, error) {
+			return genaimodel.NewOllamaModel(cfg.BaseURL, cfg.Model, systemInstruction)
+		},
+	},
+	"openai": {
+		Description: "OpenAI compatible chat completions, like vLLM, LM Studio or LiteLLM",
+		Validate:    validateOpenAI,
+		New: func(ctx context.Context, cfg config.Config, systemInstruction string) (genaimodel.Action, error) {
+			return genaimodel.NewOpenAIModel(cfg.BaseURL, cfg.Model, cfg.APIKey, systemInstruction)
+		},
+	},
+	"fake": {
+		Description:  "offline fake, replays --cassette or echoes the prompt",
+		DefaultModel: "fake",
+		Validate:     validateFake,
+		New: func(ctx context.Context, cfg config.Config, systemInstruction string) (genaimodel.Action, error) {
+			if cfg.Cassette == "" {
+				fake := fakemodel.New()
+				fake.UpdateSystemInstruction(systemInstruction)
+				return fake, nil
+			}
+			return fakemodel.NewReplayer(cfg.Cassette, 1)
+		},
+	},
+}
+
+// Names returns the sorted names of all known providers
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Usage returns a line per provider to show in help texts
+func Usage() string {
+	var usage strings.Builder
+	for _, name := range Names() {
+		fmt.Fprintf(&usage, "  %-8s %s\n", name, registry[name].Description)
+	}
+
+	return usage.String()
+}
+
+// ModelName is the configured model, or the model the
+// provider uses when none is configured
+func ModelName(cfg config.Config) string {
+	if cfg.Model != "" {
+		return cfg.Model
+	}
+
+	return registry[cfg.Provider].DefaultModel
+}
+
+// New validates the config and creates the model of the
+// configured provider with the generation parameters
+// and the context window
+func New(ctx context.Context, cfg config.Config,
+	systemInstruction string) (genaimodel.Action, error) {
+	p, ok := registry[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, choose one of: %s",
+			cfg.Provider, strings.Join(Names(), ", "))
+	}
+
+	if err := p.Validate(&cfg); err != nil {
+		return nil, fmt.Errorf("provider %s: %w", cfg.Provider, err)
+	}
+
+	action, err := p.New(ctx, cfg, systemInstruction)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %w", cfg.Provider, err)
+	}
+	action.SetParams(cfg.Params)
+	action.SetContextWindow(cfg.ContextWindow)
+	action.SetRetryPolicy(cfg.Retry)
+
+	if cfg.Record != "" {
+		action = fakemodel.NewRecorder(action, cfg.Record)
+	}
+
+	return action, nil
+}
+
+func validateGemini(cfg *config.Config) error {
+	if cfg.APIKey == "" {
+		cfg.APIKey = os.Getenv("GEMINI_API_KEY")
+	}
+	if cfg.APIKey == "" {
+		return errors.New("no api key, set GEMINI_API_KEY or apiKey in the config")
+	}
+	if cfg.BaseURL != "" {
+		return errors.New("a base url is not supported for gemini")
+	}
+
+	return nil
+}
+
+func validateOllama(cfg *config.Config) error {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = ollamaHostFromEnv()
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = genaimodel.OllamaDefaultURL
+	}
+
+	return validateURL(cfg.BaseURL)
+}
+
+// ollamaHostFromEnv reads OLLAMA_HOST the way the ollama
+// cli does, it is often given without scheme or port
+func ollamaHostFromEnv() string {
+	host := os.Getenv("OLLAMA_HOST")
+	if host == "" {
+		return ""
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	u, err := url.Parse(host)
+	if err == nil && u.Port() == "" {
+		u.Host += ":11434"
+		host = u.String()
+	}
+
+	return host
+}
+
+func validateOpenAI(cfg *config.Config) error {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = os.Getenv("OPENAI_BASE_URL")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = genaimodel.OpenAIDefaultURL
+	}
+	if cfg.APIKey == "" {
+		cfg.APIKey = os.Getenv("OPENAI_API_KEY")
+	}
+	// local gateways often run without a key, the
+	// public api does not
+	if cfg.APIKey == "" && cfg.BaseURL == genaimodel.OpenAIDefaultURL {
+		return errors.New("no api key, set OPENAI_API_KEY or apiKey in the config")
+	}
+	if cfg.Model == "" {
+		return errors.New("no model, set --model or model in the config")
+	}
+
+	return validateURL(cfg.BaseURL)
+}
+
+func validateFake(cfg *config.Config) error {
+	if cfg.Cassette == "" {
+		return nil
+	}
+	_, err := os.Stat(cfg.Cassette)
+
+	return err
+}
+
+func validateURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid base url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("base url %q must start with http:// or https://", baseURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("base url %q has no host", baseURL)
+	}
+
+	return nil
+}
+
+// Switcher creates models of the configured provider by name,
+// to continue a chat with another model
+func Switcher(cfg config.Config) func(ctx context.Context, model,
+	systemInstruction string) (genaimodel.Action, error) {
+	return func(ctx context.Context, model, systemInstruction string) (genaimodel.Action, error) {
+		cfg.Model = model
+		return New(ctx, cfg, systemInstruction)
+	}
+}
@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+func TestUnknownProvider(t *testing.T) {
+	_, err := New(context.Background(), config.Config{Provider: "nope"}, "")
+	if err == nil || !strings.Contains(err.Error(), "gemini") {
+		t.Errorf("expected error listing the providers, got %v", err)
+	}
+}
+
+func TestGeminiNeedsKey(t *testing.T) {
+	t.Setenv("GEMINI_API_KEY", "")
+
+	_, err := New(context.Background(), config.Config{Provider: "gemini"}, "")
+	if err == nil || !strings.Contains(err.Error(), "GEMINI_API_KEY") {
+		t.Errorf("expected missing api key error, got %v", err)
+	}
+}
+
+func TestOllamaHost(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "0.0.0.0")
+
+	cfg := config.Config{Provider: "ollama"}
+	if err := validateOllama(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BaseURL != "http://0.0.0.0:11434" {
+		t.Errorf("unexpected base url %s", cfg.BaseURL)
+	}
+
+	cfg = config.Config{Provider: "ollama", BaseURL: "localhost:11434"}
+	if err := validateOllama(&cfg); err == nil {
+		t.Error("expected error for base url without scheme")
+	}
+}
+
+func TestOpenAINeedsModel(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("OPENAI_BASE_URL", "")
+
+	cfg := config.Config{Provider: "openai", BaseURL: "http://localhost:8000/v1"}
+	err := validateOpenAI(&cfg)
+	if err == nil || !strings.Contains(err.Error(), "model") {
+		t.Errorf("expected missing model error, got %v", err)
+	}
+
+	cfg = config.Config{Provider: "openai", Model: "gpt-4o-mini"}
+	err = validateOpenAI(&cfg)
+	if err == nil || !strings.Contains(err.Error(), "OPENAI_API_KEY") {
+		t.Errorf("expected missing api key error, got %v", err)
+	}
+}
+
+func TestNewSetsParams(t *testing.T) {
+	cfg := config.Config{Provider: "fake"}
+	if err := cfg.Params.Set(genaimodel.ParamTemperature, "0"); err != nil {
+		t.Fatal(err)
+	}
+	action, err := New(context.Background(), cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.GetParams().String() != "temperature=0" {
+		t.Errorf("parameters not given to the model: %s", action.GetParams())
+	}
+}
@@ -0,0 +1,269 @@
+package review
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/diffparse"
+)
+
+// Severity of a finding, from critical down to info
+type Severity string
+
+const (
+	Critical Severity = "critical"
+	High     Severity = "high"
+	Medium   Severity = "medium"
+	Low      Severity = "low"
+	Info     Severity = "info"
+)
+
+// Severities lists all severities, most severe first
+var Severities = []Severity{Critical, High, Medium, Low, Info}
+
+// Rank is 0 for critical and grows for less severe findings,
+// unknown severities rank below info
+func (s Severity) Rank() int {
+	for rank, severity := range Severities {
+		if s == severity {
+			return rank
+		}
+	}
+
+	return len(Severities)
+}
+
+// ParseSeverity checks the name of a severity
+func ParseSeverity(name string) (Severity, error) {
+	severity := Severity(strings.ToLower(strings.TrimSpace(name)))
+	if severity.Rank() == len(Severities) {
+		return "", fmt.Errorf("unknown severity %q, choose one of %v", name, Severities)
+	}
+
+	return severity, nil
+}
+
+// CountAtLeast counts the findings with the severity or worse
+func CountAtLeast(findings []Finding, severity Severity) int {
+	count := 0
+	for _, finding := range findings {
+		if finding.Severity.Rank() <= severity.Rank() {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Finding is a single issue of a structured review. The lines
+// are line numbers in the new version of the file
+type Finding struct {
+	File       string   `json:"file"`
+	StartLine  int      `json:"startLine"`
+	EndLine    int      `json:"endLine"`
+	Severity   Severity `json:"severity"`
+	Category   string   `json:"category"`
+	Message    string   `json:"message"`
+	Suggestion string   `json:"suggestion,omitempty"`
+}
+
+// Report is the json answer the model is asked for
+type Report struct {
+	Findings []Finding `json:"findings"`
+}
+
+// RunFindings reviews the diff in batches like Run, but asks
+// the model for findings in json. The findings of all batches
+// are merged, deduplicated and ranked, no consolidation
+// pass is needed. The raw json is streamed to onChunk
+func RunFindings(ctx context.Context, diff string, options Options, generate Generator,
+	onChunk func(string)) ([]Finding, error) {
+	batches := batchDiff(diff, options.batchTokens())
+
+	var lists [][]Finding
+	for i, batch := range batches {
+		if len(batches) > 1 {
+			onChunk(fmt.Sprintf("_Reviewing part %d of %d..._\n\n", i+1, len(batches)))
+		}
+
+		answer, err := generate(ctx, Request{
+			Diff:        annotate(batch),
+			Instruction: FindingsInstruction(options.Categories),
+			JSON:        true,
+			Categories:  options.Categories,
+		}, onChunk)
+		if err != nil {
+			return nil, err
+		}
+
+		findings, err := ParseFindings(answer)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, findings)
+	}
+
+	return Merge(lists...), nil
+}
+
+// FindingsInstruction describes the json format, for backends
+// that only have a json mode without a schema
+func FindingsInstruction(categories []string) string {
+	categoryText := "a short name for the kind of issue"
+	if len(categories) > 0 {
+		categoryText = `one of: "` + strings.Join(categories, `", "`) + `"`
+	}
+
+	return `* Every line of the diff starts with its line number in the new file, followed by "|".
+* Answer only with json, without markdown, in this format:
+  {"findings":[{"file":"path/to/file.go","startLine":12,"endLine":14,"severity":"high","category":"...","message":"...","suggestion":"..."}]}
+* "file" is the path of the file after the change, "startLine" and "endLine" are line numbers in the new file.
+* "severity" is one of: critical, high, medium, low, info.
+* "category" is ` + categoryText + `.
+* "message" explains the issue and how to fix it.
+* "suggestion" is optional replacement code for the lines, as code and not as diff.
+* Answer with {"findings":[]} when there is nothing to report.`
+}
+
+// ParseFindings reads the json answer of the model, also when
+// it is wrapped in a markdown code block
+func ParseFindings(answer string) ([]Finding, error) {
+	answer = strings.TrimSpace(answer)
+	if start := strings.Index(answer, "{"); start > 0 {
+		answer = answer[start:]
+	}
+	if end := strings.LastIndex(answer, "}"); end >= 0 {
+		answer = answer[:end+1]
+	}
+
+	var report Report
+	err := json.Unmarshal([]byte(answer), &report)
+	if err != nil {
+		return nil, fmt.Errorf("the model did not answer with valid findings: %w", err)
+	}
+
+	for i := range report.Findings {
+		finding := &report.Findings[i]
+		severity, err := ParseSeverity(string(finding.Severity))
+		if err != nil {
+			severity = Info
+		}
+		finding.Severity = severity
+		if finding.EndLine < finding.StartLine {
+			finding.EndLine = finding.StartLine
+		}
+	}
+
+	return report.Findings, nil
+}
+
+// Merge combines the findings of batches. Findings for the
+// same file, line and category with the same message are
+// kept once, the result is sorted by severity, file and line
+func Merge(lists ...[]Finding) []Finding {
+	seen := map[string]bool{}
+	merged := []Finding{}
+	for _, findings := range lists {
+		for _, finding := range findings {
+			key := fmt.Sprintf("%s:%d:%s:%s", finding.File, finding.StartLine,
+				strings.ToLower(finding.Category), strings.ToLower(strings.TrimSpace(finding.Message)))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, finding)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		if a.Severity.Rank() != b.Severity.Rank() {
+			return a.Severity.Rank() < b.Severity.Rank()
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.StartLine < b.StartLine
+	})
+
+	return merged
+}
+
+// RenderMarkdown renders the findings as the markdown report
+func RenderMarkdown(findings []Finding) string {
+	var build strings.Builder
+	build.WriteString("# Code review\n\n")
+
+	if len(findings) == 0 {
+		build.WriteString("No findings.\n")
+		return build.String()
+	}
+
+	counts := map[Severity]int{}
+	for _, finding := range findings {
+		counts[finding.Severity]++
+	}
+	var summary []string
+	for _, severity := range Severities {
+		if counts[severity] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[severity], severity))
+		}
+	}
+	fmt.Fprintf(&build, "%d findings: %s\n", len(findings), strings.Join(summary, ", "))
+
+	for i, finding := range findings {
+		fmt.Fprintf(&build, "\n## %d. [%s] %s - `%s`\n\n%s\n", i+1,
+			strings.ToUpper(string(finding.Severity)), finding.Category,
+			finding.Location(), finding.Message)
+		if finding.Suggestion != "" {
+			fmt.Fprintf(&build, "\nSuggested replacement:\n\n~~~\n%s\n~~~\n",
+				strings.TrimRight(finding.Suggestion, "\n"))
+		}
+	}
+
+	return build.String()
+}
+
+// Location is file:line or file:start-end
+func (f Finding) Location() string {
+	if f.StartLine == 0 {
+		return f.File
+	}
+	if f.EndLine > f.StartLine {
+		return fmt.Sprintf("%s:%d-%d", f.File, f.StartLine, f.EndLine)
+	}
+
+	return fmt.Sprintf("%s:%d", f.File, f.StartLine)
+}
+
+// annotate puts the new line number in front of every line of
+// the hunks, so the model does not have to count lines itself
+func annotate(diff string) string {
+	files, err := diffparse.Parse(diff)
+	if err != nil {
+		return diff
+	}
+
+	var build strings.Builder
+	for _, file := range files {
+		for _, header := range file.Header {
+			build.WriteString(header + "\n")
+		}
+		for _, hunk := range file.Hunks {
+			hunkLines := strings.Split(strings.TrimSuffix(hunk.String(), "\n"), "\n")
+			build.WriteString(hunkLines[0] + "\n")
+			for i, line := range hunk.Lines {
+				number := ""
+				if line.NewNumber > 0 {
+					number = fmt.Sprint(line.NewNumber)
+				}
+				fmt.Fprintf(&build, "%5s|%s\n", number, hunkLines[i+1])
+			}
+		}
+	}
+
+	return build.String()
+}
@@ -0,0 +1,94 @@
+package review
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseFindings(t *testing.T) {
+	answer := "Here you go:\n```json\n" +
+		`{"findings":[{"file":"main.go","startLine":12,"severity":"HIGH","category":"bug","message":"nil map"},` +
+		`{"file":"main.go","startLine":3,"endLine":4,"severity":"urgent","category":"style","message":"naming"}]}` +
+		"\n```"
+
+	findings, err := ParseFindings(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %d", len(findings))
+	}
+	if findings[0].Severity != High || findings[0].EndLine != 12 {
+		t.Errorf("severity or end line not normalised: %+v", findings[0])
+	}
+	if findings[1].Severity != Info {
+		t.Errorf("unknown severity should become info: %+v", findings[1])
+	}
+
+	_, err = ParseFindings("I found no issues")
+	if err == nil {
+		t.Error("expected an error for an answer without json")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	first := []Finding{
+		{File: "b.go", StartLine: 5, Severity: Low, Category: "style", Message: "naming"},
+		{File: "a.go", StartLine: 9, Severity: High, Category: "bug", Message: "nil map"},
+	}
+	second := []Finding{
+		{File: "a.go", StartLine: 9, Severity: High, Category: "Bug", Message: "Nil map "},
+		{File: "a.go", StartLine: 2, Severity: High, Category: "bug", Message: "overflow"},
+		{File: "c.go", StartLine: 1, Severity: Critical, Category: "security", Message: "sql injection"},
+	}
+
+	merged := Merge(first, second)
+	var locations []string
+	for _, finding := range merged {
+		locations = append(locations, finding.Location())
+	}
+	if got := strings.Join(locations, " "); got != "c.go:1 a.go:2 a.go:9 b.go:5" {
+		t.Errorf("unexpected order or duplicates: %s", got)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	markdown := RenderMarkdown([]Finding{
+		{File: "a.go", StartLine: 2, EndLine: 4, Severity: High, Category: "bug",
+			Message: "overflow", Suggestion: "x := int64(y)\n"},
+	})
+	for _, expected := range []string{"1 findings: 1 high", "[HIGH] bug - `a.go:2-4`", "~~~\nx := int64(y)\n~~~"} {
+		if !strings.Contains(markdown, expected) {
+			t.Errorf("missing %q in:\n%s", expected, markdown)
+		}
+	}
+	if !strings.Contains(RenderMarkdown(nil), "No findings.") {
+		t.Error("expected a report without findings")
+	}
+}
+
+func TestRunFindings(t *testing.T) {
+	var requests []Request
+	generate := func(ctx context.Context, request Request, onChunk func(string)) (string, error) {
+		requests = append(requests, request)
+		return `{"findings":[{"file":"file0.go","startLine":2,"severity":"medium","category":"bug","message":"m"}]}`, nil
+	}
+
+	findings, err := RunFindings(context.Background(), makeDiff(1, 3), Options{Categories: []string{"bug"}}, generate, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !requests[0].JSON || requests[0].Categories[0] != "bug" {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	if !strings.Contains(requests[0].Diff, "    2|+var line1 = 1") {
+		t.Errorf("diff lines are not numbered:\n%s", requests[0].Diff)
+	}
+	if !strings.Contains(requests[0].Instruction, `"bug"`) {
+		t.Errorf("categories missing in the instruction: %s", requests[0].Instruction)
+	}
+	if len(findings) != 1 || findings[0].Severity != Medium {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
@@ -0,0 +1,153 @@
+// Package review splits large diffs into batches that fit the
+// context of the model, reviews every batch and merges the
+// reviews into a single report
+package review
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/diffparse"
+	"github.com/MelleKoning/aifun/internal/tokens"
+)
+
+// DefaultBatchTokens is the estimated size of the diff in a
+// single request. It stays well below the 30000 tokens context
+// of the ollama in docker-compose.yaml, leaving room for the
+// prompt and the answer
+const DefaultBatchTokens = 16000
+
+// Request is a single review request. The Diff is empty for
+// the consolidation pass, the Instruction is added to the
+// review command
+type Request struct {
+	Diff        string
+	Instruction string
+	// JSON asks for an answer in the format of Report. Backends
+	// with a response schema use Categories to limit the category
+	JSON       bool
+	Categories []string
+}
+
+// Generator sends one review request to the model with the
+// system instruction of the selected prompt. The answer is
+// not added to the chat history. When the context is cancelled
+// it returns the partial answer with the error
+type Generator func(ctx context.Context, request Request, onChunk func(string)) (string, error)
+
+type Options struct {
+	// BatchTokens is the maximum estimated tokens of diff
+	// per request, 0 uses DefaultBatchTokens
+	BatchTokens int
+	// Categories are the review categories of the prompt,
+	// used for structured reviews
+	Categories []string
+}
+
+func (o Options) batchTokens() int {
+	if o.BatchTokens <= 0 {
+		return DefaultBatchTokens
+	}
+
+	return o.BatchTokens
+}
+
+// Run reviews the diff. A diff that fits in one batch is reviewed
+// in a single request, streamed to onChunk. A larger diff is split
+// by file and hunk, each batch is reviewed on its own and a last
+// consolidation pass merges the reviews into one report, which
+// is streamed to onChunk
+func Run(ctx context.Context, diff string, options Options, generate Generator,
+	onChunk func(string)) (string, error) {
+	batches := batchDiff(diff, options.batchTokens())
+	if len(batches) == 1 {
+		return generate(ctx, Request{Diff: batches[0]}, onChunk)
+	}
+
+	var reviews []string
+	for i, batch := range batches {
+		onChunk(fmt.Sprintf("_Reviewing part %d of %d..._\n\n", i+1, len(batches)))
+
+		instruction := fmt.Sprintf(`* This diff is part %d of %d of a larger diff. Only review this part,
+  mention the file and the line for every finding.`, i+1, len(batches))
+		partReview, err := generate(ctx, Request{Diff: batch, Instruction: instruction}, func(string) {})
+		if err != nil {
+			return "", fmt.Errorf("reviewing part %d of %d: %w", i+1, len(batches), err)
+		}
+		reviews = append(reviews, partReview)
+	}
+
+	onChunk("_Consolidating the reviews..._\n\n")
+
+	return generate(ctx, Request{Instruction: consolidateInstruction(reviews)}, onChunk)
+}
+
+// batchDiff splits the diff when it is over the budget. A diff
+// that can not be parsed is sent as a whole
+func batchDiff(diff string, budget int) []string {
+	if tokens.Estimate(diff) <= budget {
+		return []string{diff}
+	}
+	files, err := diffparse.Parse(diff)
+	if err != nil {
+		return []string{diff}
+	}
+
+	return Batches(files, budget)
+}
+
+// Batches packs the files into diffs of at most budget estimated
+// tokens. Files that do not fit in a batch are split by hunk, a
+// single hunk that is larger than the budget gets its own batch
+func Batches(files []*diffparse.File, budget int) []string {
+	var batches []string
+	var current strings.Builder
+
+	add := func(part string) {
+		if current.Len() > 0 && tokens.Estimate(current.String())+tokens.Estimate(part) > budget {
+			batches = append(batches, current.String())
+			current.Reset()
+		}
+		current.WriteString(part)
+	}
+
+	for _, file := range files {
+		fileDiff := file.String()
+		if tokens.Estimate(fileDiff) <= budget || len(file.Hunks) == 0 {
+			add(fileDiff)
+			continue
+		}
+
+		// every hunk gets the header of the file, so the
+		// model knows which file the hunk belongs to
+		header := strings.Join(file.Header, "\n") + "\n"
+		for _, hunk := range file.Hunks {
+			add(header + hunk.String())
+		}
+	}
+	if current.Len() > 0 {
+		batches = append(batches, current.String())
+	}
+
+	return batches
+}
+
+func consolidateInstruction(reviews []string) string {
+	var build strings.Builder
+	fmt.Fprintf(&build, `The diff was too large for a single review and was reviewed in %d parts.
+Below are the reviews of the parts. Merge them into a single review:
+
+* Follow the structure that the instructions ask for.
+* Remove duplicate findings, keep the file and line references.
+* Rank the findings from most to least important.
+* Do not mention that the review was done in parts.
+`, len(reviews))
+
+	for i, partReview := range reviews {
+		fmt.Fprintf(&build, "\n--- REVIEW OF PART %d ---\n\n%s\n", i+1, partReview)
+	}
+	build.WriteString("\nAI OUTPUT:")
+
+	return build.String()
+}
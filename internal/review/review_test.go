@@ -0,0 +1,115 @@
+package review
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/diffparse"
+)
+
+// makeDiff creates a diff of files with one hunk of lines each
+func makeDiff(files, lines int) string {
+	var build strings.Builder
+	for f := 0; f < files; f++ {
+		fmt.Fprintf(&build, "diff --git a/file%d.go b/file%d.go\n--- a/file%d.go\n+++ b/file%d.go\n", f, f, f, f)
+		fmt.Fprintf(&build, "@@ -1,0 +1,%d @@\n", lines)
+		for l := 0; l < lines; l++ {
+			fmt.Fprintf(&build, "+var line%d = %d // some padding text\n", l, l)
+		}
+	}
+
+	return build.String()
+}
+
+type call struct {
+	diff        string
+	instruction string
+}
+
+func recordingGenerator(calls *[]call) Generator {
+	return func(ctx context.Context, request Request, onChunk func(string)) (string, error) {
+		*calls = append(*calls, call{request.Diff, request.Instruction})
+		answer := fmt.Sprintf("review %d", len(*calls))
+		onChunk(answer)
+		return answer, nil
+	}
+}
+
+func TestRunSingleBatch(t *testing.T) {
+	var calls []call
+	var streamed strings.Builder
+	diff := makeDiff(2, 3)
+
+	result, err := Run(context.Background(), diff, Options{}, recordingGenerator(&calls), func(s string) {
+		streamed.WriteString(s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].diff != diff || calls[0].instruction != "" {
+		t.Errorf("expected the diff in a single call, got %+v", calls)
+	}
+	if result != "review 1" || streamed.String() != "review 1" {
+		t.Errorf("unexpected result %q, streamed %q", result, streamed.String())
+	}
+}
+
+func TestRunBatched(t *testing.T) {
+	var calls []call
+	var streamed strings.Builder
+	diff := makeDiff(3, 20)
+
+	result, err := Run(context.Background(), diff, Options{BatchTokens: 250}, recordingGenerator(&calls), func(s string) {
+		streamed.WriteString(s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every file is a batch, plus the consolidation
+	if len(calls) != 4 {
+		t.Fatalf("expected 4 calls, got %d", len(calls))
+	}
+	if !strings.Contains(calls[1].diff, "file1.go") || !strings.Contains(calls[1].instruction, "part 2 of 3") {
+		t.Errorf("unexpected second batch %+v", calls[1])
+	}
+	consolidation := calls[3]
+	if consolidation.diff != "" || !strings.Contains(consolidation.instruction, "review 3") {
+		t.Errorf("consolidation misses the reviews: %+v", consolidation)
+	}
+	if result != "review 4" {
+		t.Errorf("expected the consolidated review, got %q", result)
+	}
+	if !strings.Contains(streamed.String(), "part 3 of 3") || !strings.HasSuffix(streamed.String(), "review 4") {
+		t.Errorf("unexpected streamed output %q", streamed.String())
+	}
+}
+
+func TestBatchesSplitsHunks(t *testing.T) {
+	diff := makeDiff(1, 10) + `diff --git a/big.go b/big.go
+--- a/big.go
++++ b/big.go
+@@ -1,1 +1,1 @@
+-a
++b
+@@ -20,1 +20,1 @@
+-c
++d
+`
+	files, err := diffparse.Parse(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := Batches(files, 20)
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d:\n%s", len(batches), strings.Join(batches, "\n====\n"))
+	}
+	for _, batch := range batches[1:] {
+		if !strings.HasPrefix(batch, "diff --git a/big.go b/big.go\n--- a/big.go\n+++ b/big.go\n@@") {
+			t.Errorf("hunk without file header:\n%s", batch)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package sarif converts review findings to SARIF 2.1.0, so the
+// results of an AI review show up in code scanning tools next
+// to go vet and staticcheck
+package sarif
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/MelleKoning/aifun/internal/diffparse"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/review"
+)
+
+const (
+	Version = "2.1.0"
+	Schema  = "https://json.schemastore.org/sarif-2.1.0.json"
+
+	toolName = "aifun diffreviewer"
+	toolURI  = "https://github.com/MelleKoning/aifun"
+)
+
+// Tool describes the review that produced the findings
+type Tool struct {
+	// PromptName is the name of the prompt of the review
+	PromptName string
+	Provider   string
+	Model      string
+}
+
+// Log is the root of a SARIF file
+type Log struct {
+	Version string `json:"version"`
+	Schema  string `json:"$schema"`
+	Runs    []Run  `json:"runs"`
+}
+
+type Run struct {
+	Tool    ToolComponent `json:"tool"`
+	Results []Result      `json:"results"`
+}
+
+type ToolComponent struct {
+	Driver Driver `json:"driver"`
+}
+
+type Driver struct {
+	Name           string            `json:"name"`
+	InformationURI string            `json:"informationUri,omitempty"`
+	Rules          []Rule            `json:"rules"`
+	Properties     map[string]string `json:"properties,omitempty"`
+}
+
+type Rule struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	ShortDescription Message `json:"shortDescription"`
+}
+
+type Message struct {
+	Text string `json:"text"`
+}
+
+type Result struct {
+	RuleID     string            `json:"ruleId"`
+	RuleIndex  int               `json:"ruleIndex"`
+	Level      string            `json:"level"`
+	Message    Message           `json:"message"`
+	Locations  []Location        `json:"locations,omitempty"`
+	Fixes      []Fix             `json:"fixes,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type Location struct {
+	PhysicalLocation PhysicalLocation `json:"physicalLocation"`
+}
+
+type PhysicalLocation struct {
+	ArtifactLocation ArtifactLocation `json:"artifactLocation"`
+	Region           *Region          `json:"region,omitempty"`
+}
+
+type ArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type Region struct {
+	StartLine int      `json:"startLine"`
+	EndLine   int      `json:"endLine,omitempty"`
+	Snippet   *Message `json:"snippet,omitempty"`
+}
+
+// Fix is only a description, the suggestion of a finding
+// is not precise enough for an automatic replacement
+type Fix struct {
+	Description Message `json:"description"`
+}
+
+// FromFindings converts the findings. The rules are the review
+// categories of all prompts in prompts.List(), extended with
+// categories the model came up with itself. The files of the
+// parsed diff place the findings on lines that were changed
+func FromFindings(findings []review.Finding, files []*diffparse.File, tool Tool) *Log {
+	rules, ruleIndex := rulesFor(findings)
+
+	results := []Result{}
+	for _, finding := range findings {
+		index := ruleIndex[RuleID(finding.Category)]
+		result := Result{
+			RuleID:    rules[index].ID,
+			RuleIndex: index,
+			Level:     Level(finding.Severity),
+			Message:   Message{Text: finding.Message},
+			Properties: map[string]string{
+				"severity": string(finding.Severity),
+			},
+		}
+		if location, ok := locate(finding, files); ok {
+			result.Locations = []Location{location}
+		}
+		if finding.Suggestion != "" {
+			result.Fixes = []Fix{{Description: Message{Text: finding.Suggestion}}}
+		}
+		results = append(results, result)
+	}
+
+	properties := map[string]string{}
+	for key, value := range map[string]string{
+		"prompt":   tool.PromptName,
+		"provider": tool.Provider,
+		"model":    tool.Model,
+	} {
+		if value != "" {
+			properties[key] = value
+		}
+	}
+
+	return &Log{
+		Version: Version,
+		Schema:  Schema,
+		Runs: []Run{{
+			Tool: ToolComponent{Driver: Driver{
+				Name:           toolName,
+				InformationURI: toolURI,
+				Rules:          rules,
+				Properties:     properties,
+			}},
+			Results: results,
+		}},
+	}
+}
+
+// RuleID turns a review category like "Correctness & Logic"
+// into a rule id like "correctness-logic"
+func RuleID(category string) string {
+	words := strings.FieldsFunc(strings.ToLower(category), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "general"
+	}
+
+	return strings.Join(words, "-")
+}
+
+// Level maps the severity to the SARIF levels error,
+// warning and note
+func Level(severity review.Severity) string {
+	switch severity {
+	case review.Critical, review.High:
+		return "error"
+	case review.Medium:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// rulesFor lists the rules of the prompt categories first,
+// so rule ids are the same for every review
+func rulesFor(findings []review.Finding) ([]Rule, map[string]int) {
+	var rules []Rule
+	index := map[string]int{}
+	add := func(category string) {
+		id := RuleID(category)
+		if _, ok := index[id]; ok {
+			return
+		}
+		name := strings.TrimSpace(category)
+		if name == "" {
+			name = "General"
+		}
+		index[id] = len(rules)
+		rules = append(rules, Rule{ID: id, Name: name, ShortDescription: Message{Text: name}})
+	}
+
+	for _, prompt := range prompts.List() {
+		for _, category := range prompt.Categories {
+			add(category)
+		}
+	}
+	for _, finding := range findings {
+		add(finding.Category)
+	}
+
+	return rules, index
+}
+
+// locate finds the file of the finding in the diff. Lines
+// that are not part of the diff are moved to the nearest
+// hunk, a code scanning tool only shows changed lines
+func locate(finding review.Finding, files []*diffparse.File) (Location, bool) {
+	file := findFile(finding.File, files)
+	if file == nil {
+		if finding.File == "" {
+			return Location{}, false
+		}
+		location := Location{PhysicalLocation: PhysicalLocation{
+			ArtifactLocation: ArtifactLocation{URI: finding.File},
+		}}
+		if finding.StartLine > 0 {
+			location.PhysicalLocation.Region = &Region{StartLine: finding.StartLine, EndLine: finding.EndLine}
+		}
+		return location, true
+	}
+
+	location := Location{PhysicalLocation: PhysicalLocation{
+		ArtifactLocation: ArtifactLocation{URI: file.Name()},
+	}}
+	if file.IsDeleted || len(file.Hunks) == 0 {
+		return location, true
+	}
+
+	start, end := finding.StartLine, finding.EndLine
+	if !file.ContainsNewLine(start) {
+		hunk := nearestHunk(file, start)
+		start, end = hunk.NewStart, hunk.NewStart+hunk.NewLines-1
+		if end < start {
+			// a hunk that only removes lines
+			end = start
+		}
+	}
+	if end < start {
+		end = start
+	}
+
+	region := &Region{StartLine: start, EndLine: end}
+	if snippet := newLines(file, start, end); snippet != "" {
+		region.Snippet = &Message{Text: snippet}
+	}
+	location.PhysicalLocation.Region = region
+
+	return location, true
+}
+
+// findFile matches the name exactly or, because models
+// sometimes shorten or prefix paths, by its path suffix
+func findFile(name string, files []*diffparse.File) *diffparse.File {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "b/"), "./")
+	if name == "" {
+		return nil
+	}
+	for _, file := range files {
+		if file.Name() == name {
+			return file
+		}
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), "/"+name) || strings.HasSuffix(name, "/"+file.Name()) {
+			return file
+		}
+	}
+
+	return nil
+}
+
+func nearestHunk(file *diffparse.File, line int) *diffparse.Hunk {
+	nearest := file.Hunks[0]
+	distance := func(hunk *diffparse.Hunk) int {
+		if line < hunk.NewStart {
+			return hunk.NewStart - line
+		}
+		return line - (hunk.NewStart + hunk.NewLines - 1)
+	}
+	for _, hunk := range file.Hunks[1:] {
+		if distance(hunk) < distance(nearest) {
+			nearest = hunk
+		}
+	}
+
+	return nearest
+}
+
+// newLines returns the text of the lines in the new file
+func newLines(file *diffparse.File, start, end int) string {
+	var lines []string
+	for _, hunk := range file.Hunks {
+		for _, line := range hunk.Lines {
+			if line.NewNumber >= start && line.NewNumber <= end {
+				lines = append(lines, line.Text)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
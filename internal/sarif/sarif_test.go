@@ -0,0 +1,82 @@
+package sarif
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/MelleKoning/aifun/internal/diffparse"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/review"
+)
+
+const diff = `diff --git a/internal/x/x.go b/internal/x/x.go
+--- a/internal/x/x.go
++++ b/internal/x/x.go
+@@ -10,3 +10,4 @@ func x() {
+ 	a := 1
+-	b := 2
++	b := 3
++	c := 4
+ 	return
+`
+
+func TestRuleID(t *testing.T) {
+	for category, expected := range map[string]string{
+		"Correctness & Logic": "correctness-logic",
+		"Obvious errors":      "obvious-errors",
+		" ":                   "general",
+	} {
+		if id := RuleID(category); id != expected {
+			t.Errorf("RuleID(%q) = %q, expected %q", category, id, expected)
+		}
+	}
+}
+
+func TestFromFindings(t *testing.T) {
+	files, err := diffparse.Parse(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings := []review.Finding{
+		{File: "x/x.go", StartLine: 11, EndLine: 12, Severity: review.High,
+			Category: prompts.PromptList[0].Categories[1], Message: "off by one", Suggestion: "b := 2"},
+		{File: "internal/x/x.go", StartLine: 40, Severity: review.Low, Category: "Naming", Message: "name c"},
+	}
+
+	log := FromFindings(findings, files, Tool{PromptName: "gitreview prompt", Model: "fake"})
+	run := log.Runs[0]
+	if log.Version != Version || run.Tool.Driver.Properties["prompt"] != "gitreview prompt" ||
+		run.Tool.Driver.Properties["model"] != "fake" {
+		t.Errorf("unexpected tool metadata %+v", run.Tool.Driver)
+	}
+
+	first := run.Results[0]
+	if first.RuleID != "obvious-errors" || run.Tool.Driver.Rules[first.RuleIndex].ID != first.RuleID ||
+		first.Level != "error" || len(first.Fixes) != 1 {
+		t.Errorf("unexpected first result %+v", first)
+	}
+	location := first.Locations[0].PhysicalLocation
+	if location.ArtifactLocation.URI != "internal/x/x.go" || location.Region.StartLine != 11 ||
+		location.Region.Snippet.Text != "\tb := 3\n\tc := 4\n" {
+		t.Errorf("unexpected location %+v %+v", location, location.Region)
+	}
+
+	// a category of the model itself becomes a rule, a line
+	// outside the diff moves to the hunk
+	second := run.Results[1]
+	if second.RuleID != "naming" || second.Level != "note" {
+		t.Errorf("unexpected second result %+v", second)
+	}
+	if region := second.Locations[0].PhysicalLocation.Region; region.StartLine != 10 || region.EndLine != 13 {
+		t.Errorf("expected the region of the hunk, got %+v", region)
+	}
+
+	encoded, err := json.Marshal(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), `"$schema":"`+Schema+`"`) {
+		t.Errorf("schema missing in %s", encoded)
+	}
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/review"
+)
+
+var errEmpty = errors.New("the session has no messages yet")
+
+// Autosave wraps a model and saves the session after every
+// call that changes the chat history, so a crash never loses
+// a conversation. Errors of saving are logged, they do not
+// fail the chat
+type Autosave struct {
+	genaimodel.Action
+	store   *Store
+	current *Session
+	// CompactAt is the percentage of the context window from
+	// where older messages are summarised before a request, 0
+	// uses DefaultCompactAt and 100 or more never compacts
+	CompactAt int
+}
+
+// NewAutosave saves the chat of the action to the session
+func NewAutosave(action genaimodel.Action, store *Store, s *Session) *Autosave {
+	return &Autosave{Action: action, store: store, current: s}
+}
+
+// Store returns the store the sessions are saved in
+func (a *Autosave) Store() *Store {
+	return a.store
+}
+
+// Current returns the session that is saved
+func (a *Autosave) Current() *Session {
+	return a.current
+}
+
+// Resume continues a saved session: the model gets the
+// system instruction, parameters and history of the session.
+// The session continues with the provider and model in use
+func (a *Autosave) Resume(s *Session) {
+	if s.Provider != a.current.Provider || s.Model != a.current.Model {
+		log.Printf("session %s was saved with %s %s, it continues with %s %s",
+			s.ID, s.Provider, s.Model, a.current.Provider, a.current.Model)
+		s.Provider, s.Model = a.current.Provider, a.current.Model
+	}
+	a.current = s
+	a.Action.UpdateSystemInstruction(s.SystemInstruction)
+	a.Action.SetParams(s.Params)
+	a.Action.SetHistory(s.History())
+}
+
+// Start begins a new, empty session with the same provider,
+// model, system instruction, prompt and parameters
+func (a *Autosave) Start() {
+	previous := a.current
+	a.current = New(previous.Provider, previous.Model, previous.SystemInstruction)
+	a.current.Prompt = previous.Prompt
+	a.current.Params = previous.Params
+	a.Action.SetHistory(nil)
+}
+
+// Rename renames a saved session, the current session
+// is renamed in memory as well
+func (a *Autosave) Rename(id, title string) error {
+	if id == a.current.ID {
+		a.current.Title = title
+		if len(a.current.Messages) == 0 {
+			return nil
+		}
+		return a.store.Save(a.current)
+	}
+
+	return a.store.Rename(id, title)
+}
+
+// Delete removes a saved session. Deleting the current
+// session starts a new one, so it is not saved again
+func (a *Autosave) Delete(id string) error {
+	err := a.store.Delete(id)
+	if id == a.current.ID {
+		a.Start()
+		// a current session without messages was never saved
+		return nil
+	}
+
+	return err
+}
+
+func (a *Autosave) ChatMessage(ctx context.Context, userPrompt string, onChunk func(string)) (string, error) {
+	a.compactIfFull(ctx, onChunk)
+	result, err := a.Action.ChatMessage(ctx, userPrompt, onChunk)
+	a.save()
+
+	return result, err
+}
+
+func (a *Autosave) ReviewFile(ctx context.Context, diff string, onChunk func(string)) (string, error) {
+	a.compactIfFull(ctx, onChunk)
+	result, err := a.Action.ReviewFile(ctx, diff, onChunk)
+	a.markReview(err)
+	a.save()
+
+	return result, err
+}
+
+func (a *Autosave) ReviewFindings(ctx context.Context, diff string, categories []string,
+	onChunk func(string)) ([]review.Finding, error) {
+	a.compactIfFull(ctx, onChunk)
+	findings, err := a.Action.ReviewFindings(ctx, diff, categories, onChunk)
+	a.markReview(err)
+	a.save()
+
+	return findings, err
+}
+
+func (a *Autosave) UpdateSystemInstruction(systemInstruction string) {
+	a.Action.UpdateSystemInstruction(systemInstruction)
+	a.current.SystemInstruction = systemInstruction
+	a.save()
+}
+
+func (a *Autosave) SetParams(params genaimodel.Params) {
+	a.Action.SetParams(params)
+	a.current.Params = params
+	a.save()
+}
+
+func (a *Autosave) SetHistory(history []genaimodel.Message) {
+	a.Action.SetHistory(history)
+	a.save()
+}
+
+// SwitchModel continues the session with another model of the
+// provider, the model gets the system instruction, parameters,
+// usage handler and history
+func (a *Autosave) SwitchModel(action genaimodel.Action, model string) {
+	history := a.Action.GetHistory()
+	action.SetUsageHandler(a.Action.GetUsageHandler())
+	a.Action = action
+	a.current.Model = model
+	action.UpdateSystemInstruction(a.current.SystemInstruction)
+	action.SetParams(a.current.Params)
+	action.SetHistory(history)
+	a.save()
+}
+
+// Save saves the current session now. A session without
+// messages is not saved, that is an error
+func (a *Autosave) Save() error {
+	a.current.SetHistory(a.Action.GetHistory())
+	if len(a.current.Messages) == 0 {
+		return errEmpty
+	}
+
+	return a.store.Save(a.current)
+}
+
+// save skips sessions without messages, starting the
+// tools should not leave empty sessions behind
+func (a *Autosave) save() {
+	err := a.Save()
+	if err != nil && !errors.Is(err, errEmpty) {
+		log.Printf("saving session %s: %v", a.current.ID, err)
+	}
+}
+
+// Open wraps the action with autosave in the default store. An
+// empty resume starts a new session, otherwise it is the id of
+// the session to continue or Last
+func Open(action genaimodel.Action, provider, model, systemInstruction,
+	resume string) (*Autosave, error) {
+	store, err := DefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	current := New(provider, model, systemInstruction)
+	current.Params = action.GetParams()
+	autosave := NewAutosave(action, store, current)
+	if resume != "" {
+		s, err := store.Load(resume)
+		if err != nil {
+			return nil, err
+		}
+		autosave.Resume(s)
+	}
+
+	return autosave, nil
+}
@@ -0,0 +1,172 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+const (
+	// DefaultCompactAt is the percentage of the context window
+	// from where the older messages are summarised
+	DefaultCompactAt = 80
+	// compactKeep is the number of recent messages that
+	// are never compacted
+	compactKeep = 4
+)
+
+// compactRequest asks for the summary, it stays in the
+// history as the question of the summary
+const compactRequest = `Summarise our conversation so far, so we can continue without the earlier messages.
+Keep the decisions, the open questions, the names of files and code, and the findings of reviews.
+Answer with the summary only.`
+
+var errNothingToCompact = errors.New("nothing to compact, the older messages are pinned or there are too few")
+
+// Compaction records the messages that were replaced by a
+// summary, so they can still be read
+type Compaction struct {
+	Time     time.Time `json:"time"`
+	Summary  string    `json:"summary"`
+	Messages []Message `json:"messages"`
+}
+
+// History returns the compacted messages like Session.History
+func (c Compaction) History() []genaimodel.Message {
+	return history(c.Messages)
+}
+
+// Kept is true for a message that is never compacted: it is
+// pinned, it is the system instruction, or it is the answer
+// of the last review
+func (s *Session) Kept(index int) bool {
+	message := s.Messages[index]
+	if message.Pinned || message.Text == s.SystemInstruction {
+		return true
+	}
+	if !message.Review {
+		return false
+	}
+	for _, later := range s.Messages[index+1:] {
+		if later.Review {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compact asks the model to summarise the older messages and
+// replaces them by the summary. The recent messages and the
+// messages that are kept stay as they are. The compacted
+// messages are recorded in the session
+func (a *Autosave) Compact(ctx context.Context) (Compaction, error) {
+	a.current.SetHistory(a.Action.GetHistory())
+	messages := a.current.Messages
+	// the recent messages stay, starting with a question
+	cut := len(messages) - compactKeep
+	for cut > 0 && messages[cut].Role != genaimodel.RoleUser {
+		cut--
+	}
+	var compacted []Message
+	first := -1
+	for i := 0; i < cut; i++ {
+		if a.current.Kept(i) {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		compacted = append(compacted, messages[i])
+	}
+	if len(compacted) < 2 {
+		return Compaction{}, errNothingToCompact
+	}
+
+	before := a.Action.GetHistory()
+	a.Action.SetHistory(history(compacted))
+	summary, err := a.Action.ChatMessage(ctx, compactRequest, func(string) {})
+	if err != nil {
+		a.Action.SetHistory(before)
+		return Compaction{}, fmt.Errorf("summarising the history: %w", err)
+	}
+
+	compaction := Compaction{Time: time.Now(), Summary: summary, Messages: compacted}
+	number := len(a.current.Compactions) + 1
+	var kept []Message
+	for i, message := range messages[:cut] {
+		if a.current.Kept(i) {
+			kept = append(kept, message)
+			continue
+		}
+		// the summary takes the place of the first compacted message
+		if i == first {
+			kept = append(kept,
+				Message{Role: genaimodel.RoleUser, Text: compactRequest, Time: compaction.Time, Summary: number},
+				Message{Role: genaimodel.RoleModel, Text: summary, Time: compaction.Time, Summary: number})
+		}
+	}
+	a.current.Messages = append(kept, messages[cut:]...)
+	a.current.Compactions = append(a.current.Compactions, compaction)
+	a.Action.SetHistory(history(a.current.Messages))
+	a.save()
+
+	return compaction, nil
+}
+
+// compactIfFull compacts before a request when the chat uses
+// CompactAt percent of the context window, onChunk tells the
+// user. A failed compaction is logged, the request may still fit
+func (a *Autosave) compactIfFull(ctx context.Context, onChunk func(string)) {
+	compactAt := a.CompactAt
+	if compactAt <= 0 {
+		compactAt = DefaultCompactAt
+	}
+	if compactAt >= 100 {
+		return
+	}
+	usage := a.Action.ContextUsage(ctx)
+	if usage.Limit <= 0 || usage.Percent() < compactAt {
+		return
+	}
+
+	compaction, err := a.Compact(ctx)
+	if errors.Is(err, errNothingToCompact) {
+		return
+	}
+	if err != nil {
+		log.Printf("compacting session %s: %v", a.current.ID, err)
+		return
+	}
+	onChunk(fmt.Sprintf("_The chat used %d%% of the context window, %d earlier messages were summarised._\n\n",
+		usage.Percent(), len(compaction.Messages)))
+}
+
+// Pin pins or unpins a message, counting from 1. It
+// returns if the message is pinned now
+func (a *Autosave) Pin(number int) (bool, error) {
+	a.current.SetHistory(a.Action.GetHistory())
+	if number < 1 || number > len(a.current.Messages) {
+		return false, fmt.Errorf("no message %d, the session has %d messages", number, len(a.current.Messages))
+	}
+	message := &a.current.Messages[number-1]
+	message.Pinned = !message.Pinned
+	a.save()
+
+	return message.Pinned, nil
+}
+
+// markReview marks the answer of a review that succeeded
+func (a *Autosave) markReview(err error) {
+	if err != nil {
+		return
+	}
+	a.current.SetHistory(a.Action.GetHistory())
+	if last := len(a.current.Messages) - 1; last >= 0 {
+		a.current.Messages[last].Review = true
+	}
+}
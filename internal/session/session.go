@@ -0,0 +1,304 @@
+// Package session saves chats to disk, one json file per
+// session, so a conversation can be resumed in a later run
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/tokens"
+)
+
+const (
+	dirName   = "sessions"
+	extension = ".json"
+	// Last selects the most recently updated session
+	Last = "last"
+	// titleLength is the length of a title taken
+	// from the first message
+	titleLength = 60
+)
+
+// Message is a message of the chat history with the
+// time it was added. Tokens is estimated
+type Message struct {
+	Role   string    `json:"role"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+	Tokens int       `json:"tokens"`
+	// Pinned messages are never compacted, Review marks the
+	// answer of a review, the last review is kept as well
+	Pinned bool `json:"pinned,omitempty"`
+	Review bool `json:"review,omitempty"`
+	// Summary is the number of the compaction the message
+	// belongs to, counting from 1. It is 0 for other messages
+	Summary int `json:"summary,omitempty"`
+}
+
+// Usage sums the tokens of the user and the model messages
+type Usage struct {
+	UserTokens  int `json:"userTokens"`
+	ModelTokens int `json:"modelTokens"`
+}
+
+// Session is a saved chat
+type Session struct {
+	ID                string `json:"id"`
+	Title             string `json:"title"`
+	Provider          string `json:"provider"`
+	Model             string `json:"model"`
+	SystemInstruction string `json:"systemInstruction"`
+	// Prompt is the name of the prompt the system instruction
+	// is made of, empty when it is no prompt of the library
+	Prompt string `json:"prompt,omitempty"`
+	// Params are the generation parameters of the chat
+	Params   genaimodel.Params `json:"params"`
+	Messages []Message         `json:"messages"`
+	// Compactions are the messages that were replaced by a
+	// summary, the oldest first
+	Compactions []Compaction `json:"compactions,omitempty"`
+	Usage       Usage        `json:"usage"`
+	Created     time.Time    `json:"created"`
+	Updated     time.Time    `json:"updated"`
+}
+
+// New starts a session with a new id
+func New(provider, model, systemInstruction string) *Session {
+	now := time.Now()
+
+	return &Session{
+		ID:                newID(now),
+		Provider:          provider,
+		Model:             model,
+		SystemInstruction: systemInstruction,
+		Created:           now,
+		Updated:           now,
+	}
+}
+
+// newID sorts by time and is unique for sessions
+// that start in the same second
+func newID(now time.Time) string {
+	random := make([]byte, 3)
+	_, _ = rand.Read(random)
+
+	return now.Format("20060102-150405") + "-" + hex.EncodeToString(random)
+}
+
+// History returns the messages for Action.SetHistory
+func (s *Session) History() []genaimodel.Message {
+	return history(s.Messages)
+}
+
+func history(messages []Message) []genaimodel.Message {
+	result := make([]genaimodel.Message, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, genaimodel.Message{Role: message.Role, Text: message.Text})
+	}
+
+	return result
+}
+
+// SetHistory updates the messages from the history of the
+// model. Messages that are already in the session keep their
+// time and marks, new messages get the current time
+func (s *Session) SetHistory(history []genaimodel.Message) {
+	now := time.Now()
+	messages := make([]Message, 0, len(history))
+	s.Usage = Usage{}
+	for i, message := range history {
+		saved := Message{Role: message.Role, Text: message.Text, Time: now, Tokens: tokens.Estimate(message.Text)}
+		if i < len(s.Messages) && s.Messages[i].Role == message.Role && s.Messages[i].Text == message.Text {
+			saved = s.Messages[i]
+			saved.Tokens = tokens.Estimate(message.Text)
+		}
+		if saved.Role == genaimodel.RoleUser {
+			s.Usage.UserTokens += saved.Tokens
+		} else {
+			s.Usage.ModelTokens += saved.Tokens
+		}
+		messages = append(messages, saved)
+	}
+	s.Messages = messages
+
+	if s.Title == "" {
+		s.Title = titleFrom(messages)
+	}
+}
+
+// titleFrom takes the first line of the first user message
+func titleFrom(messages []Message) string {
+	for _, message := range messages {
+		if message.Role != genaimodel.RoleUser {
+			continue
+		}
+		title, _, _ := strings.Cut(strings.TrimSpace(message.Text), "\n")
+		if len([]rune(title)) > titleLength {
+			title = string([]rune(title)[:titleLength]) + "..."
+		}
+		return title
+	}
+
+	return ""
+}
+
+// Store keeps the sessions as json files in a folder
+type Store struct {
+	Dir string
+}
+
+// DefaultStore keeps the sessions in ~/.aifun/sessions
+func DefaultStore() (*Store, error) {
+	userDir, err := config.UserDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{Dir: filepath.Join(userDir, dirName)}, nil
+}
+
+// Save writes the session. The file is written next to the
+// old one and renamed, so a crash never leaves half a session
+func (st *Store) Save(s *Session) error {
+	err := os.MkdirAll(st.Dir, 0o700)
+	if err != nil {
+		return err
+	}
+	s.Updated = time.Now()
+
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := st.path(s.ID)
+	temporary := path + ".tmp"
+	err = os.WriteFile(temporary, contents, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+// Load reads a session by id, or the newest with Last
+func (st *Store) Load(id string) (*Session, error) {
+	if id == Last {
+		sessions, err := st.List()
+		if err != nil {
+			return nil, err
+		}
+		if len(sessions) == 0 {
+			return nil, errors.New("there are no saved sessions")
+		}
+		return sessions[0], nil
+	}
+
+	contents, err := os.ReadFile(st.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no session %q", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Session
+	err = json.Unmarshal(contents, &s)
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %w", id, err)
+	}
+
+	return &s, nil
+}
+
+// List returns all sessions, the most recently updated
+// first. Files that can not be read are logged and skipped
+func (st *Store) List() ([]*Session, error) {
+	entries, err := os.ReadDir(st.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), extension) {
+			continue
+		}
+		s, err := st.Load(strings.TrimSuffix(entry.Name(), extension))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+
+	return sessions, nil
+}
+
+// Delete removes the file of the session
+func (st *Store) Delete(id string) error {
+	err := os.Remove(st.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no session %q", id)
+	}
+
+	return err
+}
+
+// Rename changes the title of a saved session
+func (st *Store) Rename(id, title string) error {
+	s, err := st.Load(id)
+	if err != nil {
+		return err
+	}
+	s.Title = title
+
+	return st.Save(s)
+}
+
+// Duplicate saves a copy of the session with a new id, to
+// continue a conversation in two directions
+func (st *Store) Duplicate(id string) (*Session, error) {
+	s, err := st.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	s.ID = newID(time.Now())
+	s.Title += " (copy)"
+	s.Created = time.Now()
+
+	return s, st.Save(s)
+}
+
+// path keeps the id inside the folder of the store
+func (st *Store) path(id string) string {
+	return filepath.Join(st.Dir, filepath.Base(id)+extension)
+}
+
+// Summary is a single line describing the session for lists
+func (s *Session) Summary() string {
+	title := s.Title
+	if title == "" {
+		title = "(no messages)"
+	}
+
+	return fmt.Sprintf("%s  %s  %3d messages  %s", s.ID,
+		s.Updated.Local().Format("2006-01-02 15:04"), len(s.Messages), title)
+}
@@ -0,0 +1,225 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+func TestStore(t *testing.T) {
+	store := &Store{Dir: t.TempDir()}
+
+	older := New("fake", "fake", "be brief")
+	older.SetHistory([]genaimodel.Message{{Role: genaimodel.RoleUser, Text: "first question\nwith details"}})
+	if err := store.Save(older); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	newer := New("fake", "fake", "be brief")
+	if err := store.Save(newer); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != newer.ID {
+		t.Fatalf("expected the newest session first, got %d sessions", len(sessions))
+	}
+
+	loaded, err := store.Load(older.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Title != "first question" || loaded.SystemInstruction != "be brief" || len(loaded.Messages) != 1 {
+		t.Errorf("unexpected session %+v", loaded)
+	}
+	if last, err := store.Load(Last); err != nil || last.ID != newer.ID {
+		t.Errorf("expected the last session, got %v %v", last, err)
+	}
+
+	if err := store.Delete(older.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(older.ID); err == nil {
+		t.Error("expected an error for a deleted session")
+	}
+	if err := store.Delete("../outside"); err == nil {
+		t.Error("expected an error for an id outside the store")
+	}
+}
+
+func TestListSkipsBrokenFiles(t *testing.T) {
+	store := &Store{Dir: t.TempDir()}
+	if err := os.WriteFile(filepath.Join(store.Dir, "broken.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.List()
+	if err != nil || len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %d, %v", len(sessions), err)
+	}
+}
+
+func TestAutosave(t *testing.T) {
+	store := &Store{Dir: t.TempDir()}
+	fake := fakemodel.New("hello there", "second answer")
+	autosave := NewAutosave(fake, store, New("fake", "fake", "be brief"))
+
+	if _, err := autosave.ChatMessage(context.Background(), "hi", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Load(autosave.Current().ID)
+	if err != nil {
+		t.Fatalf("not saved after the first message: %v", err)
+	}
+	if len(saved.Messages) != 2 || saved.Messages[1].Text != "hello there" || saved.Usage.ModelTokens == 0 {
+		t.Errorf("unexpected saved session %+v", saved)
+	}
+	firstTime := saved.Messages[0].Time
+
+	if _, err := autosave.ChatMessage(context.Background(), "and?", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	var params genaimodel.Params
+	_ = params.Set(genaimodel.ParamSeed, "3")
+	autosave.SetParams(params)
+	saved, _ = store.Load(autosave.Current().ID)
+	if len(saved.Messages) != 4 || !saved.Messages[0].Time.Equal(firstTime) {
+		t.Errorf("messages not appended or time changed: %+v", saved.Messages)
+	}
+	if fake.Params.String() != "seed=3" || saved.Params.String() != "seed=3" {
+		t.Errorf("parameters not set and saved: %s, %s", fake.Params, saved.Params)
+	}
+
+	// a new run resumes the session in a fresh model
+	resumedModel := fakemodel.New()
+	resumed := NewAutosave(resumedModel, store, New("fake", "other", ""))
+	resumed.Resume(saved)
+	if resumedModel.SystemInstruction != "be brief" || resumedModel.GetHistoryLength() != 4 ||
+		resumedModel.Params.String() != "seed=3" {
+		t.Errorf("history, instruction or parameters not restored: %q %d %s",
+			resumedModel.SystemInstruction, resumedModel.GetHistoryLength(), resumedModel.Params)
+	}
+	// the model in use answers, not the one of the saved session
+	if resumed.Current().Model != "other" {
+		t.Errorf("expected the session to continue with the model in use, got %q", resumed.Current().Model)
+	}
+
+	resumed.Start()
+	if resumed.Current().ID == saved.ID || resumedModel.GetHistoryLength() != 0 {
+		t.Error("expected a new empty session")
+	}
+}
+
+func TestRenameDuplicateDelete(t *testing.T) {
+	store := &Store{Dir: t.TempDir()}
+	fake := fakemodel.New("answer")
+	autosave := NewAutosave(fake, store, New("fake", "fake", ""))
+	if _, err := autosave.ChatMessage(context.Background(), "question", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	id := autosave.Current().ID
+
+	if err := autosave.Rename(id, "my chat"); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := store.Load(id); saved.Title != "my chat" || autosave.Current().Title != "my chat" {
+		t.Errorf("current session not renamed: %q", saved.Title)
+	}
+
+	duplicate, err := store.Duplicate(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate.ID == id || duplicate.Title != "my chat (copy)" || len(duplicate.Messages) != 2 {
+		t.Errorf("unexpected copy %+v", duplicate)
+	}
+
+	if err := autosave.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if autosave.Current().ID == id || fake.GetHistoryLength() != 0 {
+		t.Error("deleting the current session should start a new one")
+	}
+	if sessions, _ := store.List(); len(sessions) != 1 {
+		t.Errorf("expected only the copy, got %d sessions", len(sessions))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	store := &Store{Dir: t.TempDir()}
+	fake := fakemodel.New("answer one", "answer two", "the review", "answer three", "answer four",
+		"the summary", "the second summary", "answer five")
+	autosave := NewAutosave(fake, store, New("fake", "fake", "be brief"))
+	for _, prompt := range []string{"question one", "question two"} {
+		if _, err := autosave.ChatMessage(ctx, prompt, func(string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := autosave.ReviewFile(ctx, "the diff", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range []string{"question three", "question four"} {
+		if _, err := autosave.ChatMessage(ctx, prompt, func(string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pinned, err := autosave.Pin(1); err != nil || !pinned {
+		t.Fatalf("message not pinned: %v", err)
+	}
+
+	compaction, err := autosave.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compaction.Messages) != 3 || compaction.Summary != "the summary" {
+		t.Errorf("unexpected compaction %+v", compaction)
+	}
+	var texts []string
+	for _, message := range autosave.Current().Messages {
+		texts = append(texts, message.Text)
+	}
+	want := []string{"question one", compactRequest, "the summary", "the review",
+		"question three", "answer three", "question four", "answer four"}
+	if strings.Join(texts, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected messages after compacting %q", texts)
+	}
+	if fake.GetHistoryLength() != len(want) || autosave.Current().Messages[2].Summary != 1 {
+		t.Error("model history not replaced or summary not marked")
+	}
+	saved, _ := store.Load(autosave.Current().ID)
+	if len(saved.Compactions) != 1 || saved.Compactions[0].Messages[0].Text != "answer one" ||
+		!saved.Messages[0].Pinned || !saved.Messages[3].Review {
+		t.Errorf("compaction or marks not saved: %+v", saved)
+	}
+
+	// a nearly full context window compacts before the request
+	fake.Window = genaimodel.ContextWindow{Tokens: 10}
+	var streamed strings.Builder
+	if _, err := autosave.ChatMessage(ctx, "question five", func(chunk string) {
+		streamed.WriteString(chunk)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(streamed.String(), "2 earlier messages were summarised") ||
+		len(autosave.Current().Compactions) != 2 {
+		t.Errorf("not compacted before the request: %q", streamed.String())
+	}
+
+	autosave.CompactAt = 100
+	if _, err := autosave.ChatMessage(ctx, "question six", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if len(autosave.Current().Compactions) != 2 {
+		t.Error("compacting should be off")
+	}
+}
@@ -18,7 +18,9 @@ const colorCyan = "\033[36m"
 
 type GlamourRenderer interface {
 	GetRendered(string) (string, error)
-	FormatUserText(string, int) (string, error)
+	// FormatUserText colours a message of the user, the
+	// status line above it is left out when empty
+	FormatUserText(string, string) (string, error)
 }
 
 type glamourRenderer struct {
@@ -41,9 +43,11 @@ func (gr *glamourRenderer) GetRendered(str string) (string, error) {
 	return gr.gr.Render(str)
 }
 
-func (gr *glamourRenderer) FormatUserText(str string, historyLength int) (string, error) {
-	s := fmt.Sprintf("History items: %d\n", historyLength)
-	s = s + colorGreen + str
+func (gr *glamourRenderer) FormatUserText(str string, status string) (string, error) {
+	s := colorGreen + str
+	if status != "" {
+		s = status + "\n" + s
+	}
 	return s, nil
 }
 func PrintGlamourString(theString string) {
@@ -60,9 +64,11 @@ func PrintGlamourString(theString string) {
 	fmt.Print(markdown)
 }
 
-func PrintPrompt(historyLength int) {
-	fmt.Printf("History items: %d\n", historyLength)
-	fmt.Print(colorGreen + "('exit' to quit, `file` to upload, `prompt` to update systeminstruction) ")
+// PrintPrompt shows the context usage and the
+// commands above the input
+func PrintPrompt(usage string) {
+	fmt.Println(usage)
+	fmt.Print(colorGreen + "('exit' to quit, `/review` to review the diff, `/review findings` for a structured review,\n `/help` for all commands, Tab completes a command) ")
 	fmt.Println(colorCyan + backGroundBlack) // will be the typing colour
 }
 
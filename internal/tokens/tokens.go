@@ -0,0 +1,11 @@
+// Package tokens estimates the size of text in model tokens
+package tokens
+
+// charsPerToken is a rough average for english text and
+// source code with the tokenizers of the current models
+const charsPerToken = 4
+
+// Estimate approximates the number of tokens of the text
+func Estimate(text string) int {
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
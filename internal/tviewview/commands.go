@@ -0,0 +1,150 @@
+package tviewview
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/commands"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/review"
+
+	"github.com/rivo/tview"
+)
+
+// submit sends the text of the textArea to the model,
+// or runs it when it is a slash command
+func (tv *tviewApp) submit() {
+	text := tv.textArea.GetText()
+	if commands.IsCommand(text) {
+		tv.textArea.SetText("", false)
+		tv.runCommand(text)
+		return
+	}
+
+	ctx, ok := tv.startRequest()
+	if !ok {
+		return
+	}
+	tv.appendUserCommandToOutput(text)
+	// Execute model
+	tv.runModelCommand(ctx, text)
+}
+
+// runCommand runs a slash command with the shared runner,
+// the reviews are streamed like a chat message
+func (tv *tviewApp) runCommand(line string) {
+	input, err := commands.Parse(line)
+	if err != nil {
+		tv.appendOutput(tview.Escape(err.Error()) + "\n")
+		return
+	}
+	// commands change the model or its history, which the
+	// running request writes to as well
+	if tv.busy() {
+		return
+	}
+
+	result, err := tv.commands.Run(context.Background(), input)
+	// the runner replaces a model without sessions on /model
+	tv.aimodel = tv.commands.Action
+	if err != nil {
+		tv.appendOutput(tview.Escape(fmt.Sprintf("[%s Error] %v", strings.TrimSpace(line), err)) + "\n")
+		return
+	}
+	if result.Reset {
+		tv.renderHistory(tv.aimodel.GetHistory())
+		tv.countUsage()
+	}
+	if result.Output != "" {
+		renderedResult, _ := tv.mdRenderer.GetRendered(result.Output)
+		tv.appendOutput(tview.TranslateANSI(renderedResult))
+	}
+	if result.Review {
+		tv.review(result.Findings)
+	}
+}
+
+// completeCommand completes the command in the textArea, as far
+// as the completions agree, and shows them when there are more
+func (tv *tviewApp) completeCommand() {
+	completions := tv.commands.Complete(tv.textArea.GetText())
+	if len(completions) == 0 {
+		return
+	}
+	if prefix := commands.CommonPrefix(completions); len(prefix) > len(tv.textArea.GetText()) {
+		tv.textArea.SetText(prefix, true)
+	}
+	if len(completions) > 1 {
+		tv.progressView.SetText(tview.Escape(strings.Join(completions, "  ")))
+	}
+}
+
+// review streams a review of the diff, findings are
+// rendered as markdown when the answer is complete
+func (tv *tviewApp) review(findings bool) {
+	ctx, ok := tv.startRequest()
+	if !ok {
+		return
+	}
+	// a clean tree is not sent to the model
+	noChanges := fmt.Sprintf("No changes found in the %s\n", tv.diffOptions.Describe())
+	if !findings {
+		tv.appendUserCommandToOutput("[ReviewFile] " + tv.diffOptions.Describe())
+		tv.runRequest(ctx, func(ctx context.Context, onChunk func(string)) (string, error) {
+			diff, err := gitdiff.Diff(ctx, tv.diffOptions)
+			if err != nil {
+				return "", fmt.Errorf("[ReviewFile Error] %w", err)
+			}
+			if strings.TrimSpace(diff) == "" {
+				return noChanges, nil
+			}
+			// commands wait for the request, the runner is not shared
+			tv.commands.Instruct(ctx, tv.diffOptions, diff)
+			result, err := tv.aimodel.ReviewFile(ctx, diff, onChunk)
+			if err != nil && !genaimodel.Interrupted(err) {
+				return "", fmt.Errorf("[ReviewFile Error] %w", err)
+			}
+			return result, err
+		})
+		return
+	}
+
+	tv.appendUserCommandToOutput("[ReviewFindings] " + tv.diffOptions.Describe())
+	categories := tv.commands.Prompt.Categories
+	tv.runRequest(ctx, func(ctx context.Context, onChunk func(string)) (string, error) {
+		diff, err := gitdiff.Diff(ctx, tv.diffOptions)
+		if err == nil && strings.TrimSpace(diff) == "" {
+			return noChanges, nil
+		}
+		var findings []review.Finding
+		if err == nil {
+			tv.commands.Instruct(ctx, tv.diffOptions, diff)
+			findings, err = tv.aimodel.ReviewFindings(ctx, diff, categories, onChunk)
+		}
+		if genaimodel.Interrupted(err) {
+			// a partial json answer has no findings to show
+			return "", err
+		}
+		if err != nil {
+			return "", fmt.Errorf("[ReviewFindings Error] %w", err)
+		}
+		return review.RenderMarkdown(findings), nil
+	})
+}
+
+// promptsReloaded tells the user the prompt files changed, the
+// selected prompt is given to the model again when it changed
+func (tv *tviewApp) promptsReloaded() {
+	text := fmt.Sprintf("Prompts reloaded, %d prompts", len(prompts.List()))
+	// a running request keeps the instruction it started with
+	if tv.cancel == nil && tv.commands.Reload() {
+		text += ", updated " + tv.commands.Prompt.Name
+	}
+	if tv.promptsVisible() && tv.prompts.editing == nil {
+		tv.loadPrompts()
+	}
+	tv.progressView.SetText(tview.Escape(text))
+}
@@ -0,0 +1,253 @@
+package tviewview
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/prompts"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	promptListWidth = 44
+	promptsHelp     = "Enter use as system instruction, e edit, Tab scroll the preview, Esc back"
+	editHelp        = "Ctrl+S save the prompt file, Esc cancel"
+)
+
+// promptScreen lists the prompts of the library next to a
+// preview of the highlighted prompt. The promptView of the
+// app replaces the preview while a prompt is edited
+type promptScreen struct {
+	flex    *tview.Flex
+	list    *tview.List
+	preview *tview.TextView
+	// shown are the prompts in the order of the list
+	shown []prompts.Prompt
+	// editing is the prompt in the promptView, it is
+	// nil when no prompt is edited
+	editing *prompts.Prompt
+}
+
+// createPromptScreen creates the screen of the PromptView option
+func (tv *tviewApp) createPromptScreen() {
+	screen := &tv.prompts
+	screen.list = tview.NewList().ShowSecondaryText(true).SetHighlightFullLine(true)
+	// the list calls the func before its current item changes
+	screen.list.SetChangedFunc(func(index int, _ string, _ string, _ rune) {
+		tv.previewPrompt(index)
+	})
+	screen.list.SetInputCapture(tv.promptListKeys)
+
+	screen.preview = tview.NewTextView().SetDynamicColors(true).SetScrollable(true)
+	screen.preview.SetBorder(true).SetTitle(" Preview ")
+	screen.preview.SetDoneFunc(func(tcell.Key) {
+		tv.app.SetFocus(screen.list)
+	})
+
+	tv.promptView = tview.NewTextArea()
+	tv.promptView.SetBorder(true)
+	tv.promptView.SetInputCapture(tv.promptEditKeys)
+
+	screen.list.SetBorder(true).SetTitle(" Prompts ")
+	screen.flex = tview.NewFlex()
+}
+
+// showPrompts replaces the chat with the prompt screen
+func (tv *tviewApp) showPrompts() {
+	screen := &tv.prompts
+	screen.editing = nil
+	screen.flex.Clear().
+		AddItem(screen.list, promptListWidth, 0, true).
+		AddItem(screen.preview, 0, 1, false)
+	tv.flex.Clear().
+		AddItem(screen.flex, 0, 1, true).
+		AddItem(tv.progressView, 1, 0, false)
+	tv.loadPrompts()
+	tv.progressView.SetText(promptsHelp)
+	tv.app.SetFocus(screen.list)
+}
+
+// hidePrompts goes back to the chat
+func (tv *tviewApp) hidePrompts() {
+	tv.prompts.editing = nil
+	tv.SetDefaultView()
+	tv.progressView.SetText("")
+	tv.app.SetFocus(tv.textArea)
+}
+
+// promptsVisible is true while the prompt screen is shown
+func (tv *tviewApp) promptsVisible() bool {
+	return tv.flex.GetItemCount() > 0 && tv.flex.GetItem(0) == tv.prompts.flex
+}
+
+// loadPrompts fills the list from the library, the prompt
+// of the session is marked
+func (tv *tviewApp) loadPrompts() {
+	screen := &tv.prompts
+	selected := screen.list.GetCurrentItem()
+	screen.shown = prompts.List()
+
+	screen.list.Clear()
+	for _, prompt := range screen.shown {
+		title := prompt.Name
+		if prompt.Name == tv.commands.Prompt.Name {
+			title = "* " + title
+		}
+		source := "built-in"
+		if prompt.Source != "" {
+			source = prompt.Source
+		}
+		screen.list.AddItem(title, source, 0, nil)
+	}
+	if selected < screen.list.GetItemCount() {
+		screen.list.SetCurrentItem(selected)
+	}
+	tv.previewPrompt(screen.list.GetCurrentItem())
+}
+
+// promptAt is the prompt of the list item, false
+// when there is no such item
+func (tv *tviewApp) promptAt(index int) (prompts.Prompt, bool) {
+	if index < 0 || index >= len(tv.prompts.shown) {
+		return prompts.Prompt{}, false
+	}
+
+	return tv.prompts.shown[index], true
+}
+
+// selectedPrompt is the highlighted prompt
+func (tv *tviewApp) selectedPrompt() (prompts.Prompt, bool) {
+	return tv.promptAt(tv.prompts.list.GetCurrentItem())
+}
+
+// previewPrompt renders the prompt of the list item with its
+// settings, filled in like the model would get it
+func (tv *tviewApp) previewPrompt(index int) {
+	prompt, ok := tv.promptAt(index)
+	if !ok {
+		tv.prompts.preview.SetText("")
+		return
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "# %s\n\n", prompt.Name)
+	if prompt.Description != "" {
+		fmt.Fprintf(&text, "_%s_\n\n", prompt.Description)
+	}
+	settings := []struct{ name, value string }{
+		{"Model", prompt.Model},
+		{"Format", prompt.Format},
+		{"Tags", strings.Join(prompt.Tags, ", ")},
+		{"Categories", strings.Join(prompt.Categories, ", ")},
+	}
+	for _, setting := range settings {
+		if setting.value != "" {
+			fmt.Fprintf(&text, "* %s: %s\n", setting.name, setting.value)
+		}
+	}
+	text.WriteString("\n---\n\n" + tv.commands.Instruction(prompt))
+
+	rendered, _ := tv.mdRenderer.GetRendered(text.String())
+	// the [Task] words of the prompts are no colour tags
+	tv.prompts.preview.SetText(tview.TranslateANSI(tview.Escape(rendered))).ScrollToBeginning()
+}
+
+func (tv *tviewApp) promptListKeys(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyEnter:
+		tv.usePrompt()
+		return nil
+	case tcell.KeyEscape:
+		tv.hidePrompts()
+		return nil
+	case tcell.KeyTAB:
+		tv.app.SetFocus(tv.prompts.preview)
+		return nil
+	case tcell.KeyRune:
+		if event.Rune() == 'e' {
+			tv.editPrompt()
+			return nil
+		}
+	}
+
+	return event
+}
+
+// usePrompt makes the highlighted prompt the system
+// instruction of the session
+func (tv *tviewApp) usePrompt() {
+	prompt, ok := tv.selectedPrompt()
+	if !ok {
+		return
+	}
+	// the running request keeps the instruction it started with
+	if tv.cancel != nil {
+		tv.progressView.SetText("[yellow]" + tview.Escape("A request is running, use "+prompt.Name+
+			" when it is done or stop it with Ctrl+X"))
+		return
+	}
+	output := tv.commands.Use(prompt)
+	rendered, _ := tv.mdRenderer.GetRendered(output)
+	tv.appendOutput(tview.TranslateANSI(rendered))
+	tv.loadPrompts()
+	tv.progressView.SetText(tview.Escape("Using " + prompt.Name + ", Esc goes back to the chat"))
+}
+
+// editPrompt shows the text of the highlighted
+// prompt in the promptView instead of the preview
+func (tv *tviewApp) editPrompt() {
+	prompt, ok := tv.selectedPrompt()
+	if !ok {
+		return
+	}
+	screen := &tv.prompts
+	screen.editing = &prompt
+	tv.promptView.SetTitle(" Edit " + tview.Escape(prompt.Name) + " ")
+	tv.promptView.SetText(prompt.Prompt, false)
+	screen.flex.RemoveItem(screen.preview).AddItem(tv.promptView, 0, 1, true)
+	tv.progressView.SetText(editHelp)
+	tv.app.SetFocus(tv.promptView)
+}
+
+func (tv *tviewApp) promptEditKeys(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyCtrlS:
+		tv.savePrompt()
+		return nil
+	case tcell.KeyEscape:
+		tv.stopEditing()
+		tv.progressView.SetText(promptsHelp)
+		return nil
+	}
+
+	return event
+}
+
+// savePrompt writes the edited prompt to its prompt file, the
+// session gets the new text when it uses the prompt
+func (tv *tviewApp) savePrompt() {
+	edited := *tv.prompts.editing
+	edited.Prompt = tv.promptView.GetText()
+	saved, err := prompts.Default.Save(edited)
+	if err != nil {
+		tv.progressView.SetText(tview.Escape("[Prompt Error] " + err.Error()))
+		return
+	}
+	text := "Saved " + saved.Source
+	if !tv.busy() && tv.commands.Reload() {
+		text += ", updated the system instruction"
+	}
+	tv.stopEditing()
+	tv.progressView.SetText(tview.Escape(text))
+}
+
+// stopEditing shows the preview again
+func (tv *tviewApp) stopEditing() {
+	screen := &tv.prompts
+	screen.editing = nil
+	screen.flex.RemoveItem(tv.promptView).AddItem(screen.preview, 0, 1, false)
+	tv.loadPrompts()
+	tv.app.SetFocus(screen.list)
+}
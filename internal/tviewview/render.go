@@ -0,0 +1,107 @@
+package tviewview
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// frameRate is the number of times per second a streaming
+// answer is rendered, chunks in between are coalesced
+const frameRate = 15
+
+// transcript is the rendered text of the output view. Finished
+// messages are rendered once and kept as blocks, so that while
+// an answer streams only the active message is rendered again
+type transcript struct {
+	blocks []string
+	joined strings.Builder
+}
+
+// add appends a rendered block
+func (t *transcript) add(block string) {
+	t.blocks = append(t.blocks, block)
+	t.joined.WriteString(block)
+}
+
+// reset removes all blocks
+func (t *transcript) reset() {
+	t.blocks = nil
+	t.joined.Reset()
+}
+
+// text is all blocks joined, without copying them again
+func (t *transcript) text() string {
+	return t.joined.String()
+}
+
+// renderScheduler collects the chunks of a streaming answer and
+// calls render at most once per frame, with the answer so far.
+// Chunks are added from the goroutine of the request, render
+// is called from the goroutine of the scheduler
+type renderScheduler struct {
+	frame  time.Duration
+	render func(progress ModelResponseProgress)
+
+	mu       sync.Mutex
+	progress ModelResponseProgress
+	dirty    bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newRenderScheduler starts rendering, stop it when the answer is complete
+func newRenderScheduler(frame time.Duration, render func(progress ModelResponseProgress)) *renderScheduler {
+	rs := &renderScheduler{
+		frame:   frame,
+		render:  render,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go rs.run()
+
+	return rs
+}
+
+// add is the onChunk callback of the model
+func (rs *renderScheduler) add(chunk string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.progress.progressCount++
+	rs.progress.length += len(chunk)
+	rs.progress.progressString += chunk
+	rs.dirty = true
+}
+
+// stop ends the rendering and returns the progress of the answer.
+// When stop returns render is not running and not called again
+func (rs *renderScheduler) stop() ModelResponseProgress {
+	close(rs.done)
+	<-rs.stopped
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.progress
+}
+
+func (rs *renderScheduler) run() {
+	defer close(rs.stopped)
+	ticker := time.NewTicker(rs.frame)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+			rs.mu.Lock()
+			progress, dirty := rs.progress, rs.dirty
+			rs.dirty = false
+			rs.mu.Unlock()
+			if dirty {
+				rs.render(progress)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package tviewview
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenderSchedulerCoalesces(t *testing.T) {
+	var mu sync.Mutex
+	var renders []ModelResponseProgress
+	stream := newRenderScheduler(20*time.Millisecond, func(progress ModelResponseProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		renders = append(renders, progress)
+	})
+
+	for range 100 {
+		stream.add("word ")
+	}
+	time.Sleep(60 * time.Millisecond)
+	progress := stream.stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(renders) != 1 {
+		t.Fatalf("expected the chunks rendered once, got %d renders", len(renders))
+	}
+	if renders[0].progressCount != 100 || renders[0].progressString != strings.Repeat("word ", 100) {
+		t.Errorf("unexpected render of %d chunks", renders[0].progressCount)
+	}
+	if progress.length != 500 {
+		t.Errorf("unexpected length %d", progress.length)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	var tr transcript
+	tr.add("question\n")
+	tr.add("answer\n")
+	if tr.text() != "question\nanswer\n" || len(tr.blocks) != 2 {
+		t.Errorf("unexpected transcript %q", tr.text())
+	}
+	tr.reset()
+	if tr.text() != "" || len(tr.blocks) != 0 {
+		t.Error("transcript not reset")
+	}
+}
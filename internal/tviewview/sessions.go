@@ -0,0 +1,301 @@
+package tviewview
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/MelleKoning/aifun/internal/commands"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/session"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	sidebarWidth = 44
+	sessionsHelp = "Enter open, Ctrl+R rename, Ctrl+Y copy, Ctrl+D delete, Ctrl+N new, type to filter, Esc back"
+	filterLabel  = "Filter: "
+	renameLabel  = "Rename: "
+	// mainPage holds the root, confirmPage asks
+	// before a session is deleted
+	mainPage     = "main"
+	confirmPage  = "confirm"
+	deleteButton = "Delete"
+	cancelButton = "Cancel"
+)
+
+// sessionBrowser is the sidebar with the saved sessions
+type sessionBrowser struct {
+	flex    *tview.Flex
+	filter  *tview.InputField
+	list    *tview.List
+	visible bool
+	// all holds the sessions of the store, shown the
+	// ones that match the filter, in the order of the list
+	all   []*session.Session
+	shown []*session.Session
+	// renaming is the id of the session that is being
+	// renamed in the filter field, empty when filtering
+	renaming string
+}
+
+// createSessionBrowser creates the sidebar, it is only
+// available when the model saves its sessions
+func (tv *tviewApp) createSessionBrowser() {
+	browser := &tv.browser
+	browser.list = tview.NewList().ShowSecondaryText(true).SetHighlightFullLine(true)
+	browser.list.SetInputCapture(tv.sessionListKeys)
+
+	browser.filter = tview.NewInputField().SetLabel(filterLabel)
+	browser.filter.SetChangedFunc(func(string) {
+		if browser.renaming == "" {
+			tv.filterSessions()
+		}
+	})
+	browser.filter.SetDoneFunc(tv.sessionFilterDone)
+
+	browser.flex = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(browser.filter, 1, 0, false).
+		AddItem(browser.list, 0, 1, true)
+	browser.flex.SetBorder(true).SetTitle(" Sessions ")
+}
+
+// toggleSessions shows or hides the sidebar
+func (tv *tviewApp) toggleSessions() {
+	if tv.sessions == nil {
+		tv.appendOutput("[Sessions] sessions are not saved\n")
+		return
+	}
+
+	browser := &tv.browser
+	browser.visible = !browser.visible
+	tv.root.Clear()
+	if browser.visible {
+		tv.loadSessions()
+		tv.root.AddItem(browser.flex, sidebarWidth, 0, true)
+		tv.progressView.SetText(sessionsHelp)
+	} else {
+		tv.progressView.SetText("")
+	}
+	tv.root.AddItem(tv.flex, 0, 1, !browser.visible)
+
+	if browser.visible {
+		tv.app.SetFocus(browser.list)
+	} else {
+		tv.app.SetFocus(tv.textArea)
+	}
+}
+
+// loadSessions reads the sessions from the store
+func (tv *tviewApp) loadSessions() {
+	sessions, err := tv.sessions.Store().List()
+	if err != nil {
+		tv.appendOutput("[Sessions Error] " + err.Error() + "\n")
+	}
+	tv.browser.all = sessions
+	tv.filterSessions()
+}
+
+// filterSessions shows the sessions of which the title,
+// id or date contain every word of the filter
+func (tv *tviewApp) filterSessions() {
+	browser := &tv.browser
+	words := strings.Fields(strings.ToLower(browser.filter.GetText()))
+	selected := browser.list.GetCurrentItem()
+
+	browser.list.Clear()
+	browser.shown = nil
+	for _, s := range browser.all {
+		date := s.Updated.Local().Format("2006-01-02 15:04")
+		searchText := strings.ToLower(s.Title + " " + s.ID + " " + date)
+		matches := true
+		for _, word := range words {
+			if !strings.Contains(searchText, word) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		title := s.Title
+		if title == "" {
+			title = "(no messages)"
+		}
+		if s.ID == tv.sessions.Current().ID {
+			title = "* " + title
+		}
+		browser.list.AddItem(title, fmt.Sprintf("%s  %d messages", date, len(s.Messages)), 0, nil)
+		browser.shown = append(browser.shown, s)
+	}
+	if selected < browser.list.GetItemCount() {
+		browser.list.SetCurrentItem(selected)
+	}
+}
+
+// selectedSession is the highlighted session, or nil
+func (tv *tviewApp) selectedSession() *session.Session {
+	index := tv.browser.list.GetCurrentItem()
+	if index < 0 || index >= len(tv.browser.shown) {
+		return nil
+	}
+
+	return tv.browser.shown[index]
+}
+
+func (tv *tviewApp) sessionListKeys(event *tcell.EventKey) *tcell.EventKey {
+	browser := &tv.browser
+	switch event.Key() {
+	case tcell.KeyEnter:
+		// a running request would write into the opened session
+		if s := tv.selectedSession(); s != nil && !tv.busy() {
+			tv.openSession(s)
+		}
+		return nil
+	case tcell.KeyEscape:
+		tv.toggleSessions()
+		return nil
+	case tcell.KeyTAB:
+		tv.app.SetFocus(tv.outputView)
+		return nil
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		text := browser.filter.GetText()
+		if text != "" {
+			browser.filter.SetText(text[:len(text)-1])
+		}
+		return nil
+	case tcell.KeyCtrlR:
+		if s := tv.selectedSession(); s != nil && !tv.savingSession(s.ID) {
+			browser.renaming = s.ID
+			browser.filter.SetLabel(renameLabel).SetText(s.Title)
+			tv.app.SetFocus(browser.filter)
+		}
+		return nil
+	case tcell.KeyCtrlY:
+		if s := tv.selectedSession(); s != nil {
+			if _, err := tv.sessions.Store().Duplicate(s.ID); err != nil {
+				log.Println(err)
+			}
+			tv.loadSessions()
+		}
+		return nil
+	case tcell.KeyCtrlD:
+		if s := tv.selectedSession(); s != nil && !tv.busy() {
+			tv.confirmDelete(s)
+		}
+		return nil
+	case tcell.KeyCtrlN:
+		if !tv.busy() {
+			tv.commands.EndSession(context.Background())
+			tv.sessions.Start()
+			tv.clearOutput()
+			tv.loadSessions()
+			tv.countUsage()
+		}
+		return nil
+	case tcell.KeyRune:
+		// typing only filters the list, the actions
+		// have a modifier so they are not typed by accident
+		browser.filter.SetText(browser.filter.GetText() + string(event.Rune()))
+		tv.app.SetFocus(browser.filter)
+		return nil
+	}
+
+	return event
+}
+
+// confirmDelete asks before the session is deleted,
+// Cancel has the focus
+func (tv *tviewApp) confirmDelete(s *session.Session) {
+	title := s.Title
+	if title == "" {
+		title = s.ID
+	}
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("Delete the session %q?", title)).
+		AddButtons([]string{deleteButton, cancelButton}).
+		SetDoneFunc(func(_ int, label string) {
+			tv.pages.RemovePage(confirmPage)
+			if label == deleteButton {
+				tv.deleteSession(s)
+			}
+			tv.app.SetFocus(tv.browser.list)
+		}).
+		SetFocus(1)
+	tv.pages.AddPage(confirmPage, modal, true, true)
+	tv.app.SetFocus(modal)
+}
+
+// deleteSession deletes the session, deleting the
+// current session clears the chat
+func (tv *tviewApp) deleteSession(s *session.Session) {
+	if s.ID == tv.sessions.Current().ID {
+		tv.clearOutput()
+	}
+	if err := tv.sessions.Delete(s.ID); err != nil {
+		log.Println(err)
+	}
+	tv.loadSessions()
+}
+
+// savingSession is true when the session of the id is the
+// current one and a request runs, the request saves it
+func (tv *tviewApp) savingSession(id string) bool {
+	return id == tv.sessions.Current().ID && tv.busy()
+}
+
+// sessionFilterDone ends filtering or renaming. Enter commits
+// a rename, Escape cancels it or clears the filter
+func (tv *tviewApp) sessionFilterDone(key tcell.Key) {
+	browser := &tv.browser
+	if browser.renaming != "" {
+		if key == tcell.KeyEnter && !tv.savingSession(browser.renaming) {
+			title := strings.TrimSpace(browser.filter.GetText())
+			if err := tv.sessions.Rename(browser.renaming, title); err != nil {
+				log.Println(err)
+			}
+		}
+		browser.renaming = ""
+		browser.filter.SetLabel(filterLabel).SetText("")
+		tv.loadSessions()
+	} else if key == tcell.KeyEscape {
+		browser.filter.SetText("")
+	}
+	tv.app.SetFocus(browser.list)
+}
+
+// openSession resumes the session and renders its history
+func (tv *tviewApp) openSession(s *session.Session) {
+	tv.commands.EndSession(context.Background())
+	tv.sessions.Resume(s)
+	// the review format, categories and reloads
+	// follow the prompt of the session
+	tv.commands.Prompt = commands.PromptOf(s)
+	tv.renderHistory(s.History())
+	tv.countUsage()
+	tv.filterSessions()
+	tv.app.SetFocus(tv.outputView)
+}
+
+// renderHistory shows the history of a resumed session
+// in the output view, like it was shown during the chat
+func (tv *tviewApp) renderHistory(history []genaimodel.Message) {
+	tv.transcript.reset()
+	for _, message := range history {
+		if message.Role == genaimodel.RoleUser {
+			txtRendered, err := tv.mdRenderer.FormatUserText(message.Text, "")
+			if err != nil {
+				log.Print(err)
+			}
+			tv.transcript.add(tview.TranslateANSI(txtRendered))
+			continue
+		}
+		renderedResult, _ := tv.mdRenderer.GetRendered(message.Text)
+		tv.transcript.add(tview.TranslateANSI(renderedResult))
+	}
+	tv.showOutput(tv.transcript.text())
+}
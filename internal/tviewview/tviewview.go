@@ -1,10 +1,16 @@
 package tviewview
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"time"
 
+	"github.com/MelleKoning/aifun/internal/commands"
 	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/session"
 	"github.com/MelleKoning/aifun/internal/terminal"
 
 	"github.com/gdamore/tcell/v2"
@@ -12,26 +18,53 @@ import (
 )
 
 type ModelResponseProgress struct {
-	progressCount  int
-	length         int
-	beforeContents string
+	progressCount int
+	length        int
 	// added to for each chunk
 	progressString string
 }
 type tviewApp struct {
-	app          *tview.Application
+	app *tview.Application
+	// root holds the session sidebar and the flex
+	root *tview.Flex
+	// pages shows a confirmation over the root
+	pages        *tview.Pages
 	mdRenderer   terminal.GlamourRenderer // can render markdown colours
 	flex         *tview.Flex
 	textArea     *tview.TextArea
 	dropDown     *tview.DropDown
 	outputView   *tview.TextView
 	submitButton *tview.Button
+	stopButton   *tview.Button
 	progressView *tview.TextView
-	promptView   *tview.TextArea
-	progress     ModelResponseProgress
-	aimodel      genaimodel.Action
+	// promptView edits a prompt of the prompt screen
+	promptView *tview.TextArea
+	browser    sessionBrowser
+	prompts    promptScreen
+	// transcript holds the rendered messages of the outputView
+	transcript transcript
+	aimodel    genaimodel.Action
+	// commands runs the slash commands of the textArea
+	commands    *commands.Runner
+	diffOptions gitdiff.Options
+	// sessions is set when the model saves its sessions
+	sessions *session.Autosave
+	// cancel stops the running request, it is nil when
+	// no request runs. Only used on the UI goroutine
+	cancel context.CancelFunc
+	// usage is the context window the chat used after the
+	// last request. Only used on the UI goroutine
+	usage genaimodel.ContextUsage
 }
 
+const (
+	busyText = "[yellow]Busy, wait for the answer or press Ctrl+X to stop"
+	// reloadInterval is how often the prompt files are checked
+	reloadInterval = 2 * time.Second
+	// countTimeout limits counting tokens on the UI goroutine
+	countTimeout = time.Second
+)
+
 type TviewApp interface {
 	Run() error
 	SetDefaultView()
@@ -42,11 +75,14 @@ type TviewApp interface {
 // to initialize the view container with a default view
 // TODO Expose a good interface for this
 func New(mdrenderer terminal.GlamourRenderer,
-	aimodel genaimodel.Action) TviewApp {
+	runner *commands.Runner, diffOptions gitdiff.Options) TviewApp {
+	aimodel := runner.Action
 	tv := &tviewApp{
-		app:        tview.NewApplication(),
-		mdRenderer: mdrenderer,
-		aimodel:    aimodel,
+		app:         tview.NewApplication(),
+		mdRenderer:  mdrenderer,
+		aimodel:     aimodel,
+		commands:    runner,
+		diffOptions: diffOptions,
 		flex: tview.NewFlex().SetDirection(
 			tview.FlexRow,
 		),
@@ -54,10 +90,39 @@ func New(mdrenderer terminal.GlamourRenderer,
 	tv.createOutputView()
 	tv.createTextArea()
 	tv.createSubmitButton()
+	tv.createStopButton()
 	tv.createDropDown()
 	tv.createProgressView()
+	tv.createSessionBrowser()
+	tv.createPromptScreen()
+	if autosave, ok := aimodel.(*session.Autosave); ok {
+		tv.sessions = autosave
+		tv.renderHistory(autosave.GetHistory())
+	}
 	tv.SetDefaultView()
-	tv.app.SetRoot(tv.flex, true)
+	tv.countUsage()
+	tv.root = tview.NewFlex().AddItem(tv.flex, 0, 1, true)
+	tv.pages = tview.NewPages().AddPage(mainPage, tv.root, true, true)
+	tv.app.SetRoot(tv.pages, true)
+	tv.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyCtrlO:
+			// toggles the session sidebar from everywhere, except
+			// while a confirmation is shown. The text area has no
+			// use for Ctrl+O, Ctrl+B is its page up
+			if !tv.pages.HasPage(confirmPage) {
+				tv.toggleSessions()
+			}
+			return nil
+		case tcell.KeyCtrlX:
+			// without a request the text area cuts the selection
+			if tv.cancel != nil {
+				tv.stopRequest()
+				return nil
+			}
+		}
+		return event
+	})
 
 	return tv
 }
@@ -67,32 +132,85 @@ func (tv *tviewApp) createProgressView() {
 		SetText("").SetDynamicColors(true)
 	//.SetChangedFunc(func() {
 	// redraw when text changes
-	// see onChunkReceived
+	// see renderProgress
 	//tv.app.Draw()
 	//})
 	tv.progressView.SetBorder(false)
 
 }
 
-func (tv *tviewApp) onChunkReceived(str string) {
-
-	tv.progress.progressCount++
-	tv.progress.length += len(str)
-
-	// keep track of the progress,
-	// progress is reset in handleModelResult
-	tv.progress.progressString += str
-	renderedResult, _ := tv.mdRenderer.GetRendered(tv.progress.progressString)
+// renderProgress is called by the renderScheduler once per
+// frame, only the active answer is rendered, the finished
+// messages come from the transcript
+func (tv *tviewApp) renderProgress(progress ModelResponseProgress) {
+	renderedResult, _ := tv.mdRenderer.GetRendered(progress.progressString)
 	txtRendered := tview.TranslateANSI(renderedResult)
 
 	tv.app.QueueUpdateDraw(func() {
-		tv.progressView.SetText(fmt.Sprintf("Progress: %d/%d", tv.progress.progressCount, tv.progress.length))
-		tv.outputView.SetText(tv.progress.beforeContents + txtRendered)
+		tv.showProgress(progress)
+		tv.showOutput(tv.transcript.text() + txtRendered)
 	})
+}
+
+func (tv *tviewApp) showProgress(progress ModelResponseProgress) {
+	text := fmt.Sprintf("Progress: %d/%d  %s", progress.progressCount, progress.length, tv.usage)
+	if tv.usage.NearlyFull() {
+		text = "[yellow]" + text
+	}
+	tv.progressView.SetText(text)
+}
+
+// countUsage counts the context usage of the chat after its
+// history was replaced. Gemini counts the tokens of messages it
+// has not seen with a request, the messages that are not counted
+// within the countTimeout are estimated
+func (tv *tviewApp) countUsage() {
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+	tv.usage = tv.aimodel.ContextUsage(ctx)
+	tv.showUsage()
+}
 
+// showUsage shows the context usage, unless the
+// progressView shows the help of another screen
+func (tv *tviewApp) showUsage() {
+	if tv.browser.visible || tv.promptsVisible() {
+		return
+	}
+	text := tview.Escape(tv.usage.String())
+	if tv.usage.NearlyFull() {
+		text = "[yellow]" + text
+	}
+	tv.progressView.SetText(text)
+}
+
+// appendOutput adds a rendered message to the outputView
+func (tv *tviewApp) appendOutput(block string) {
+	tv.transcript.add(block)
+	tv.showOutput(tv.transcript.text())
+}
+
+// clearOutput removes all messages from the outputView
+func (tv *tviewApp) clearOutput() {
+	tv.transcript.reset()
+	tv.showOutput("")
+}
+
+// showOutput sets the text of the outputView and scrolls to
+// the end. Scrolling is done here and not in a changed func,
+// tview runs that in its own goroutine while drawing
+func (tv *tviewApp) showOutput(text string) {
+	tv.outputView.SetText(text)
+	tv.outputView.ScrollToEnd()
 }
 
 func (tv *tviewApp) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go prompts.Default.Watch(ctx, reloadInterval, func() {
+		tv.app.QueueUpdateDraw(tv.promptsReloaded)
+	})
+
 	err := tv.app.Run()
 	if err != nil {
 		return err
@@ -107,13 +225,11 @@ func (tv *tviewApp) createOutputView() {
 		SetDynamicColors(true).
 		SetScrollable(true).
 		SetSize(0, 0).
-		SetChangedFunc(func() {
-			tv.outputView.ScrollToEnd()
-		}).SetDoneFunc(func(key tcell.Key) {
-		if key == tcell.KeyTAB {
-			tv.app.SetFocus(tv.dropDown)
-		}
-	})
+		SetDoneFunc(func(key tcell.Key) {
+			if key == tcell.KeyTAB {
+				tv.app.SetFocus(tv.dropDown)
+			}
+		})
 
 	tv.outputView.SetBorder(true).SetBackgroundColor(tcell.ColorBlack)
 }
@@ -121,19 +237,32 @@ func (tv *tviewApp) createOutputView() {
 func (tv *tviewApp) createTextArea() {
 	// Create an input field for user input
 	tv.textArea = tview.NewTextArea().
-		SetLabel("Enter command: ")
+		SetLabel("Enter command: ").
+		SetPlaceholder("Type a message, or / for the commands")
 	tv.textArea.SetBorder(true)
 	// Capture key events for the text area
 	tv.textArea.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		isCommand := commands.IsCommand(tv.textArea.GetText())
 		if event.Key() == tcell.KeyTAB {
+			if isCommand {
+				tv.completeCommand()
+				return nil
+			}
 			tv.app.SetFocus(tv.submitButton) // Move focus to the submit button
 			return nil                       // Consume the event
 		}
-		if event.Key() == tcell.KeyEnter {
-			return event // nil // Consume other events - do nothing!
+		if event.Key() == tcell.KeyEnter && isCommand {
+			// commands are a single line, Enter runs them
+			tv.submit()
+			return nil
 		}
 		return event
 	})
+	tv.textArea.SetChangedFunc(func() {
+		if hint := commands.Hint(tv.textArea.GetText()); hint != "" {
+			tv.progressView.SetText(tview.Escape(hint))
+		}
+	})
 
 	// we have to enable pasting for the user
 	// for the whole app so that user can
@@ -143,27 +272,75 @@ func (tv *tviewApp) createTextArea() {
 
 func (tv *tviewApp) appendUserCommandToOutput(command string) {
 	tv.app.SetFocus(tv.progressView) // remove highlight from button
-	txtRendered, err := tv.mdRenderer.FormatUserText(command,
-		tv.aimodel.GetHistoryLength())
+	txtRendered, err := tv.mdRenderer.FormatUserText(command, tv.usage.String())
 	if err != nil {
 		log.Print(err)
 	}
-	txtRendered = tview.TranslateANSI(txtRendered)
-	tv.outputView.SetText(tv.outputView.GetText(false) + txtRendered)
+	tv.appendOutput(tview.TranslateANSI(txtRendered))
+}
+
+func (tv *tviewApp) runModelCommand(ctx context.Context, command string) {
+	tv.runRequest(ctx, func(ctx context.Context, onChunk func(string)) (string, error) {
+		// the callback updates the outputview for intermediate results
+		return tv.aimodel.ChatMessage(ctx, command, onChunk)
+	})
+}
+
+// startRequest returns the context for a new request to the
+// model. It is false, and tells the user, while another
+// request runs, so requests never overlap
+func (tv *tviewApp) startRequest() (context.Context, bool) {
+	if tv.busy() {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tv.cancel = cancel
+
+	return ctx, true
+}
+
+// busy is true while a request runs, it tells the user
+// to wait or to stop the request
+func (tv *tviewApp) busy() bool {
+	if tv.cancel == nil {
+		return false
+	}
+	tv.progressView.SetText(busyText)
+
+	return true
+}
+
+// stopRequest cancels the running request, the request
+// itself ends and shows the partial answer
+func (tv *tviewApp) stopRequest() {
+	if tv.cancel != nil {
+		tv.cancel()
+	}
 }
 
-func (tv *tviewApp) runModelCommand(command string) {
+// runRequest runs the request in the background with the
+// context of startRequest, and shows the result when done.
+// The chunks of onChunk are rendered at the frameRate
+func (tv *tviewApp) runRequest(ctx context.Context,
+	request func(ctx context.Context, onChunk func(string)) (string, error)) {
+	// the monthly budget is checked before anything is sent
+	if warning := tv.commands.Warning(); warning != "" {
+		tv.appendOutput("[yellow]" + warning + "[-]")
+	}
+	stream := newRenderScheduler(time.Second/frameRate, tv.renderProgress)
 	go func() {
-		// remember the original contents of the output view
-		tv.progress.beforeContents = tv.outputView.GetText(false)
-		// the callback -can- update the outputview for intermediate results
-		result, chatErr := tv.aimodel.ChatMessage(command, tv.onChunkReceived)
+		result, err := request(ctx, stream.add)
+		progress := stream.stop()
+		usage := tv.aimodel.ContextUsage(context.Background())
 		// as we run in an async routine we have
 		// to use the QueueUpdateDraw for all following
 		// UI updates
 		tv.app.QueueUpdateDraw(func() {
-			tv.outputView.SetText(tv.progress.beforeContents) // reset back
-			tv.handleModelResult(result, chatErr)
+			tv.cancel()
+			tv.cancel = nil
+			tv.usage = usage
+			tv.showProgress(progress)
+			tv.handleModelResult(result, err)
 		})
 	}()
 }
@@ -173,35 +350,48 @@ func (tv *tviewApp) runModelCommand(command string) {
 // we can safely write to all the UI elements because
 // this func is already called from QueueUpdateDraw
 func (tv *tviewApp) handleModelResult(result string, chatErr error) {
-	if chatErr != nil {
-		tv.outputView.SetText(tv.outputView.GetText(false) + chatErr.Error())
-	} else {
+	switch {
+	case genaimodel.Interrupted(chatErr):
+		// the partial answer is kept, like in the history
+		renderedResult, _ := tv.mdRenderer.GetRendered(result + genaimodel.InterruptedMarker)
+		tv.appendOutput(tview.TranslateANSI(renderedResult))
+	case chatErr != nil:
+		// a blocked answer may have streamed a part
+		if result != "" {
+			renderedResult, _ := tv.mdRenderer.GetRendered(result)
+			tv.appendOutput(tview.TranslateANSI(renderedResult))
+		}
+		tv.appendOutput("[red]" + tview.Escape(chatErr.Error()) + "[-]")
+	default:
 		renderedResult, _ := tv.mdRenderer.GetRendered(result)
-		txtRendered := tview.TranslateANSI(renderedResult)
-		tv.outputView.SetText(tv.outputView.GetText(false) + txtRendered)
-		// reset the progressview
-		tv.progress = ModelResponseProgress{}
+		tv.appendOutput(tview.TranslateANSI(renderedResult))
 	}
 	tv.app.SetFocus(tv.outputView)
 }
 
 func (tv *tviewApp) createSubmitButton() {
-	tv.submitButton = tview.NewButton("Submit").SetSelectedFunc(
-		func() {
-			command := tv.textArea.GetText()
-			tv.appendUserCommandToOutput(command)
-			// Execute model
-			tv.runModelCommand(command)
-
-		}).
+	tv.submitButton = tview.NewButton("Submit").SetSelectedFunc(tv.submit).
 		SetExitFunc(func(key tcell.Key) {
 			if key == tcell.KeyTAB {
-				tv.app.SetFocus(tv.outputView)
+				tv.app.SetFocus(tv.stopButton)
 			}
 		},
 		)
 }
 
+// createStopButton creates the button that cancels the
+// running request, Ctrl+X does the same everywhere while
+// a request runs
+func (tv *tviewApp) createStopButton() {
+	tv.stopButton = tview.NewButton("Stop (Ctrl+X)").
+		SetSelectedFunc(tv.stopRequest).
+		SetExitFunc(func(key tcell.Key) {
+			if key == tcell.KeyTAB {
+				tv.app.SetFocus(tv.outputView)
+			}
+		})
+}
+
 // we create a dropdown, but it should be fed with
 // some model data instead of hardcoded static data
 func (tv *tviewApp) createDropDown() {
@@ -211,8 +401,10 @@ func (tv *tviewApp) createDropDown() {
 		SetOptions([]string{
 			"Continue",
 			"ReviewFile",
+			"ReviewFindings",
 			"OutputView",
 			"PromptView",
+			"Sessions",
 			"SystemPrompt",
 			"Exit"}, func(option string, index int) {
 			switch option {
@@ -221,37 +413,20 @@ func (tv *tviewApp) createDropDown() {
 			case "OutputView":
 				tv.SetDefaultView()
 			case "PromptView":
-				// TODO: move switching of view
-				// to a function
-				tv.flex.RemoveItem(tv.outputView)
-				tv.flex.AddItem(tv.promptView, 0, 10, true)
+				tv.showPrompts()
+			case "Sessions":
+				tv.toggleSessions()
 			case "SystemPrompt":
-				response := tv.aimodel.SendSystemPrompt()
-				renderedResult, _ := tv.mdRenderer.GetRendered(response)
-				txtRendered := tview.TranslateANSI(renderedResult)
-				tv.outputView.SetText(tv.outputView.GetText(false) + txtRendered)
+				tv.introduce()
 			case "ReviewFile":
-				// Prompt user for file path (simple version: use textArea input)
-				filePath := "gitdiff.txt"
-				tv.appendUserCommandToOutput("[ReviewFile] " + filePath)
-				go func() {
-					result, err := tv.aimodel.ReviewFile(tv.onChunkReceived)
-					tv.app.QueueUpdateDraw(func() {
-						if err != nil {
-							tv.outputView.SetText(tv.outputView.GetText(false) + "[ReviewFile Error] " + err.Error())
-						} else {
-							renderedResult, _ := tv.mdRenderer.GetRendered(result)
-							txtRendered := tview.TranslateANSI(renderedResult)
-							tv.outputView.SetText(tv.outputView.GetText(false) + txtRendered)
-						}
-						tv.app.SetFocus(tv.outputView)
-					})
-				}()
+				tv.runCommand(commands.Prefix + commands.Review)
+			case "ReviewFindings":
+				tv.runCommand(commands.Prefix + commands.Review + " findings")
 			}
 			if option == "Exit" {
 				tv.app.Stop()
 			}
-			tv.outputView.SetText(tv.outputView.GetText(false) + option)
+			tv.appendOutput(option)
 		}).SetDoneFunc(func(key tcell.Key) {
 		if key == tcell.KeyTAB {
 			tv.app.SetFocus(tv.textArea)
@@ -259,13 +434,26 @@ func (tv *tviewApp) createDropDown() {
 	})
 }
 
+// introduce asks the model to introduce itself, in the
+// background like a chat message so Ctrl+X stops it
+func (tv *tviewApp) introduce() {
+	ctx, ok := tv.startRequest()
+	if !ok {
+		return
+	}
+	tv.runRequest(ctx, func(ctx context.Context, _ func(string)) (string, error) {
+		return tv.aimodel.SendSystemPrompt(ctx)
+	})
+}
+
 // SetDefaultView will set the default view
 // of the tviewApp
 func (tv *tviewApp) SetDefaultView() {
 	tv.flex.Clear()
 	buttonRow := tview.NewFlex().
 		AddItem(tv.submitButton, 0, 1, false).
-		AddItem(tv.progressView, 0, 1, false)
+		AddItem(tv.stopButton, 0, 1, false).
+		AddItem(tv.progressView, 0, 2, false)
 	tv.flex.
 		SetDirection(tview.FlexRow).
 		AddItem(tv.outputView, 0, 10, true).
@@ -0,0 +1,433 @@
+package tviewview
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/commands"
+	"github.com/MelleKoning/aifun/internal/fakemodel"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+	"github.com/MelleKoning/aifun/internal/gitdiff"
+	"github.com/MelleKoning/aifun/internal/prompts"
+	"github.com/MelleKoning/aifun/internal/session"
+	"github.com/MelleKoning/aifun/internal/terminal"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// newTestApp runs the app on a simulation screen, so
+// that queued updates of the callbacks are executed
+func newTestApp(t *testing.T, fake genaimodel.Action) *tviewApp {
+	t.Helper()
+	mdRenderer, err := terminal.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tv := New(mdRenderer, commands.NewRunner(fake, prompts.Prompt{}), gitdiff.DefaultOptions()).(*tviewApp)
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.SetSize(120, 40)
+	tv.app.SetScreen(screen)
+
+	done := make(chan error)
+	go func() {
+		done <- tv.Run()
+	}()
+	t.Cleanup(func() {
+		tv.app.Stop()
+		<-done
+	})
+
+	return tv
+}
+
+// waitIdle waits until the running request is done
+// and returns the text of the output view
+func waitIdle(t *testing.T, tv *tviewApp) string {
+	t.Helper()
+	for range 200 {
+		var busy bool
+		var output string
+		tv.app.QueueUpdate(func() {
+			busy = tv.cancel != nil
+			output = tv.outputView.GetText(true)
+		})
+		if !busy {
+			return output
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the request did not finish")
+
+	return ""
+}
+
+// startChat starts a chat request like the submit button
+func startChat(t *testing.T, tv *tviewApp, command string) {
+	t.Helper()
+	started := make(chan bool, 1)
+	tv.app.QueueUpdate(func() {
+		ctx, ok := tv.startRequest()
+		if ok {
+			tv.appendUserCommandToOutput(command)
+			tv.runModelCommand(ctx, command)
+		}
+		started <- ok
+	})
+	if !<-started {
+		t.Fatal("request not started")
+	}
+}
+
+func TestChatFlow(t *testing.T) {
+	fake := fakemodel.New("The answer is **42**")
+	tv := newTestApp(t, fake)
+
+	startChat(t, tv, "what is the answer?")
+	output := waitIdle(t, tv)
+	if !strings.Contains(output, "what is the answer?") || !strings.Contains(output, "42") {
+		t.Errorf("unexpected output %q", output)
+	}
+	var progress string
+	tv.app.QueueUpdate(func() {
+		progress = tv.progressView.GetText(true)
+	})
+	if !strings.HasPrefix(progress, "Progress: 4/") || !strings.Contains(progress, "Context: 10 tokens") {
+		t.Errorf("expected 4 chunks and the context usage, got %q", progress)
+	}
+	if fake.GetHistoryLength() != 2 || len(tv.transcript.blocks) != 2 {
+		t.Errorf("expected history of 2, got %d and %d blocks",
+			fake.GetHistoryLength(), len(tv.transcript.blocks))
+	}
+}
+
+func TestIntroduce(t *testing.T) {
+	fake := fakemodel.New("I review **diffs**")
+	tv := newTestApp(t, fake)
+
+	// the dropdown starts the request, the answer comes later
+	tv.app.QueueUpdate(func() {
+		tv.dropDown.SetCurrentOption(6)
+	})
+	output := waitIdle(t, tv)
+	if !strings.Contains(output, "I review diffs") || len(fake.Prompts) != 1 || fake.Prompts[0] != "SendSystemPrompt" {
+		t.Errorf("the model did not introduce itself: %q %q", output, fake.Prompts)
+	}
+
+	// a stopped introduction is marked, not shown as answer
+	fake.Delay = time.Minute
+	tv.app.QueueUpdate(func() {
+		tv.introduce()
+		tv.stopRequest()
+	})
+	output = waitIdle(t, tv)
+	if !strings.HasSuffix(strings.TrimSpace(output), "[interrupted]") || strings.Contains(output, "canceled") {
+		t.Errorf("expected the introduction marked interrupted, got %q", output)
+	}
+}
+
+func TestReviewWithoutChanges(t *testing.T) {
+	fake := fakemodel.New("a review")
+	tv := newTestApp(t, fake)
+	empty := filepath.Join(t.TempDir(), "empty.diff")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, findings := range []bool{false, true} {
+		tv.app.QueueUpdate(func() {
+			tv.diffOptions.DiffFile = empty
+			tv.review(findings)
+		})
+		output := waitIdle(t, tv)
+		if !strings.Contains(output, "No changes found") || len(fake.Prompts) != 0 {
+			t.Errorf("an empty diff was sent to the model: %q %q", output, fake.Prompts)
+		}
+	}
+}
+
+func TestSessionBrowser(t *testing.T) {
+	store := &session.Store{Dir: t.TempDir()}
+	saved := session.New("fake", "fake", prompts.PromptList[1].Prompt)
+	saved.Prompt = prompts.PromptList[1].Name
+	saved.SetHistory([]genaimodel.Message{
+		{Role: genaimodel.RoleUser, Text: "how to parse a diff"},
+		{Role: genaimodel.RoleModel, Text: "Use **diffparse**"},
+	})
+	other := session.New("fake", "fake", "be brief")
+	other.SetHistory([]genaimodel.Message{{Role: genaimodel.RoleUser, Text: "weather report"}})
+	for _, s := range []*session.Session{saved, other} {
+		if err := store.Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := fakemodel.New()
+	autosave := session.NewAutosave(fake, store, session.New("fake", "fake", ""))
+	tv := newTestApp(t, autosave)
+	key := func(r rune) {
+		tv.sessionListKeys(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	ctrl := func(k tcell.Key) {
+		tv.sessionListKeys(tcell.NewEventKey(k, 0, tcell.ModCtrl))
+	}
+
+	var titles []string
+	var pageUp bool
+	tv.app.QueueUpdateDraw(func() {
+		// Ctrl+B stays page up of the text area
+		pageUp = tv.app.GetInputCapture()(tcell.NewEventKey(tcell.KeyCtrlB, 0, tcell.ModCtrl)) != nil
+		tv.app.GetInputCapture()(tcell.NewEventKey(tcell.KeyCtrlO, 0, tcell.ModCtrl))
+		// typing filters the list, also the letters of actions
+		key('p')
+		key('a')
+		key('r')
+		for i := 0; i < tv.browser.list.GetItemCount(); i++ {
+			title, _ := tv.browser.list.GetItemText(i)
+			titles = append(titles, title)
+		}
+	})
+	if !pageUp || len(titles) != 1 || titles[0] != "how to parse a diff" {
+		t.Fatalf("unexpected filtered sessions %v", titles)
+	}
+
+	var output string
+	tv.app.QueueUpdateDraw(func() {
+		tv.sessionListKeys(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+		output = tv.outputView.GetText(true)
+	})
+	if !strings.Contains(output, "how to parse a diff") || !strings.Contains(output, "diffparse") {
+		t.Errorf("history not rendered: %q", output)
+	}
+	if fake.GetHistoryLength() != 2 || autosave.Current().ID != saved.ID ||
+		tv.commands.Prompt.Name != prompts.PromptList[1].Name {
+		t.Error("session not resumed with its prompt")
+	}
+
+	tv.app.QueueUpdateDraw(func() {
+		tv.sessionFilterDone(tcell.KeyEscape)
+		for i, s := range tv.browser.shown {
+			if s.ID == other.ID {
+				tv.browser.list.SetCurrentItem(i)
+			}
+		}
+		ctrl(tcell.KeyCtrlR)
+		tv.browser.filter.SetText("renamed")
+		tv.sessionFilterDone(tcell.KeyEnter)
+		ctrl(tcell.KeyCtrlY)
+	})
+	renamed, err := store.Load(other.ID)
+	if err != nil || renamed.Title != "renamed" {
+		t.Errorf("session not renamed: %v %v", renamed, err)
+	}
+	sessions, _ := store.List()
+	if len(sessions) != 3 {
+		t.Fatalf("expected a copy, got %d sessions", len(sessions))
+	}
+
+	// a delete is confirmed, Cancel has the focus
+	var asking bool
+	confirm := func(keys ...tcell.Key) {
+		tv.app.QueueUpdateDraw(func() {
+			tv.browser.list.SetCurrentItem(0)
+			ctrl(tcell.KeyCtrlD)
+			_, modal := tv.pages.GetFrontPage()
+			for _, k := range keys {
+				modal.InputHandler()(tcell.NewEventKey(k, 0, tcell.ModNone), func(p tview.Primitive) {
+					tv.app.SetFocus(p)
+				})
+			}
+			asking = tv.pages.HasPage(confirmPage)
+		})
+	}
+	confirm(tcell.KeyEnter)
+	if sessions, _ = store.List(); len(sessions) != 3 || asking {
+		t.Errorf("expected Cancel to keep the sessions, got %d", len(sessions))
+	}
+	confirm(tcell.KeyLeft, tcell.KeyEnter)
+	if sessions, _ = store.List(); len(sessions) != 2 {
+		t.Errorf("expected a session to be deleted, got %d", len(sessions))
+	}
+}
+
+func TestRenameWhileBusy(t *testing.T) {
+	fake := fakemodel.New("a long answer")
+	fake.Delay = time.Minute
+	autosave := session.NewAutosave(fake, &session.Store{Dir: t.TempDir()}, session.New("fake", "fake", ""))
+	tv := newTestApp(t, autosave)
+
+	// the request saves the current session when it is done
+	startChat(t, tv, "question")
+	var title string
+	tv.app.QueueUpdateDraw(func() {
+		tv.browser.renaming = autosave.Current().ID
+		tv.browser.filter.SetText("renamed")
+		tv.sessionFilterDone(tcell.KeyEnter)
+		title = autosave.Current().Title
+		tv.stopRequest()
+	})
+	waitIdle(t, tv)
+	if title == "renamed" {
+		t.Error("the current session was renamed while a request runs")
+	}
+}
+
+func TestStopRequest(t *testing.T) {
+	fake := fakemodel.New("first\nsecond\nthird\nfourth")
+	fake.Delay = 50 * time.Millisecond
+	tv := newTestApp(t, fake)
+
+	startChat(t, tv, "count")
+	var blocked bool
+	tv.app.QueueUpdateDraw(func() {
+		_, ok := tv.startRequest()
+		blocked = !ok && strings.Contains(tv.progressView.GetText(true), "Busy")
+		tv.stopRequest()
+	})
+	if !blocked {
+		t.Error("an overlapping request was not blocked")
+	}
+
+	output := waitIdle(t, tv)
+	if !strings.Contains(output, "interrupted") || strings.Contains(output, "fourth") {
+		t.Errorf("expected the partial answer marked interrupted, got %q", output)
+	}
+	if history := fake.GetHistory(); len(history) != 2 ||
+		!strings.HasSuffix(history[1].Text, genaimodel.InterruptedMarker) {
+		t.Errorf("interrupted answer not in the history: %+v", history)
+	}
+
+	// without a request Ctrl+X cuts in the text area
+	var passed bool
+	tv.app.QueueUpdate(func() {
+		passed = tv.app.GetInputCapture()(tcell.NewEventKey(tcell.KeyCtrlX, 0, tcell.ModCtrl)) != nil
+	})
+	if !passed {
+		t.Error("Ctrl+X was taken from the text area")
+	}
+}
+
+func TestSlashCommands(t *testing.T) {
+	fake := fakemodel.New("an answer")
+	tv := newTestApp(t, fake)
+	key := func(key tcell.Key) {
+		handler := tv.textArea.InputHandler()
+		if capture := tv.textArea.GetInputCapture(); capture != nil {
+			if capture(tcell.NewEventKey(key, 0, tcell.ModNone)) == nil {
+				return
+			}
+		}
+		handler(tcell.NewEventKey(key, 0, tcell.ModNone), func(tview.Primitive) {})
+	}
+
+	var text, hint string
+	tv.app.QueueUpdateDraw(func() {
+		tv.textArea.SetText("/pro", true)
+		hint = tv.progressView.GetText(true)
+		key(tcell.KeyTAB)
+		text = tv.textArea.GetText()
+	})
+	if text != "/prompt " || !strings.HasPrefix(hint, "/prompt [name or number]") {
+		t.Errorf("unexpected completion %q with hint %q", text, hint)
+	}
+
+	var output string
+	tv.app.QueueUpdateDraw(func() {
+		tv.textArea.SetText("/prompt 1", true)
+		key(tcell.KeyEnter)
+		text = tv.textArea.GetText()
+		output = tv.outputView.GetText(true)
+	})
+	if text != "" || !strings.Contains(output, prompts.PromptList[0].Name) ||
+		fake.SystemInstruction != prompts.PromptList[0].Instruction(prompts.Vars{}) {
+		t.Errorf("prompt command not run, output %q", output)
+	}
+
+	startChat(t, tv, "question")
+	waitIdle(t, tv)
+	tv.app.QueueUpdateDraw(func() {
+		tv.textArea.SetText("/clear", true)
+		tv.submit()
+		output = tv.outputView.GetText(true)
+	})
+	if fake.GetHistoryLength() != 0 || strings.Contains(output, "an answer") {
+		t.Errorf("history not cleared, output %q", output)
+	}
+}
+
+func TestPromptScreen(t *testing.T) {
+	defer func(library *prompts.Library) { prompts.Default = library }(prompts.Default)
+	dir := t.TempDir()
+	prompts.Default = prompts.NewLibrary(dir)
+	fake := fakemodel.New()
+	tv := newTestApp(t, fake)
+	listKey := func(event *tcell.EventKey) {
+		tv.prompts.list.GetInputCapture()(event)
+	}
+
+	var count int
+	var preview string
+	tv.app.QueueUpdateDraw(func() {
+		tv.showPrompts()
+		tv.prompts.list.SetCurrentItem(1)
+		count = tv.prompts.list.GetItemCount()
+		preview = tv.prompts.preview.GetText(true)
+		listKey(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+	})
+	if count != len(prompts.PromptList) || !strings.Contains(preview, prompts.PromptList[1].Name) {
+		t.Errorf("unexpected list of %d prompts, preview %q", count, preview)
+	}
+	if fake.SystemInstruction != prompts.PromptList[1].Prompt || tv.commands.Prompt.Name != prompts.PromptList[1].Name {
+		t.Error("prompt not used as system instruction")
+	}
+
+	var editing string
+	tv.app.QueueUpdateDraw(func() {
+		listKey(tcell.NewEventKey(tcell.KeyRune, 'e', tcell.ModNone))
+		editing = tv.promptView.GetText()
+		tv.promptView.SetText("Only the top suggestion.", false)
+		tv.promptView.GetInputCapture()(tcell.NewEventKey(tcell.KeyCtrlS, 0, tcell.ModNone))
+	})
+	if editing != prompts.PromptList[1].Prompt {
+		t.Errorf("the prompt is not edited: %q", editing)
+	}
+	if fake.SystemInstruction != "Only the top suggestion." {
+		t.Errorf("the edited prompt is not used: %q", fake.SystemInstruction)
+	}
+	if saved, ok := prompts.Find(prompts.PromptList[1].Name); !ok || saved.Source == "" {
+		t.Errorf("the prompt file is not saved: %+v", saved)
+	}
+
+	var visible bool
+	tv.app.QueueUpdateDraw(func() {
+		listKey(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+		visible = tv.promptsVisible()
+	})
+	if visible {
+		t.Error("Escape should go back to the chat")
+	}
+}
+
+func TestUsePromptWhileBusy(t *testing.T) {
+	fake := fakemodel.New("a long answer")
+	fake.Delay = time.Minute
+	tv := newTestApp(t, fake)
+
+	startChat(t, tv, "question")
+	var progress string
+	tv.app.QueueUpdateDraw(func() {
+		tv.showPrompts()
+		tv.prompts.list.SetCurrentItem(1)
+		tv.prompts.list.GetInputCapture()(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+		progress = tv.progressView.GetText(true)
+		tv.stopRequest()
+	})
+	waitIdle(t, tv)
+	if !strings.Contains(progress, "A request is running") || tv.commands.Prompt.Name != "" {
+		t.Errorf("expected the prompt not used with a message, got %q", progress)
+	}
+}
@@ -0,0 +1,295 @@
+// Package usage records the tokens of every request to a model
+// in a json lines file, so the costs can be reported by day,
+// session and prompt and checked against a monthly budget
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/config"
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+const (
+	fileName = "usage.jsonl"
+	// warnAt is the percentage of the monthly budget from
+	// where a request gives a warning
+	warnAt = 80
+)
+
+// Ways to group a report
+const (
+	ByDay     = "day"
+	BySession = "session"
+	ByPrompt  = "prompt"
+	ByModel   = "model"
+)
+
+// Groups lists the ways to group a report
+var Groups = []string{ByDay, BySession, ByPrompt, ByModel}
+
+// DefaultPrices are the prices of the gemini api in dollars per
+// million tokens, for prompts up to 200k tokens. Local models
+// have no price and cost nothing
+var DefaultPrices = map[string]genaimodel.Price{
+	"gemini-2.0-flash":      {Input: 0.10, CachedInput: 0.025, Output: 0.40},
+	"gemini-2.0-flash-lite": {Input: 0.075, CachedInput: 0.075, Output: 0.30},
+	"gemini-2.5-flash":      {Input: 0.30, CachedInput: 0.075, Output: 2.50},
+	"gemini-2.5-flash-lite": {Input: 0.10, CachedInput: 0.025, Output: 0.40},
+	"gemini-2.5-pro":        {Input: 1.25, CachedInput: 0.31, Output: 10.00},
+}
+
+// Labels tell what a request was for
+type Labels struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Session  string `json:"session,omitempty"`
+	Prompt   string `json:"prompt,omitempty"`
+}
+
+// Record is the usage of a single request
+type Record struct {
+	Time time.Time `json:"time"`
+	Labels
+	genaimodel.Usage
+}
+
+// Store appends the records to a file
+type Store struct {
+	Path string
+}
+
+// DefaultStore keeps the records in ~/.aifun/usage.jsonl
+func DefaultStore() (*Store, error) {
+	userDir, err := config.UserDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{Path: filepath.Join(userDir, fileName)}, nil
+}
+
+// Add appends the record as a line to the file
+func (st *Store) Add(record Record) error {
+	err := os.MkdirAll(filepath.Dir(st.Path), 0o700)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(st.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+
+	return errors.Join(err, file.Close())
+}
+
+// Load reads the records from the time on, the oldest
+// first. Lines that can not be read are logged and skipped
+func (st *Store) Load(since time.Time) ([]Record, error) {
+	file, err := os.Open(st.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("%s line %d: %v", st.Path, number, err)
+			continue
+		}
+		if !record.Time.Before(since) {
+			records = append(records, record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// Prices are the prices of the models by name
+type Prices map[string]genaimodel.Price
+
+// NewPrices are the default prices with the
+// configured prices added or replaced
+func NewPrices(configured map[string]genaimodel.Price) Prices {
+	prices := Prices{}
+	for model, price := range DefaultPrices {
+		prices[model] = price
+	}
+	for model, price := range configured {
+		prices[model] = price
+	}
+
+	return prices
+}
+
+// Find takes the price of the longest model name that the model
+// starts with, so "gemini-2.5-flash-preview-05-20" costs the
+// same as "gemini-2.5-flash"
+func (p Prices) Find(model string) (genaimodel.Price, bool) {
+	found := ""
+	for name := range p {
+		if strings.HasPrefix(model, name) && len(name) > len(found) {
+			found = name
+		}
+	}
+	if found == "" {
+		return genaimodel.Price{}, false
+	}
+
+	return p[found], true
+}
+
+// Cost of the record in dollars, 0 without price
+func (p Prices) Cost(record Record) float64 {
+	price, _ := p.Find(record.Model)
+
+	return price.Cost(record.Usage)
+}
+
+// Tracker records the usage of the requests and
+// warns when the monthly budget comes near
+type Tracker struct {
+	Store  *Store
+	Prices Prices
+	// Budget is the monthly budget in dollars, 0 is no budget
+	Budget float64
+}
+
+// Open tracks the usage in the default store with
+// the prices and budget of the config
+func Open(cfg config.Config) (*Tracker, error) {
+	store, err := DefaultStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tracker{Store: store, Prices: NewPrices(cfg.Prices), Budget: cfg.MonthlyBudget}, nil
+}
+
+// Record adds the usage of a request with its labels. An
+// error is logged, it does not fail the request
+func (t *Tracker) Record(labels Labels, usage genaimodel.Usage) {
+	err := t.Store.Add(Record{Time: time.Now(), Labels: labels, Usage: usage})
+	if err != nil {
+		log.Printf("recording the token usage: %v", err)
+	}
+}
+
+// Month returns the records of the calendar month of now
+func (t *Tracker) Month(now time.Time) ([]Record, error) {
+	year, month, _ := now.Date()
+
+	return t.Store.Load(time.Date(year, month, 1, 0, 0, 0, 0, now.Location()))
+}
+
+// Warning is the warning to show before a request when the costs of
+// this month reached warnAt percent of the budget, empty otherwise
+func (t *Tracker) Warning() string {
+	if t.Budget <= 0 {
+		return ""
+	}
+	records, err := t.Month(time.Now())
+	if err != nil {
+		log.Printf("reading the token usage: %v", err)
+		return ""
+	}
+	spent := 0.0
+	for _, record := range records {
+		spent += t.Prices.Cost(record)
+	}
+	switch {
+	case spent >= t.Budget:
+		return fmt.Sprintf("Over the monthly budget: spent $%.2f of $%.2f this month", spent, t.Budget)
+	case spent*100 >= t.Budget*warnAt:
+		return fmt.Sprintf("Nearly at the monthly budget: spent $%.2f of $%.2f this month", spent, t.Budget)
+	}
+
+	return ""
+}
+
+// Row is the summed usage of a group of requests
+type Row struct {
+	Key      string
+	Requests int
+	genaimodel.Usage
+	Cost float64
+}
+
+// Report sums the records by day, session, prompt or model.
+// The rows are sorted by key, the last row is the total
+func (t *Tracker) Report(records []Record, by string) ([]Row, error) {
+	key, ok := map[string]func(Record) string{
+		ByDay:     func(r Record) string { return r.Time.Local().Format("2006-01-02") },
+		BySession: func(r Record) string { return r.Session },
+		ByPrompt:  func(r Record) string { return r.Prompt },
+		ByModel:   func(r Record) string { return r.Provider + "/" + r.Model },
+	}[by]
+	if !ok {
+		return nil, fmt.Errorf("can not group by %q, use one of: %s", by, strings.Join(Groups, ", "))
+	}
+
+	rows := map[string]*Row{}
+	total := Row{Key: "total"}
+	for _, record := range records {
+		name := key(record)
+		if name == "" {
+			name = "-"
+		}
+		if rows[name] == nil {
+			rows[name] = &Row{Key: name}
+		}
+		cost := t.Prices.Cost(record)
+		for _, row := range []*Row{rows[name], &total} {
+			row.Requests++
+			row.InputTokens += record.InputTokens
+			row.CachedTokens += record.CachedTokens
+			row.OutputTokens += record.OutputTokens
+			row.Cost += cost
+		}
+	}
+
+	result := make([]Row, 0, len(rows)+1)
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+
+	return append(result, total), nil
+}
+
+// Markdown shows the rows as a table
+func Markdown(rows []Row, by string) string {
+	var table strings.Builder
+	fmt.Fprintf(&table, "| %s | Requests | Input | Cached | Output | Cost |\n|---|--:|--:|--:|--:|--:|\n", by)
+	for _, row := range rows {
+		fmt.Fprintf(&table, "| %s | %d | %d | %d | %d | $%.4f |\n", row.Key, row.Requests,
+			row.InputTokens, row.CachedTokens, row.OutputTokens, row.Cost)
+	}
+
+	return table.String()
+}
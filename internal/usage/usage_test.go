@@ -0,0 +1,76 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MelleKoning/aifun/internal/genaimodel"
+)
+
+func TestStoreAndReport(t *testing.T) {
+	store := &Store{Path: filepath.Join(t.TempDir(), "aifun", fileName)}
+	tracker := &Tracker{Store: store, Prices: NewPrices(map[string]genaimodel.Price{
+		"llama3.2": {Input: 1, Output: 2},
+	})}
+
+	old := Record{Time: time.Now().AddDate(0, -2, 0), Labels: Labels{Provider: "gemini", Model: "gemini-2.5-pro"},
+		Usage: genaimodel.Usage{InputTokens: 1000000}}
+	if err := store.Add(old); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record(Labels{Provider: "gemini", Model: "gemini-2.5-flash-preview", Session: "s1", Prompt: "review"},
+		genaimodel.Usage{InputTokens: 1000000, CachedTokens: 1000000, OutputTokens: 1000000})
+	tracker.Record(Labels{Provider: "ollama", Model: "llama3.2", Session: "s2"},
+		genaimodel.Usage{InputTokens: 500000, OutputTokens: 250000})
+	// a broken line is skipped
+	file, _ := os.OpenFile(store.Path, os.O_APPEND|os.O_WRONLY, 0o600)
+	_, _ = file.WriteString("{broken\n")
+	_ = file.Close()
+
+	records, err := tracker.Month(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Session != "s1" || records[1].OutputTokens != 250000 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	rows, err := tracker.Report(records, BySession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cached input and output of gemini-2.5-flash, the input
+	// and output of the configured price of llama3.2
+	if len(rows) != 3 || rows[0].Key != "s1" || rows[0].Cost != 0.075+2.50 || rows[1].Cost != 0.5+0.5 ||
+		rows[2].Key != "total" || rows[2].Requests != 2 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+	if rows, _ := tracker.Report(records, ByPrompt); rows[0].Key != "-" || rows[1].Key != "review" {
+		t.Errorf("expected a row without prompt, got %+v", rows)
+	}
+	if _, err := tracker.Report(records, "week"); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+	if table := Markdown(rows, BySession); !strings.Contains(table, "| s1 | 1 | 1000000 | 1000000 | 1000000 | $2.5750 |") {
+		t.Errorf("unexpected table %q", table)
+	}
+
+	if warning := tracker.Warning(); warning != "" {
+		t.Errorf("no budget should not warn, got %q", warning)
+	}
+	tracker.Budget = 4
+	if warning := tracker.Warning(); !strings.HasPrefix(warning, "Nearly at the monthly budget: spent $3.58 of $4.00") {
+		t.Errorf("unexpected warning %q", warning)
+	}
+	tracker.Budget = 3
+	if warning := tracker.Warning(); !strings.HasPrefix(warning, "Over the monthly budget") {
+		t.Errorf("unexpected warning %q", warning)
+	}
+	tracker.Budget = 10
+	if warning := tracker.Warning(); warning != "" {
+		t.Errorf("unexpected warning %q", warning)
+	}
+}